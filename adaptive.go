@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/rs/zerolog/log"
+)
+
+// adaptiveSmoothing is the weight of the newest sample in moving averages,
+// higher value makes scheduler react faster but also makes it more jumpy
+const adaptiveSmoothing = 0.3
+
+// adaptiveScheduler tunes LAPI pull interval and spacing between mikrotik updates
+// based on how long recent updates took and how often decisions arrive
+//
+// spacing between updates follows the update duration, so that the device
+// spends at most half of the time rebuilding address-lists,
+// pull interval goes from ticker_interval_min when there are no new decisions
+// up to the full update cycle when every pull brings changes, because then
+// pulling more often only adds requests which are merged anyway
+type adaptiveScheduler struct {
+	mutex    sync.Mutex
+	syncCost float64 // moving average of mikrotik update duration, in seconds
+	busy     float64 // moving average of pulls which brought changes, from 0 to 1
+	pull     time.Duration
+	spacing  time.Duration
+}
+
+func newAdaptiveScheduler() *adaptiveScheduler {
+	s := &adaptiveScheduler{
+		pull:    clampDuration(tickerInterval, tickerIntervalMin, tickerIntervalMax),
+		spacing: syncMinSpacing,
+	}
+	s.publish()
+	return s
+}
+
+// observeSync records duration of finished mikrotik update
+func (s *adaptiveScheduler) observeSync(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.syncCost == 0 {
+		s.syncCost = d.Seconds()
+	} else {
+		s.syncCost += adaptiveSmoothing * (d.Seconds() - s.syncCost)
+	}
+	s.adjust()
+}
+
+// observePull records if decisions pulled from LAPI changed the cache
+func (s *adaptiveScheduler) observePull(changed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sample := 0.0
+	if changed {
+		sample = 1
+	}
+	s.busy += adaptiveSmoothing * (sample - s.busy)
+	s.adjust()
+}
+
+// adjust recalculates pull interval and spacing, must be called with mutex held
+func (s *adaptiveScheduler) adjust() {
+	cost := time.Duration(s.syncCost * float64(time.Second))
+	s.spacing = clampDuration(cost, syncMinSpacing, syncMinSpacingMax)
+
+	cycle := syncDebounce + cost + s.spacing
+	pull := tickerIntervalMin + time.Duration(s.busy*float64(cycle-tickerIntervalMin))
+	s.pull = clampDuration(pull, tickerIntervalMin, tickerIntervalMax)
+	s.publish()
+}
+
+func (s *adaptiveScheduler) publish() {
+	metricAdaptiveTicker.Set(s.pull.Seconds())
+	metricAdaptiveSpacing.Set(s.spacing.Seconds())
+	metricAdaptiveSyncCost.Set(s.syncCost)
+	metricAdaptiveBusy.Set(s.busy)
+}
+
+// pullInterval returns current interval between LAPI pulls
+func (s *adaptiveScheduler) pullInterval() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pull
+}
+
+// minSpacing returns current minimum time between mikrotik updates
+func (s *adaptiveScheduler) minSpacing() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.spacing
+}
+
+func clampDuration(d, low, high time.Duration) time.Duration {
+	return max(low, min(d, high))
+}
+
+// adaptiveRestartRatio is how much pull interval must change before the stream is restarted with it,
+// every restart pulls all active decisions again, so small changes are ignored
+const adaptiveRestartRatio = 0.25
+
+// runAdaptiveStream runs StreamBouncer.Run with ticker interval chosen by the scheduler,
+// and restarts it when the interval changed by more than adaptiveRestartRatio
+//
+// ticker of StreamBouncer.Run can not be changed while it runs, restarted run begins with startup pull,
+// which returns all active decisions and the ones which expired or were deleted in the meantime
+func runAdaptiveStream(ctx context.Context, b *csbouncer.StreamBouncer, s *adaptiveScheduler) error {
+	for {
+		interval := s.pullInterval()
+		b.TickerIntervalDuration = interval
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- b.Run(runCtx)
+		}()
+
+		err := waitIntervalChange(ctx, s, interval, done)
+		cancel()
+		if err != nil {
+			return err
+		}
+		<-done
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Info().
+			Str("func", "runAdaptiveStream").
+			Str("interval", interval.String()).
+			Str("new_interval", s.pullInterval().String()).
+			Msg("LAPI pull interval changed, restarting decision stream")
+
+		// LAPI errors of restarted stream are retried instead of stopping the bouncer,
+		// the first pull already succeeded, or it is retried anyway
+		b.RetryInitialConnect = true
+	}
+}
+
+// waitIntervalChange returns nil when pull interval changed by more than adaptiveRestartRatio
+// from given interval, or error of the stream if it stopped
+func waitIntervalChange(ctx context.Context, s *adaptiveScheduler, interval time.Duration, done <-chan error) error {
+	check := time.NewTicker(tickerIntervalMin)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-done:
+			if err == nil {
+				err = errors.New("decision stream stopped")
+			}
+			return err
+		case <-check.C:
+			change := math.Abs(float64(s.pullInterval()-interval)) / float64(interval)
+			if change > adaptiveRestartRatio {
+				return nil
+			}
+		}
+	}
+}
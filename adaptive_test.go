@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+)
+
+func newTestScheduler() *adaptiveScheduler {
+	tickerInterval, tickerIntervalMin, tickerIntervalMax = 10*time.Second, 5*time.Second, 2*time.Minute
+	syncDebounce, syncMinSpacing, syncMinSpacingMax = time.Second, 2*time.Second, 30*time.Second
+	return newAdaptiveScheduler()
+}
+
+func TestAdaptiveSchedulerBounds(t *testing.T) {
+	s := newTestScheduler()
+	if got := s.pullInterval(); got != tickerInterval {
+		t.Errorf("initial pull interval = %s, want ticker_interval %s", got, tickerInterval)
+	}
+
+	// quick updates and no changes keep both at lower bounds
+	for range 20 {
+		s.observeSync(100 * time.Millisecond)
+		s.observePull(false)
+	}
+	if got := s.minSpacing(); got != syncMinSpacing {
+		t.Errorf("spacing after quick updates = %s, want sync_min_spacing %s", got, syncMinSpacing)
+	}
+	if got := s.pullInterval(); got != tickerIntervalMin {
+		t.Errorf("pull interval without changes = %s, want ticker_interval_min %s", got, tickerIntervalMin)
+	}
+
+	// slow updates with every pull bringing changes push both to upper bounds
+	for range 50 {
+		s.observeSync(5 * time.Minute)
+		s.observePull(true)
+	}
+	if got := s.minSpacing(); got != syncMinSpacingMax {
+		t.Errorf("spacing after slow updates = %s, want sync_min_spacing_max %s", got, syncMinSpacingMax)
+	}
+	if got := s.pullInterval(); got != tickerIntervalMax {
+		t.Errorf("pull interval when busy = %s, want ticker_interval_max %s", got, tickerIntervalMax)
+	}
+}
+
+func TestAdaptiveSchedulerFollowsCost(t *testing.T) {
+	s := newTestScheduler()
+
+	// first sample is taken as is, next ones are smoothed
+	s.observeSync(10 * time.Second)
+	if got := s.minSpacing(); got != 10*time.Second {
+		t.Errorf("spacing after first update = %s, want 10s", got)
+	}
+	s.observeSync(20 * time.Second)
+	if got, want := s.minSpacing(), 13*time.Second; got != want {
+		t.Errorf("spacing after second update = %s, want %s", got, want)
+	}
+
+	// pull interval grows with share of pulls which brought changes, up to the update cycle
+	previous := s.pullInterval()
+	for range 3 {
+		s.observePull(true)
+		got := s.pullInterval()
+		if got <= previous {
+			t.Errorf("pull interval = %s after busy pull, want more than %s", got, previous)
+		}
+		if cycle := syncDebounce + 2*s.minSpacing(); got > cycle {
+			t.Errorf("pull interval = %s, want at most update cycle %s", got, cycle)
+		}
+		previous = got
+	}
+}
+
+// lapiPull is request of fake LAPI decision stream
+type lapiPull struct {
+	at      time.Time
+	startup bool
+}
+
+func TestRunAdaptiveStream(t *testing.T) {
+	pulls := make(chan lapiPull, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulls <- lapiPull{time.Now(), r.URL.Query().Get("startup") == "true"}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"new":[],"deleted":[]}`)) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	tickerInterval, tickerIntervalMin, tickerIntervalMax = 40*time.Millisecond, 20*time.Millisecond, time.Second
+	syncDebounce, syncMinSpacing, syncMinSpacingMax = 0, 0, time.Second
+	s := newAdaptiveScheduler()
+
+	b := &csbouncer.StreamBouncer{APIKey: "key", APIUrl: srv.URL, TickerInterval: tickerInterval.String()}
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- runAdaptiveStream(ctx, b, s) }()
+	go func() {
+		for range b.Stream {
+		}
+	}()
+
+	next := func() lapiPull {
+		t.Helper()
+		select {
+		case p := <-pulls:
+			return p
+		case <-time.After(2 * time.Second):
+			t.Fatal("no LAPI pull")
+		}
+		return lapiPull{}
+	}
+
+	// stream runs with the initial interval while it does not change
+	if p := next(); !p.startup {
+		t.Error("first pull is not startup pull")
+	}
+	for range 5 {
+		if p := next(); p.startup {
+			t.Error("stream restarted without interval change")
+		}
+	}
+
+	// slow updates with every pull bringing changes make pull interval much longer
+	for range 20 {
+		s.observeSync(300 * time.Millisecond)
+		s.observePull(true)
+	}
+	interval := s.pullInterval()
+	p := next()
+	for !p.startup {
+		p = next()
+	}
+	if p2 := next(); p2.startup || p2.at.Sub(p.at) < interval*3/4 {
+		t.Errorf("pull %s after restart, want after new interval %s", p2.at.Sub(p.at), interval)
+	}
+	if !b.RetryInitialConnect {
+		t.Error("restarted stream does not retry LAPI errors")
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("runAdaptiveStream() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream did not stop")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// audit events, only state transitions of addresses are recorded
+const (
+	auditReceived     = "received"      // decision received from LAPI
+	auditCached       = "cached"        // address added to the cache
+	auditTTLExtended  = "ttl_extended"  // address already in the cache, got longer ttl
+	auditTTLShortened = "ttl_shortened" // address already in the cache, got shorter ttl
+	auditPushed       = "pushed"        // address pushed to mikrotik for the first time since it was cached
+	auditRemoved      = "removed"       // address removed from the cache by decision
+	auditExpired      = "expired"       // address expired in the cache
+)
+
+// audit is nil when audit_log is not set
+var audit *auditLog
+
+// auditDecision is a decision which put address in the cache
+type auditDecision struct {
+	id       int64
+	origin   string
+	scenario string
+	kind     string // decision type
+}
+
+func auditDecisionOf(decision *models.Decision) auditDecision {
+	return auditDecision{
+		id:       decision.ID,
+		origin:   *decision.Origin,
+		scenario: *decision.Scenario,
+		kind:     decisionTypeOf(decision),
+	}
+}
+
+// auditLog writes JSON line per address state transition to stdout or rotated file
+type auditLog struct {
+	logger zerolog.Logger
+	mutex  sync.Mutex
+
+	decisions map[string]auditDecision // list prefix + address -> last decision which cached it
+	pushed    map[string]struct{}      // list prefix + address, for addresses already pushed to mikrotik
+}
+
+func newAuditLog() *auditLog {
+	var w io.Writer = os.Stdout
+	if auditLogPath != "stdout" {
+		w = &lumberjack.Logger{
+			Filename:   auditLogPath,
+			MaxSize:    auditLogMaxSize,
+			MaxBackups: auditLogMaxBackups,
+			MaxAge:     auditLogMaxAge,
+			Compress:   auditLogCompress,
+		}
+	}
+	log.Info().
+		Str("func", "audit").
+		Str("audit_log", auditLogPath).
+		Msg("Audit log enabled")
+	return &auditLog{
+		logger:    zerolog.New(w).With().Timestamp().Str("log", "audit").Logger(),
+		decisions: map[string]auditDecision{},
+		pushed:    map[string]struct{}{},
+	}
+}
+
+func (a *auditLog) write(event string, list string, address string, d auditDecision, ttl time.Duration) {
+	e := a.logger.Log().
+		Str("event", event).
+		Str("address", address).
+		Int64("decision_id", d.id).
+		Str("origin", d.origin).
+		Str("scenario", d.scenario).
+		Str("type", d.kind)
+	if list != "" {
+		e = e.Str("list", list)
+	}
+	if ttl > 0 {
+		e = e.Str("ttl", ttl.String())
+	}
+	e.Send()
+}
+
+// received records decision received from LAPI, action is add or remove
+func (a *auditLog) received(action string, decision *models.Decision) {
+	if a == nil {
+		return
+	}
+	a.logger.Log().
+		Str("event", auditReceived).
+		Str("action", action).
+		Str("address", *decision.Value).
+		Int64("decision_id", decision.ID).
+		Str("origin", *decision.Origin).
+		Str("scenario", *decision.Scenario).
+		Str("type", decisionTypeOf(decision)).
+		Str("duration", *decision.Duration).
+		Send()
+}
+
+// cached records address added to the cache or its ttl change, event is one of auditCached, auditTTLExtended, auditTTLShortened
+func (a *auditLog) cached(event string, prefix string, address string, decision *models.Decision, ttl time.Duration) {
+	if a == nil {
+		return
+	}
+	d := auditDecisionOf(decision)
+	a.mutex.Lock()
+	a.decisions[prefix+" "+address] = d
+	a.mutex.Unlock()
+	a.write(event, prefix, address, d, ttl)
+}
+
+// removed records address removed from the cache, event is auditRemoved or auditExpired
+func (a *auditLog) removed(event string, prefix string, address string, decision *models.Decision) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	key := prefix + " " + address
+	d, ok := a.decisions[key]
+	delete(a.decisions, key)
+	delete(a.pushed, key)
+	a.mutex.Unlock()
+	if decision != nil {
+		d = auditDecisionOf(decision)
+	} else if !ok {
+		return
+	}
+	a.write(event, prefix, address, d, 0)
+}
+
+// pushedToList records addresses which are in mikrotik address-list listName for the first time since they were cached
+func (a *auditLog) pushedToList(prefix string, listName string, items map[string]*ttlcache.Item[string, cacheEntry]) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for address, item := range items {
+		key := prefix + " " + address
+		if _, ok := a.pushed[key]; ok {
+			continue
+		}
+		a.pushed[key] = struct{}{}
+		a.write(auditPushed, listName, address, a.decisions[key], remainingTTL(item))
+	}
+}
+
+// watchExpired records addresses expired in the cache of given list prefix
+func (a *auditLog) watchExpired(prefix string, cache *ttlcache.Cache[string, cacheEntry]) {
+	if a == nil {
+		return
+	}
+	cache.OnEviction(func(_ context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, cacheEntry]) {
+		if reason == ttlcache.EvictionReasonExpired {
+			a.removed(auditExpired, prefix, item.Key(), nil)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog"
+)
+
+// syncBuffer is bytes.Buffer safe for writes from eviction callbacks
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// events returns audit records written so far, and clears them
+func (b *syncBuffer) events(t *testing.T) []map[string]string {
+	t.Helper()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var out []map[string]string
+	scanner := bufio.NewScanner(&b.buf)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit record %s: %v", scanner.Text(), err)
+		}
+		event := map[string]string{}
+		for k, v := range record {
+			if s, ok := v.(string); ok {
+				event[k] = s
+			}
+		}
+		out = append(out, event)
+	}
+	b.buf.Reset()
+	return out
+}
+
+func startAudit(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	audit = &auditLog{
+		logger:    zerolog.New(buf),
+		decisions: map[string]auditDecision{},
+		pushed:    map[string]struct{}{},
+	}
+	t.Cleanup(func() { audit = nil })
+	return buf
+}
+
+// eventNames returns event names of records, skipping received decisions
+func eventNames(events []map[string]string) []string {
+	var names []string
+	for _, e := range events {
+		if e["event"] != auditReceived {
+			names = append(names, e["event"])
+		}
+	}
+	return names
+}
+
+func TestAuditTTLTransitions(t *testing.T) {
+	useIPV4, useIPV6 = true, true
+	useSettings(t, &settings{})
+	buf := startAudit(t)
+	mal := newTypedAddrList()
+
+	steps := []struct {
+		duration string
+		want     string
+	}{
+		{"4h", auditCached},
+		{"8h", auditTTLExtended},
+		{"1h", auditTTLShortened},
+		{"2h", auditTTLExtended},
+	}
+	for _, step := range steps {
+		decision := newDecision("192.0.2.1", "ban", false)
+		decision.Duration = &step.duration
+		mal.add(decision)
+
+		events := buf.events(t)
+		if len(events) != 2 || events[0]["event"] != auditReceived || events[0]["duration"] != step.duration {
+			t.Fatalf("duration %s: events = %v, want received decision first", step.duration, events)
+		}
+		got := events[1]
+		if got["event"] != step.want || got["address"] != "192.0.2.1" || got["list"] != addressList || got["scenario"] != "crowdsecurity/ssh-bf" {
+			t.Errorf("duration %s: event = %v, want %s", step.duration, got, step.want)
+		}
+		if want := mustDuration(t, step.duration).String(); got["ttl"] != want {
+			t.Errorf("duration %s: ttl = %s, want %s", step.duration, got["ttl"], want)
+		}
+	}
+
+	// address is reported as pushed only once per caching
+	audit.pushedToList(addressList, addressList+"_1", mal.cache.Items())
+	audit.pushedToList(addressList, addressList+"_2", mal.cache.Items())
+	events := buf.events(t)
+	if names := eventNames(events); len(names) != 1 || names[0] != auditPushed || events[0]["list"] != addressList+"_1" {
+		t.Errorf("events after two pushes = %v, want single pushed to the first list", events)
+	}
+
+	mal.remove(newDecision("192.0.2.1", "ban", false))
+	if names := eventNames(buf.events(t)); len(names) != 1 || names[0] != auditRemoved {
+		t.Errorf("events after remove = %v, want removed", names)
+	}
+
+	// cached again after removal, so it is pushed again
+	mal.add(newDecision("192.0.2.1", "ban", false))
+	audit.pushedToList(addressList, addressList+"_3", mal.cache.Items())
+	if names := eventNames(buf.events(t)); len(names) != 2 || names[0] != auditCached || names[1] != auditPushed {
+		t.Errorf("events after adding again = %v, want cached and pushed", names)
+	}
+}
+
+func TestAuditExpired(t *testing.T) {
+	buf := startAudit(t)
+	cache := ttlcache.New[string, cacheEntry]()
+	audit.watchExpired(addressList, cache)
+
+	decision := newDecision("192.0.2.7", "ban", false)
+	audit.cached(auditCached, addressList, "192.0.2.7", decision, time.Millisecond)
+	cache.Set("192.0.2.7", cacheEntry{origin: "crowdsec"}, time.Millisecond)
+	buf.events(t)
+
+	time.Sleep(5 * time.Millisecond)
+	cache.DeleteExpired()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		events := buf.events(t)
+		if len(events) > 0 {
+			if events[0]["event"] != auditExpired || events[0]["scenario"] != "crowdsecurity/ssh-bf" {
+				t.Errorf("event = %v, want expired with decision which cached the address", events[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no expired event")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func mustDuration(t *testing.T, s string) time.Duration {
+	t.Helper()
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
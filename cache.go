@@ -0,0 +1,170 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scenarios outside of top cache_metrics_top_scenarios are counted under this label
+const otherScenarios = "other"
+
+// buckets of remaining TTL of cached addresses, from 5 minutes to 30 days
+var cacheTTLBuckets = []float64{300, 900, 3600, 4 * 3600, 12 * 3600, 86400, 7 * 86400, 30 * 86400}
+
+// cacheEntry is decision of cached address, it becomes comment of address-list entry
+type cacheEntry struct {
+	origin   string // such as crowdsec, cscli or lists
+	scenario string // for lists origin this is the blocklist name
+	scope    string // decision scope, for AS and Country decisions with its value, such as 'Country:CN'
+}
+
+func newCacheEntry(decision *models.Decision) cacheEntry {
+	return cacheEntry{
+		origin:   *decision.Origin,
+		scenario: *decision.Scenario,
+		scope:    *decision.Scope,
+	}
+}
+
+// comment returns address-list entry comment, such as 'crowdsec crowdsecurity/ssh-bf Ip'
+func (e cacheEntry) comment() string {
+	// TODO: allow formatting comment for decision
+	return fmt.Sprintf("%s %s %s", e.origin, e.scenario, e.scope)
+}
+
+// usageOrigin returns origin in format used by other CrowdSec bouncers in usage metrics
+func (e cacheEntry) usageOrigin() string {
+	if e.origin == "" {
+		return "unknown"
+	}
+	if e.origin == "lists" && e.scenario != "" {
+		return "lists:" + e.scenario
+	}
+	return e.origin
+}
+
+// remainingTTL returns time until cached address expires, or 0 if it never expires
+func remainingTTL(item *ttlcache.Item[string, cacheEntry]) time.Duration {
+	if item.ExpiresAt().IsZero() {
+		return 0
+	}
+	return time.Until(item.ExpiresAt())
+}
+
+// cacheTTLCollector exports histogram of remaining TTL of cached addresses,
+// computed from the last snapshot of the caches instead of accumulated over time
+type cacheTTLCollector struct {
+	desc *prometheus.Desc
+
+	mutex      sync.Mutex
+	histograms map[[2]string]ttlHistogram // [list, proto]
+}
+
+type ttlHistogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+var cacheTTL = &cacheTTLCollector{
+	desc: prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_ttl_seconds"),
+		"Remaining TTL of cached addresses, by address-list prefix and proto, addresses without TTL are not counted",
+		[]string{"list", "proto"}, nil,
+	),
+	histograms: map[[2]string]ttlHistogram{},
+}
+
+func (c *cacheTTLCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *cacheTTLCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, h := range c.histograms {
+		ch <- prometheus.MustNewConstHistogram(c.desc, h.count, h.sum, h.buckets, key[0], key[1])
+	}
+}
+
+func (c *cacheTTLCollector) set(list string, proto string, ttls []time.Duration) {
+	h := ttlHistogram{buckets: map[float64]uint64{}}
+	for _, bucket := range cacheTTLBuckets {
+		h.buckets[bucket] = 0
+	}
+	for _, ttl := range ttls {
+		seconds := ttl.Seconds()
+		h.count++
+		h.sum += seconds
+		for _, bucket := range cacheTTLBuckets {
+			if seconds <= bucket {
+				h.buckets[bucket]++
+			}
+		}
+	}
+	c.mutex.Lock()
+	c.histograms[[2]string{list, proto}] = h
+	c.mutex.Unlock()
+}
+
+// recordCacheComposition sets number of cached addresses of given address-list prefix
+// per protocol, origin and top scenarios, and the histogram of their remaining TTL
+func recordCacheComposition(list string, items map[string]*ttlcache.Item[string, cacheEntry]) {
+	type originKey struct{ proto, origin string }
+	protos := map[string]int{"ip": 0, "ipv6": 0}
+	origins := map[originKey]int{}
+	scenarios := map[string]int{}
+	ttls := map[string][]time.Duration{"ip": nil, "ipv6": nil}
+
+	for address, item := range items {
+		proto := getProtoCmd(address)
+		entry := item.Value()
+		protos[proto]++
+		origins[originKey{proto, entry.origin}]++
+		scenarios[entry.scenario]++
+		if !item.ExpiresAt().IsZero() {
+			ttls[proto] = append(ttls[proto], time.Until(item.ExpiresAt()))
+		}
+	}
+
+	for proto, n := range protos {
+		metricCacheEntries.WithLabelValues(proto, list).Set(float64(n))
+	}
+
+	// origins and scenarios which are no longer in the cache must disappear from metrics
+	metricCacheOrigins.DeletePartialMatch(prometheus.Labels{"list": list})
+	for k, n := range origins {
+		metricCacheOrigins.WithLabelValues(list, k.proto, k.origin).Set(float64(n))
+	}
+
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(scenarios[b], scenarios[a]), cmp.Compare(a, b))
+	})
+	metricCacheScenarios.DeletePartialMatch(prometheus.Labels{"list": list})
+	other := 0
+	for i, name := range names {
+		if i >= cacheMetricsTopScenarios {
+			other += scenarios[name]
+			continue
+		}
+		metricCacheScenarios.WithLabelValues(list, name).Set(float64(scenarios[name]))
+	}
+	if other > 0 {
+		metricCacheScenarios.WithLabelValues(list, otherScenarios).Set(float64(other))
+	}
+
+	for proto, durations := range ttls {
+		cacheTTL.set(list, proto, durations)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// histogramCount returns number of observations of cache TTL histogram with given labels,
+// the collector is registered in intitMetrics, so it is read directly
+func histogramCount(list string, proto string) uint64 {
+	cacheTTL.mutex.Lock()
+	defer cacheTTL.mutex.Unlock()
+	return cacheTTL.histograms[[2]string{list, proto}].count
+}
+
+func TestCacheEntryComment(t *testing.T) {
+	e := cacheEntry{"crowdsec", "crowdsecurity/ssh-bf", "Ip"}
+	if got, want := e.comment(), "crowdsec crowdsecurity/ssh-bf Ip"; got != want {
+		t.Errorf("comment() = %q, want %q", got, want)
+	}
+}
+
+func TestRecordCacheComposition(t *testing.T) {
+	cacheMetricsTopScenarios = 2
+	const list = "crowdsec_composition"
+
+	cache := ttlcache.New[string, cacheEntry]()
+	for i := range 3 {
+		cache.Set(fmt.Sprintf("192.0.2.%d", i), cacheEntry{"crowdsec", "crowdsecurity/ssh-bf", "Ip"}, time.Hour)
+	}
+	for i := range 2 {
+		cache.Set(fmt.Sprintf("198.51.100.%d", i), cacheEntry{"cscli", "manual", "Ip"}, time.Hour)
+	}
+	cache.Set("203.0.113.1", cacheEntry{"lists", "firehol", "Ip"}, time.Hour)
+	cache.Set("2001:db8::1/128", cacheEntry{"crowdsec", "crowdsecurity/http-probing", "Ip"}, ttlcache.DefaultTTL)
+	recordCacheComposition(list, cache.Items())
+
+	gauges := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"cs_mikrotik_bouncer_cache_entries", map[string]string{"list": list, "proto": "ip"}, 6},
+		{"cs_mikrotik_bouncer_cache_entries", map[string]string{"list": list, "proto": "ipv6"}, 1},
+		{"cs_mikrotik_bouncer_cache_origin_entries", map[string]string{"list": list, "proto": "ip", "origin": "crowdsec"}, 3},
+		{"cs_mikrotik_bouncer_cache_origin_entries", map[string]string{"list": list, "proto": "ip", "origin": "cscli"}, 2},
+		{"cs_mikrotik_bouncer_cache_origin_entries", map[string]string{"list": list, "proto": "ipv6", "origin": "crowdsec"}, 1},
+		{"cs_mikrotik_bouncer_cache_scenario_entries", map[string]string{"list": list, "scenario": "crowdsecurity/ssh-bf"}, 3},
+		{"cs_mikrotik_bouncer_cache_scenario_entries", map[string]string{"list": list, "scenario": "manual"}, 2},
+		{"cs_mikrotik_bouncer_cache_scenario_entries", map[string]string{"list": list, "scenario": "firehol"}, 0},
+		{"cs_mikrotik_bouncer_cache_scenario_entries", map[string]string{"list": list, "scenario": otherScenarios}, 2},
+	}
+	for _, g := range gauges {
+		if got := metricValue(t, g.name, g.labels); got != g.want {
+			t.Errorf("%s%v = %v, want %v", g.name, g.labels, got, g.want)
+		}
+	}
+	// addresses without TTL are not in the histogram
+	if got := histogramCount(list, "ip"); got != 6 {
+		t.Errorf("ip ttl histogram count = %d, want 6", got)
+	}
+	if got := histogramCount(list, "ipv6"); got != 0 {
+		t.Errorf("ipv6 ttl histogram count = %d, want 0", got)
+	}
+
+	// origins and scenarios which left the cache are removed from metrics
+	cache.DeleteAll()
+	cache.Set("192.0.2.1", cacheEntry{"cscli", "manual", "Ip"}, time.Hour)
+	recordCacheComposition(list, cache.Items())
+	if got := metricValue(t, "cs_mikrotik_bouncer_cache_origin_entries", map[string]string{"list": list, "origin": "crowdsec"}); got != 0 {
+		t.Errorf("crowdsec origin still exported with %v entries", got)
+	}
+	if got := metricValue(t, "cs_mikrotik_bouncer_cache_scenario_entries", map[string]string{"list": list, "scenario": otherScenarios}); got != 0 {
+		t.Errorf("other scenarios still exported with %v entries", got)
+	}
+	if got := metricValue(t, "cs_mikrotik_bouncer_cache_scenario_entries", map[string]string{"list": list, "scenario": "manual"}); got != 1 {
+		t.Errorf("manual scenario = %v, want 1", got)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"maps"
 	"os"
-	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -19,44 +21,57 @@ var (
 	crowdsecBouncerURL    string   // url to crowdsec lapi
 	crowdsecOrigins       []string // CORS
 
+	crowdsecCertPath            string   // client certificate to authenticate in LAPI instead of API key
+	crowdsecKeyPath             string   // client certificate key to authenticate in LAPI instead of API key
+	crowdsecCAPath              string   // CA to verify LAPI certificate
+	crowdsecInsecureSkipVerify  *bool    // skip LAPI certificate verification, nil means library default
+	crowdsecRetryInitConnect    bool     // retry initial connection to LAPI instead of exiting
+	crowdsecScopes              []string // decision scopes to request from LAPI
+	crowdsecScenariosContain    []string // request only decisions with scenarios containing these strings
+	crowdsecScenariosNotContain []string // skip decisions with scenarios containing these strings
+
+	// how often to report remediation usage metrics to LAPI, 0 disables reporting
+	usageMetricsInterval time.Duration
+
 	// use this for coding debug sessions only
 	// max decisions to use when processing,
 	// set to low as 3 to enable, thus limiting number of items processed
 	// default -1, means process everything
 	debugDecisionsMax int
 
-	// default time for items without TTL,
-	// this is required to allow automatic list expiry, if unsure set it to 1d
-	defaultTTL time.Duration
-
-	// default time for items with TTL, this is used to truncate incoming TTL
-	// to specific value to prevent of address-list with addresses
-	// which would expire after few days
-	// default 24h
-	// we assume that we get updates from crowdsec at least once per hour
-	// so 1 day seems reasonable for now
-	maxTTL time.Duration
+	configFile string // optional config file, reloaded on change
 
-	// set to true if you want to use maxTTL
-	useMaxTTL bool
+	// separate address-lists for decision types other than ban, such as captcha or throttle,
+	// decisions of types not listed here are ignored
+	typedLists map[string]*typedList
 
-	listNameFormat string // "static" or "dynamic" option for Addresslist name
+	// static address-list without timeout for bans without TTL, empty keeps them in mikrotik_address_list
+	permanentList string
 
-	enableFirewallFilter bool   // enable updating firewall filter rules
-	srcFilterRuleIdsIPv4 string // comma separated firewall filter rule ids for IPv4 for source rules
-	srcFilterRuleIdsIPv6 string // comma separated firewall filter rule ids for IPv6 for source rules
-	dstFilterRuleIdsIPv4 string // comma separated firewall filter rule ids for IPv4 for destination rules
-	dstFilterRuleIdsIPv6 string // comma separated firewall filter rule ids for IPv6 for destination rules
+	enableFirewallFilter bool // enable updating firewall filter rules
+	enableFirewallRaw    bool // enable updating firewall raw rules
 
-	enableFirewallRaw bool   // enable updating firewall raw rules
-	srcRawRuleIdsIPv4 string // comma separated firewall raw rule ids for IPv4 for source rules
-	srcRawRuleIdsIPv6 string // comma separated firewall raw rule ids for IPv6 for source rules
-	dstRawRuleIdsIPv4 string // comma separated firewall raw rule ids for IPv4 for destination rules
-	dstRawRuleIdsIPv6 string // comma separated firewall raw rule ids for IPv6 for destination rules
+	otelTracesEnable    bool          // export traces over OTLP
+	otelMetricsEnable   bool          // export prometheus metrics over OTLP
+	otelProtocol        string        // OTLP protocol, 'grpc' or 'http'
+	otelEndpoint        string        // OTLP collector address, host:port
+	otelInsecure        bool          // disable TLS for OTLP export
+	otelSampleRatio     float64       // fraction of traces to export
+	otelMetricsInterval time.Duration // how often to export metrics over OTLP
 
-	logLevel    string // 0=debug, 1=info
 	metricsAddr string // prometheus listen address
 
+	metricsTLSCertFile   string        // serve metrics over TLS with this certificate
+	metricsTLSKeyFile    string        // key for metricsTLSCertFile
+	metricsBasicAuthUser string        // require basic auth to access metrics
+	metricsBasicAuthPass string        // password for metricsBasicAuthUser
+	metricsBearerToken   string        // require bearer token to access metrics
+	metricsPprof         bool          // expose /debug/pprof handlers
+	metricsReadTimeout   time.Duration // metrics server read timeout
+	metricsWriteTimeout  time.Duration // metrics server write timeout, must be longer than pprof profile duration
+
+	cacheMetricsTopScenarios int // scenarios with own label in cache_scenario_entries metric, the rest is 'other'
+
 	mikrotikHost string        // address of the mikrotik device
 	password     string        // mikrotik api password
 	timeout      time.Duration //mikrotik command timeout duration
@@ -65,22 +80,103 @@ var (
 	username     string        // mikrotik api username
 	useTLS       bool          // use TLS in communication with mikrotik
 
+	mikrotikTLSConfig *tls.Config // TLS settings for connection to mikrotik, built from mikrotik_tls_* options
+
+	leaderElection       string        // leader election backend, empty to disable, 'file' or 'kubernetes'
+	leaderLockFile       string        // lock file for 'file' leader election
+	leaderLeaseName      string        // kubernetes Lease name for 'kubernetes' leader election
+	leaderLeaseNamespace string        // kubernetes Lease namespace, defaults to pod namespace
+	leaderIdentity       string        // identity of this replica, defaults to hostname
+	leaderLeaseDuration  time.Duration // how long lease is valid without renewal
+	leaderRetryInterval  time.Duration // how often to try to acquire or renew leadership
+
+	auditLogPath       string // audit log file, 'stdout', or empty to disable audit log
+	auditLogMaxSize    int    // megabytes of audit log file before it is rotated
+	auditLogMaxBackups int    // number of rotated audit log files to keep
+	auditLogMaxAge     int    // days to keep rotated audit log files
+	auditLogCompress   bool   // gzip rotated audit log files
+
+	hookWebhookURL              string        // url to POST hook events to, empty disables webhook
+	hookWebhookTemplate         string        // 'generic', 'slack', 'mattermost', 'teams' or path to payload template file
+	hookExec                    string        // command to run on hook events, empty disables exec hook
+	hookEnabledEvents           []string      // hook events to send
+	hookConsecutiveFailureCount int           // number of failed updates in a row which sends consecutive_failures event
+	hookRateLimit               time.Duration // minimal interval between notifications of the same event
+	hookTimeout                 time.Duration // timeout of webhook request or exec hook run
+
+	geoCountryDB      []string      // MMDB or CSV files with country prefixes, to resolve Country scoped decisions
+	geoASNDB          []string      // MMDB or CSV files with AS prefixes, to resolve AS scoped decisions
+	geoMaxPrefixes    int           // decisions resolved to more prefixes are skipped
+	geoReloadInterval time.Duration // how often to check if geo database files changed, 0 disables reload
+
+	mikrotikShards  int    // number of address-lists to split addresses into, filled in parallel
+	syncStrategy    string // how to add addresses to new address-list, 'api' or 'script'
+	scriptChunkSize int    // max size of generated script source, in bytes
+
+	mikrotikTransport     string      // 'api' for binary API, 'rest' for REST API
+	mikrotikRESTURL       string      // base url of the router for REST API, such as https://192.168.88.1
+	mikrotikRESTTLSConfig *tls.Config // TLS settings for REST API, built from mikrotik_rest_tls_* options
+
+	keepaliveInterval   time.Duration // how often to check if connection to mikrotik is alive
+	reconnectBackoffMin time.Duration // initial delay between reconnect attempts
+	reconnectBackoffMax time.Duration // max delay between reconnect attempts
+
+	errPolicy  map[string]string // what to do on failed mikrotik command, per error class
+	errRetries int               // how many times to retry failed command if policy is 'retry'
+	// initial delay between retries of failed command, doubled on each retry up to errRetryDelayMax
+	errRetryDelay time.Duration
+
 	// run mikrotik address-list+fw update on received decision event
 	// defaults to true if you want faster blocking/unblocking
 	triggerOnUpdate bool
+
+	syncDebounce   time.Duration // wait for requests to stop coming before running mikrotik update
+	syncMaxDelay   time.Duration // max time between the first request and mikrotik update
+	syncMinSpacing time.Duration // min time between end of mikrotik update and start of the next one
+	// how often to collect address-list sizes and firewall rule counters from mikrotik, 0 disables it
+	routerStatsInterval time.Duration
+
+	driftInterval time.Duration // how often to check firewall rules for drift, 0 disables it
+	driftPolicy   string        // 'heal' or 'alert'
+
+	preflightEnable bool // check router and firewall rules on startup and before each update
+
 	//mikrotik update frequency to process create new address list and update firewall
 	updateFreq time.Duration
 
 	// how frequently process streamed decisions from CrowdSec LAPI
-	// the best if this is as close to the total time used to update MikroTik
-	// address lists and firewall as possible
-	// if you get frequent delays in acquiring lock then try to increase this value
 	tickerInterval time.Duration
+
+	adaptiveSchedule  bool          // tune ticker_interval and sync_min_spacing based on measured update duration
+	tickerIntervalMin time.Duration // lower bound of adaptive ticker interval
+	tickerIntervalMax time.Duration // upper bound of adaptive ticker interval
+	syncMinSpacingMax time.Duration // upper bound of adaptive spacing between mikrotik updates
+)
+
+// transports which can be used to run commands on mikrotik
+const (
+	transportAPI  = "api"
+	transportREST = "rest"
 )
 
+// decision scopes which can be turned into address-list entries
+var supportedScopes = []string{"ip", "range", scopeAS, scopeCountry}
+
 func initConfig() {
 
-	// TODO: allow loading config from file, because using env vars is insecure
+	// settings from environment variables take precedence over config file
+	viper.BindEnv("config_file") //nolint:errcheck
+	configFile = viper.GetString("config_file")
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			log.Fatal().
+				Err(err).
+				Str("func", "config").
+				Str("config_file", configFile).
+				Msg("Failed to read config file")
+		}
+	}
 
 	viper.BindEnv("log_format_json") //nolint:errcheck
 	viper.SetDefault("log_format_json", "true")
@@ -92,8 +188,7 @@ func initConfig() {
 
 	viper.BindEnv("log_level") //nolint:errcheck
 	viper.SetDefault("log_level", "1")
-	logLevel = viper.GetString("log_level")
-	level, err := zerolog.ParseLevel(logLevel)
+	level, err := zerolog.ParseLevel(viper.GetString("log_level"))
 	if err != nil {
 		log.Fatal().
 			Err(err).
@@ -110,6 +205,104 @@ func initConfig() {
 	viper.SetDefault("metrics_address", ":2112")
 	metricsAddr = viper.GetString("metrics_address")
 
+	viper.BindEnv("metrics_tls_cert_file") //nolint:errcheck
+	metricsTLSCertFile = viper.GetString("metrics_tls_cert_file")
+	viper.BindEnv("metrics_tls_key_file") //nolint:errcheck
+	metricsTLSKeyFile = viper.GetString("metrics_tls_key_file")
+	if (metricsTLSCertFile == "") != (metricsTLSKeyFile == "") {
+		log.Fatal().
+			Str("func", "config").
+			Msg("Both metrics_tls_cert_file and metrics_tls_key_file must be set")
+	}
+
+	viper.BindEnv("metrics_basic_auth_user") //nolint:errcheck
+	metricsBasicAuthUser = viper.GetString("metrics_basic_auth_user")
+	viper.BindEnv("metrics_basic_auth_pass") //nolint:errcheck
+	metricsBasicAuthPass = viper.GetString("metrics_basic_auth_pass")
+	if metricsBasicAuthUser != "" && metricsBasicAuthPass == "" {
+		log.Fatal().
+			Str("func", "config").
+			Msg("metrics_basic_auth_pass is required when metrics_basic_auth_user is set")
+	}
+
+	viper.BindEnv("metrics_bearer_token") //nolint:errcheck
+	metricsBearerToken = viper.GetString("metrics_bearer_token")
+
+	viper.BindEnv("metrics_pprof_enable") //nolint:errcheck
+	viper.SetDefault("metrics_pprof_enable", "false")
+	metricsPprof = viper.GetBool("metrics_pprof_enable")
+
+	viper.BindEnv("metrics_read_timeout") //nolint:errcheck
+	viper.SetDefault("metrics_read_timeout", "10s")
+	metricsReadTimeout = viper.GetDuration("metrics_read_timeout")
+
+	viper.BindEnv("metrics_write_timeout") //nolint:errcheck
+	viper.SetDefault("metrics_write_timeout", "60s")
+	metricsWriteTimeout = viper.GetDuration("metrics_write_timeout")
+	if metricsReadTimeout <= 0 || metricsWriteTimeout <= 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("metrics_read_timeout", metricsReadTimeout.String()).
+			Str("metrics_write_timeout", metricsWriteTimeout.String()).
+			Msg("metrics_read_timeout and metrics_write_timeout can not be equal zero or negative")
+	}
+
+	viper.BindEnv("cache_metrics_top_scenarios") //nolint:errcheck
+	viper.SetDefault("cache_metrics_top_scenarios", "10")
+	cacheMetricsTopScenarios = viper.GetInt("cache_metrics_top_scenarios")
+	if cacheMetricsTopScenarios < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("cache_metrics_top_scenarios", viper.GetString("cache_metrics_top_scenarios")).
+			Msg("cache_metrics_top_scenarios can not be negative")
+	}
+
+	viper.BindEnv("otel_traces_enable") //nolint:errcheck
+	viper.SetDefault("otel_traces_enable", "false")
+	otelTracesEnable = viper.GetBool("otel_traces_enable")
+
+	viper.BindEnv("otel_metrics_enable") //nolint:errcheck
+	viper.SetDefault("otel_metrics_enable", "false")
+	otelMetricsEnable = viper.GetBool("otel_metrics_enable")
+
+	viper.BindEnv("otel_protocol") //nolint:errcheck
+	viper.SetDefault("otel_protocol", "grpc")
+	otelProtocol = viper.GetString("otel_protocol")
+	if otelProtocol != "grpc" && otelProtocol != "http" {
+		log.Fatal().
+			Str("func", "config").
+			Str("otel_protocol", otelProtocol).
+			Msg("otel_protocol must be 'grpc' or 'http'")
+	}
+
+	viper.BindEnv("otel_endpoint") //nolint:errcheck
+	viper.SetDefault("otel_endpoint", "localhost:4317")
+	otelEndpoint = viper.GetString("otel_endpoint")
+
+	viper.BindEnv("otel_insecure") //nolint:errcheck
+	viper.SetDefault("otel_insecure", "false")
+	otelInsecure = viper.GetBool("otel_insecure")
+
+	viper.BindEnv("otel_sample_ratio") //nolint:errcheck
+	viper.SetDefault("otel_sample_ratio", "1")
+	otelSampleRatio = viper.GetFloat64("otel_sample_ratio")
+	if otelSampleRatio < 0 || otelSampleRatio > 1 {
+		log.Fatal().
+			Str("func", "config").
+			Str("otel_sample_ratio", viper.GetString("otel_sample_ratio")).
+			Msg("otel_sample_ratio must be between 0 and 1")
+	}
+
+	viper.BindEnv("otel_metrics_interval") //nolint:errcheck
+	viper.SetDefault("otel_metrics_interval", "60s")
+	otelMetricsInterval = viper.GetDuration("otel_metrics_interval")
+	if otelMetricsInterval <= 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("otel_metrics_interval", viper.GetString("otel_metrics_interval")).
+			Msg("otel_metrics_interval value can not be equal zero or negative")
+	}
+
 	viper.BindEnv("mikrotik_host") //nolint:errcheck
 	mikrotikHost = viper.GetString("mikrotik_host")
 
@@ -133,6 +326,47 @@ func initConfig() {
 	viper.SetDefault("mikrotik_tls", "true")
 	useTLS = viper.GetBool("mikrotik_tls")
 
+	mikrotikTLSConfig = tlsConfigFromEnv("mikrotik_tls", useTLS)
+
+	viper.BindEnv("mikrotik_transport") //nolint:errcheck
+	viper.SetDefault("mikrotik_transport", transportAPI)
+	mikrotikTransport = viper.GetString("mikrotik_transport")
+	if mikrotikTransport != transportAPI && mikrotikTransport != transportREST {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_transport", mikrotikTransport).
+			Msgf("mikrotik_transport must be '%s' or '%s'", transportAPI, transportREST)
+	}
+
+	viper.BindEnv("mikrotik_rest_url") //nolint:errcheck
+	mikrotikRESTURL = viper.GetString("mikrotik_rest_url")
+	if mikrotikTransport == transportREST && mikrotikRESTURL == "" {
+		log.Fatal().
+			Str("func", "config").
+			Msg("mikrotik_rest_url must be set when mikrotik_transport is 'rest'")
+	}
+	mikrotikRESTTLSConfig = tlsConfigFromEnv("mikrotik_rest_tls", strings.HasPrefix(mikrotikRESTURL, "https://"))
+
+	viper.BindEnv("mikrotik_sync_strategy") //nolint:errcheck
+	viper.SetDefault("mikrotik_sync_strategy", syncStrategyAPI)
+	syncStrategy = viper.GetString("mikrotik_sync_strategy")
+	if syncStrategy != syncStrategyAPI && syncStrategy != syncStrategyScript {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_sync_strategy", syncStrategy).
+			Msgf("mikrotik_sync_strategy must be '%s' or '%s'", syncStrategyAPI, syncStrategyScript)
+	}
+
+	viper.BindEnv("mikrotik_script_chunk_size") //nolint:errcheck
+	viper.SetDefault("mikrotik_script_chunk_size", "16384")
+	scriptChunkSize = viper.GetInt("mikrotik_script_chunk_size")
+	if scriptChunkSize < 1024 || scriptChunkSize > 65535 {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_script_chunk_size", viper.GetString("mikrotik_script_chunk_size")).
+			Msg("mikrotik_script_chunk_size must be between 1024 and 65535")
+	}
+
 	viper.BindEnv("mikrotik_ipv4") //nolint:errcheck
 	viper.SetDefault("mikrotik_ipv4", "true")
 	useIPV4 = viper.GetBool("mikrotik_ipv4")
@@ -149,14 +383,6 @@ func initConfig() {
 	viper.SetDefault("mikrotik_firewall_raw_enable", "true")
 	enableFirewallRaw = viper.GetBool("mikrotik_firewall_raw_enable")
 
-	viper.BindEnv("mikrotik_address_list_name_format") //nolint:errcheck
-	viper.SetDefault("mikrotik_address_list_name_format", "dynamic")
-
-	listNameFormat = viper.GetString("mikrotik_address_list_name_format")
-	if listNameFormat != "static" && listNameFormat != "dynamic" {
-		log.Fatal().Str("func", "config").Msg("mikrotik_address_list_name_format must be 'static' or 'dynamic'")
-	}
-
 	viper.BindEnv("mikrotik_address_list") //nolint:errcheck
 	viper.SetDefault("mikrotik_address_list", "crowdsec")
 	addressList = viper.GetString("mikrotik_address_list")
@@ -166,26 +392,35 @@ func initConfig() {
 			Msg("mikrotik_address_list cannot be empty")
 	}
 
-	if useIPV4 {
-		if enableFirewallFilter {
-			srcFilterRuleIdsIPv4 = cfgValidateFirewall("ip_firewall_filter_rules_src")
-			dstFilterRuleIdsIPv4 = cfgValidateFirewall("ip_firewall_filter_rules_dst")
-		}
-		if enableFirewallRaw {
-			srcRawRuleIdsIPv4 = cfgValidateFirewall("ip_firewall_raw_rules_src")
-			dstRawRuleIdsIPv4 = cfgValidateFirewall("ip_firewall_raw_rules_dst")
-		}
+	viper.BindEnv("decision_type_lists") //nolint:errcheck
+	viper.SetDefault("decision_type_lists", nil)
+	typedLists, err = parseTypeLists(viper.GetStringSlice("decision_type_lists"))
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("func", "config").
+			Str("decision_type_lists", viper.GetString("decision_type_lists")).
+			Msg("Failed to parse decision_type_lists")
 	}
 
-	if useIPV6 {
-		if enableFirewallFilter {
-			srcFilterRuleIdsIPv6 = cfgValidateFirewall("ipv6_firewall_filter_rules_src")
-			dstFilterRuleIdsIPv6 = cfgValidateFirewall("ipv6_firewall_filter_rules_dst")
+	viper.BindEnv("permanent_list") //nolint:errcheck
+	viper.SetDefault("permanent_list", "")
+	permanentList = viper.GetString("permanent_list")
+	if permanentList != "" {
+		reserved := permanentList == addressList
+		for _, list := range typedLists {
+			reserved = reserved || permanentList == list.prefix
 		}
-		if enableFirewallRaw {
-			srcRawRuleIdsIPv6 = cfgValidateFirewall("ipv6_firewall_raw_rules_src")
-			dstRawRuleIdsIPv6 = cfgValidateFirewall("ipv6_firewall_raw_rules_dst")
+		if reserved {
+			log.Fatal().
+				Str("func", "config").
+				Str("permanent_list", permanentList).
+				Msg("permanent_list must differ from mikrotik_address_list and decision_type_lists prefixes")
 		}
+		log.Warn().
+			Str("func", "config").
+			Str("permanent_list", permanentList).
+			Msg("Bouncer owns static entries of permanent_list, entries without timeout which are not bans from LAPI are removed")
 	}
 
 	viper.BindEnv("mikrotik_timeout") //nolint:errcheck
@@ -200,6 +435,102 @@ func initConfig() {
 			Msg("Failed to parse mikrotik_timeout")
 	}
 
+	viper.BindEnv("mikrotik_keepalive_interval") //nolint:errcheck
+	viper.SetDefault("mikrotik_keepalive_interval", "30s")
+	keepaliveInterval = viper.GetDuration("mikrotik_keepalive_interval")
+	if keepaliveInterval <= 0*time.Second {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_keepalive_interval", viper.GetString("mikrotik_keepalive_interval")).
+			Msg("mikrotik_keepalive_interval value can not be equal zero or negative")
+	}
+
+	viper.BindEnv("mikrotik_reconnect_backoff_min") //nolint:errcheck
+	viper.SetDefault("mikrotik_reconnect_backoff_min", "1s")
+	reconnectBackoffMin = viper.GetDuration("mikrotik_reconnect_backoff_min")
+	if reconnectBackoffMin <= 0*time.Second {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_reconnect_backoff_min", viper.GetString("mikrotik_reconnect_backoff_min")).
+			Msg("mikrotik_reconnect_backoff_min value can not be equal zero or negative")
+	}
+
+	viper.BindEnv("mikrotik_reconnect_backoff_max") //nolint:errcheck
+	viper.SetDefault("mikrotik_reconnect_backoff_max", "5m")
+	reconnectBackoffMax = viper.GetDuration("mikrotik_reconnect_backoff_max")
+	if reconnectBackoffMax < reconnectBackoffMin {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_reconnect_backoff_min", viper.GetString("mikrotik_reconnect_backoff_min")).
+			Str("mikrotik_reconnect_backoff_max", viper.GetString("mikrotik_reconnect_backoff_max")).
+			Msg("mikrotik_reconnect_backoff_max can not be shorter than mikrotik_reconnect_backoff_min")
+	}
+
+	viper.BindEnv("mikrotik_error_policy") //nolint:errcheck
+	viper.SetDefault("mikrotik_error_policy", "")
+	errPolicy, err = parseErrPolicy(viper.GetString("mikrotik_error_policy"))
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("func", "config").
+			Str("mikrotik_error_policy", viper.GetString("mikrotik_error_policy")).
+			Msg("Failed to parse mikrotik_error_policy")
+	}
+
+	viper.BindEnv("mikrotik_error_retries") //nolint:errcheck
+	viper.SetDefault("mikrotik_error_retries", "3")
+	errRetries = viper.GetInt("mikrotik_error_retries")
+	if errRetries < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_error_retries", viper.GetString("mikrotik_error_retries")).
+			Msg("mikrotik_error_retries can not be negative")
+	}
+
+	viper.BindEnv("mikrotik_error_retry_delay") //nolint:errcheck
+	viper.SetDefault("mikrotik_error_retry_delay", "500ms")
+	errRetryDelay = viper.GetDuration("mikrotik_error_retry_delay")
+	if errRetryDelay <= 0 || errRetryDelay > errRetryDelayMax {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_error_retry_delay", viper.GetString("mikrotik_error_retry_delay")).
+			Msgf("mikrotik_error_retry_delay must be greater than zero and not longer than %s", errRetryDelayMax)
+	}
+
+	viper.BindEnv("mikrotik_stats_interval") //nolint:errcheck
+	viper.SetDefault("mikrotik_stats_interval", "5m")
+	routerStatsInterval = viper.GetDuration("mikrotik_stats_interval")
+	if routerStatsInterval < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_stats_interval", viper.GetString("mikrotik_stats_interval")).
+			Msg("mikrotik_stats_interval can not be negative")
+	}
+
+	viper.BindEnv("mikrotik_preflight") //nolint:errcheck
+	viper.SetDefault("mikrotik_preflight", "true")
+	preflightEnable = viper.GetBool("mikrotik_preflight")
+
+	viper.BindEnv("firewall_drift_interval") //nolint:errcheck
+	viper.SetDefault("firewall_drift_interval", "1m")
+	driftInterval = viper.GetDuration("firewall_drift_interval")
+	if driftInterval < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("firewall_drift_interval", viper.GetString("firewall_drift_interval")).
+			Msg("firewall_drift_interval can not be negative")
+	}
+
+	viper.BindEnv("firewall_drift_policy") //nolint:errcheck
+	viper.SetDefault("firewall_drift_policy", driftPolicyHeal)
+	driftPolicy = viper.GetString("firewall_drift_policy")
+	if driftPolicy != driftPolicyHeal && driftPolicy != driftPolicyAlert {
+		log.Fatal().
+			Str("func", "config").
+			Str("firewall_drift_policy", driftPolicy).
+			Msg("firewall_drift_policy must be 'heal' or 'alert'")
+	}
+
 	viper.BindEnv("mikrotik_update_frequency") //nolint:errcheck
 	viper.SetDefault("mikrotik_update_frequency", "1h")
 	updateFreq = viper.GetDuration("mikrotik_update_frequency")
@@ -217,12 +548,118 @@ func initConfig() {
 
 	viper.BindEnv("crowdsec_bouncer_api_key") //nolint:errcheck
 	crowdsecBouncerAPIKey = viper.GetString("crowdsec_bouncer_api_key")
-	if crowdsecBouncerAPIKey == "" {
+
+	viper.BindEnv("crowdsec_cert_path") //nolint:errcheck
+	crowdsecCertPath = viper.GetString("crowdsec_cert_path")
+
+	viper.BindEnv("crowdsec_key_path") //nolint:errcheck
+	crowdsecKeyPath = viper.GetString("crowdsec_key_path")
+
+	viper.BindEnv("crowdsec_ca_cert_path") //nolint:errcheck
+	crowdsecCAPath = viper.GetString("crowdsec_ca_cert_path")
+
+	switch {
+	case crowdsecBouncerAPIKey == "" && crowdsecCertPath == "" && crowdsecKeyPath == "":
+		log.Fatal().
+			Str("func", "config").
+			Msg("Crowdsec API key or client certificate is not set")
+	case crowdsecBouncerAPIKey != "" && (crowdsecCertPath != "" || crowdsecKeyPath != ""):
 		log.Fatal().
 			Str("func", "config").
-			Msg("Crowdsec API key is not set")
+			Msg("Crowdsec API key and client certificate can not be used together")
+	case (crowdsecCertPath == "") != (crowdsecKeyPath == ""):
+		log.Fatal().
+			Str("func", "config").
+			Str("crowdsec_cert_path", crowdsecCertPath).
+			Str("crowdsec_key_path", crowdsecKeyPath).
+			Msg("Both crowdsec_cert_path and crowdsec_key_path must be set")
+	}
+	for _, path := range []string{crowdsecCertPath, crowdsecKeyPath, crowdsecCAPath} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			log.Fatal().
+				Err(err).
+				Str("func", "config").
+				Str("path", path).
+				Msg("Crowdsec certificate file is not readable")
+		}
 	}
 
+	viper.BindEnv("crowdsec_insecure_skip_verify") //nolint:errcheck
+	if viper.IsSet("crowdsec_insecure_skip_verify") {
+		insecure := viper.GetBool("crowdsec_insecure_skip_verify")
+		crowdsecInsecureSkipVerify = &insecure
+		if insecure {
+			log.Warn().
+				Str("func", "config").
+				Msg("crowdsec_insecure_skip_verify is enabled, LAPI certificate will not be verified")
+		}
+	}
+
+	viper.BindEnv("crowdsec_retry_initial_connect") //nolint:errcheck
+	viper.SetDefault("crowdsec_retry_initial_connect", "false")
+	crowdsecRetryInitConnect = viper.GetBool("crowdsec_retry_initial_connect")
+
+	viper.BindEnv("crowdsec_scopes") //nolint:errcheck
+	viper.SetDefault("crowdsec_scopes", nil)
+	crowdsecScopes = viper.GetStringSlice("crowdsec_scopes")
+	for _, scope := range crowdsecScopes {
+		if !slices.Contains(supportedScopes, strings.ToLower(scope)) {
+			log.Fatal().
+				Str("func", "config").
+				Str("crowdsec_scopes", viper.GetString("crowdsec_scopes")).
+				Msgf("Unsupported scope '%s', valid values are: %s", scope, strings.Join(supportedScopes, " "))
+		}
+	}
+
+	viper.BindEnv("geo_country_db") //nolint:errcheck
+	viper.SetDefault("geo_country_db", nil)
+	geoCountryDB = viper.GetStringSlice("geo_country_db")
+
+	viper.BindEnv("geo_asn_db") //nolint:errcheck
+	viper.SetDefault("geo_asn_db", nil)
+	geoASNDB = viper.GetStringSlice("geo_asn_db")
+
+	for _, scope := range crowdsecScopes {
+		scope = strings.ToLower(scope)
+		if (scope == scopeCountry && len(geoCountryDB) == 0) || (scope == scopeAS && len(geoASNDB) == 0) {
+			log.Fatal().
+				Str("func", "config").
+				Str("crowdsec_scopes", viper.GetString("crowdsec_scopes")).
+				Msgf("Scope '%s' requires geo_country_db or geo_asn_db to be set", scope)
+		}
+	}
+
+	viper.BindEnv("geo_max_prefixes") //nolint:errcheck
+	viper.SetDefault("geo_max_prefixes", "10000")
+	geoMaxPrefixes = viper.GetInt("geo_max_prefixes")
+	if geoMaxPrefixes < 1 {
+		log.Fatal().
+			Str("func", "config").
+			Str("geo_max_prefixes", viper.GetString("geo_max_prefixes")).
+			Msg("geo_max_prefixes can not be lower than 1")
+	}
+
+	viper.BindEnv("geo_reload_interval") //nolint:errcheck
+	viper.SetDefault("geo_reload_interval", "1m")
+	geoReloadInterval = viper.GetDuration("geo_reload_interval")
+	if geoReloadInterval < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("geo_reload_interval", viper.GetString("geo_reload_interval")).
+			Msg("geo_reload_interval can not be negative")
+	}
+
+	viper.BindEnv("crowdsec_scenarios_containing") //nolint:errcheck
+	viper.SetDefault("crowdsec_scenarios_containing", nil)
+	crowdsecScenariosContain = viper.GetStringSlice("crowdsec_scenarios_containing")
+
+	viper.BindEnv("crowdsec_scenarios_not_containing") //nolint:errcheck
+	viper.SetDefault("crowdsec_scenarios_not_containing", nil)
+	crowdsecScenariosNotContain = viper.GetStringSlice("crowdsec_scenarios_not_containing")
+
 	viper.BindEnv("crowdsec_url") //nolint:errcheck
 	crowdsecBouncerURL = viper.GetString("crowdsec_url")
 	if crowdsecBouncerURL == "" {
@@ -235,45 +672,56 @@ func initConfig() {
 	viper.SetDefault("crowdsec_origins", nil)
 	crowdsecOrigins = viper.GetStringSlice("crowdsec_origins")
 
-	viper.BindEnv("default_ttl") //nolint:errcheck
-	viper.SetDefault("default_ttl", "3h")
-	defaultTTL = viper.GetDuration("default_ttl")
-	defaultTTLD, err := time.ParseDuration(defaultTTL.String())
-	if err != nil {
+	viper.BindEnv("crowdsec_metrics_interval") //nolint:errcheck
+	viper.SetDefault("crowdsec_metrics_interval", "15m")
+	usageMetricsInterval = viper.GetDuration("crowdsec_metrics_interval")
+	if usageMetricsInterval < 0 {
 		log.Fatal().
-			Err(err).
 			Str("func", "config").
-			Str("default_ttl", viper.GetString("default_ttl")).
-			Msg("Failed to parse default_ttl")
+			Str("crowdsec_metrics_interval", viper.GetString("crowdsec_metrics_interval")).
+			Msg("crowdsec_metrics_interval can not be negative")
+	}
+	if usageMetricsInterval > 0 && usageMetricsInterval < 10*time.Minute {
+		log.Warn().
+			Str("func", "config").
+			Str("crowdsec_metrics_interval", viper.GetString("crowdsec_metrics_interval")).
+			Msg("crowdsec_metrics_interval below 10m may be rejected by CrowdSec LAPI")
 	}
 
-	viper.BindEnv("use_max_ttl") //nolint:errcheck
-	viper.SetDefault("use_max_ttl", "false")
-	useMaxTTL = viper.GetBool("use_max_ttl")
+	viper.BindEnv("trigger_on_update") //nolint:errcheck
+	viper.SetDefault("trigger_on_update", "true")
+	triggerOnUpdate = viper.GetBool("trigger_on_update")
 
-	viper.BindEnv("default_ttl_max") //nolint:errcheck
-	viper.SetDefault("default_ttl_max", "4h")
-	maxTTL = viper.GetDuration("default_ttl_max")
-	maxTTLD, err := time.ParseDuration(maxTTL.String())
-	if err != nil {
+	viper.BindEnv("sync_debounce") //nolint:errcheck
+	viper.SetDefault("sync_debounce", "2s")
+	syncDebounce = viper.GetDuration("sync_debounce")
+	if syncDebounce < 0 {
 		log.Fatal().
-			Err(err).
 			Str("func", "config").
-			Str("default_ttl_max", viper.GetString("default_ttl_max")).
-			Msg("Failed to parse default_ttl_max")
+			Str("sync_debounce", viper.GetString("sync_debounce")).
+			Msg("sync_debounce value can not be negative")
 	}
-	if maxTTL < updateFreq {
+
+	viper.BindEnv("sync_max_delay") //nolint:errcheck
+	viper.SetDefault("sync_max_delay", "30s")
+	syncMaxDelay = viper.GetDuration("sync_max_delay")
+	if syncMaxDelay < syncDebounce {
 		log.Fatal().
-			Err(err).
 			Str("func", "config").
-			Str("default_ttl_max", maxTTL.String()).
-			Str("mikrotik_update_frequency", viper.GetString("mikrotik_update_frequency")).
-			Msg("default_ttl_max can not be shorter than mikrotik_update_frequency")
+			Str("sync_max_delay", viper.GetString("sync_max_delay")).
+			Str("sync_debounce", viper.GetString("sync_debounce")).
+			Msg("sync_max_delay can not be shorter than sync_debounce")
 	}
 
-	viper.BindEnv("trigger_on_update") //nolint:errcheck
-	viper.SetDefault("trigger_on_update", "true")
-	triggerOnUpdate = viper.GetBool("trigger_on_update")
+	viper.BindEnv("sync_min_spacing") //nolint:errcheck
+	viper.SetDefault("sync_min_spacing", "10s")
+	syncMinSpacing = viper.GetDuration("sync_min_spacing")
+	if syncMinSpacing < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("sync_min_spacing", viper.GetString("sync_min_spacing")).
+			Msg("sync_min_spacing value can not be negative")
+	}
 
 	viper.BindEnv("ticker_interval") //nolint:errcheck
 	viper.SetDefault("ticker_interval", "10s")
@@ -294,12 +742,207 @@ func initConfig() {
 			Msg("ticker_interval value can not be equal zero or negative")
 	}
 
+	viper.BindEnv("adaptive_schedule") //nolint:errcheck
+	viper.SetDefault("adaptive_schedule", "false")
+	adaptiveSchedule = viper.GetBool("adaptive_schedule")
+
+	viper.BindEnv("ticker_interval_min") //nolint:errcheck
+	viper.SetDefault("ticker_interval_min", "5s")
+	tickerIntervalMin = viper.GetDuration("ticker_interval_min")
+	if tickerIntervalMin <= 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("ticker_interval_min", viper.GetString("ticker_interval_min")).
+			Msg("ticker_interval_min value can not be equal zero or negative")
+	}
+
+	viper.BindEnv("ticker_interval_max") //nolint:errcheck
+	viper.SetDefault("ticker_interval_max", "2m")
+	tickerIntervalMax = viper.GetDuration("ticker_interval_max")
+	if tickerIntervalMax < tickerIntervalMin {
+		log.Fatal().
+			Str("func", "config").
+			Str("ticker_interval_min", viper.GetString("ticker_interval_min")).
+			Str("ticker_interval_max", viper.GetString("ticker_interval_max")).
+			Msg("ticker_interval_max can not be shorter than ticker_interval_min")
+	}
+
+	viper.BindEnv("sync_min_spacing_max") //nolint:errcheck
+	viper.SetDefault("sync_min_spacing_max", "5m")
+	syncMinSpacingMax = viper.GetDuration("sync_min_spacing_max")
+	if syncMinSpacingMax < syncMinSpacing {
+		log.Fatal().
+			Str("func", "config").
+			Str("sync_min_spacing", viper.GetString("sync_min_spacing")).
+			Str("sync_min_spacing_max", viper.GetString("sync_min_spacing_max")).
+			Msg("sync_min_spacing_max can not be shorter than sync_min_spacing")
+	}
+
+	viper.BindEnv("leader_election") //nolint:errcheck
+	leaderElection = viper.GetString("leader_election")
+	if leaderElection != leaderElectionNone && leaderElection != leaderElectionFile && leaderElection != leaderElectionKubernetes {
+		log.Fatal().
+			Str("func", "config").
+			Str("leader_election", leaderElection).
+			Msgf("leader_election must be empty, '%s' or '%s'", leaderElectionFile, leaderElectionKubernetes)
+	}
+
+	viper.BindEnv("leader_lock_file") //nolint:errcheck
+	leaderLockFile = viper.GetString("leader_lock_file")
+	if leaderElection == leaderElectionFile && leaderLockFile == "" {
+		log.Fatal().
+			Str("func", "config").
+			Msg("leader_lock_file must be set when leader_election is 'file'")
+	}
+
+	viper.BindEnv("leader_lease_name") //nolint:errcheck
+	viper.SetDefault("leader_lease_name", "cs-mikrotik-bouncer")
+	leaderLeaseName = viper.GetString("leader_lease_name")
+
+	viper.BindEnv("leader_lease_namespace") //nolint:errcheck
+	leaderLeaseNamespace = viper.GetString("leader_lease_namespace")
+
+	hostname, _ := os.Hostname()
+	viper.BindEnv("leader_identity") //nolint:errcheck
+	viper.SetDefault("leader_identity", hostname)
+	leaderIdentity = viper.GetString("leader_identity")
+	if leaderElection != leaderElectionNone && leaderIdentity == "" {
+		log.Fatal().
+			Str("func", "config").
+			Msg("leader_identity must be set, hostname is not available")
+	}
+
+	viper.BindEnv("leader_lease_duration") //nolint:errcheck
+	viper.SetDefault("leader_lease_duration", "15s")
+	leaderLeaseDuration = viper.GetDuration("leader_lease_duration")
+
+	viper.BindEnv("leader_retry_interval") //nolint:errcheck
+	viper.SetDefault("leader_retry_interval", "2s")
+	leaderRetryInterval = viper.GetDuration("leader_retry_interval")
+	if leaderRetryInterval <= 0 || leaderLeaseDuration < 3*leaderRetryInterval {
+		log.Fatal().
+			Str("func", "config").
+			Str("leader_lease_duration", viper.GetString("leader_lease_duration")).
+			Str("leader_retry_interval", viper.GetString("leader_retry_interval")).
+			Msg("leader_retry_interval must be positive and leader_lease_duration must be at least 3 times longer")
+	}
+
+	viper.BindEnv("audit_log") //nolint:errcheck
+	viper.SetDefault("audit_log", "")
+	auditLogPath = viper.GetString("audit_log")
+
+	viper.BindEnv("audit_log_max_size") //nolint:errcheck
+	viper.SetDefault("audit_log_max_size", "100")
+	auditLogMaxSize = viper.GetInt("audit_log_max_size")
+
+	viper.BindEnv("audit_log_max_backups") //nolint:errcheck
+	viper.SetDefault("audit_log_max_backups", "5")
+	auditLogMaxBackups = viper.GetInt("audit_log_max_backups")
+
+	viper.BindEnv("audit_log_max_age") //nolint:errcheck
+	viper.SetDefault("audit_log_max_age", "30")
+	auditLogMaxAge = viper.GetInt("audit_log_max_age")
+	if auditLogMaxSize < 1 || auditLogMaxBackups < 0 || auditLogMaxAge < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("audit_log_max_size", viper.GetString("audit_log_max_size")).
+			Str("audit_log_max_backups", viper.GetString("audit_log_max_backups")).
+			Str("audit_log_max_age", viper.GetString("audit_log_max_age")).
+			Msg("audit_log_max_size must be positive, audit_log_max_backups and audit_log_max_age can not be negative")
+	}
+
+	viper.BindEnv("audit_log_compress") //nolint:errcheck
+	viper.SetDefault("audit_log_compress", "false")
+	auditLogCompress = viper.GetBool("audit_log_compress")
+
+	viper.BindEnv("hook_webhook_url") //nolint:errcheck
+	hookWebhookURL = viper.GetString("hook_webhook_url")
+
+	viper.BindEnv("hook_webhook_template") //nolint:errcheck
+	viper.SetDefault("hook_webhook_template", "generic")
+	hookWebhookTemplate = viper.GetString("hook_webhook_template")
+
+	viper.BindEnv("hook_exec") //nolint:errcheck
+	hookExec = viper.GetString("hook_exec")
+
+	viper.BindEnv("hook_events") //nolint:errcheck
+	viper.SetDefault("hook_events", hookEvents)
+	hookEnabledEvents = viper.GetStringSlice("hook_events")
+	for _, event := range hookEnabledEvents {
+		if !slices.Contains(hookEvents, event) {
+			log.Fatal().
+				Str("func", "config").
+				Str("hook_events", viper.GetString("hook_events")).
+				Msgf("Unsupported hook event '%s', valid values are: %s", event, strings.Join(hookEvents, " "))
+		}
+	}
+
+	viper.BindEnv("hook_consecutive_failures") //nolint:errcheck
+	viper.SetDefault("hook_consecutive_failures", "3")
+	hookConsecutiveFailureCount = viper.GetInt("hook_consecutive_failures")
+	if hookConsecutiveFailureCount < 1 {
+		log.Fatal().
+			Str("func", "config").
+			Str("hook_consecutive_failures", viper.GetString("hook_consecutive_failures")).
+			Msg("hook_consecutive_failures can not be lower than 1")
+	}
+
+	viper.BindEnv("hook_rate_limit") //nolint:errcheck
+	viper.SetDefault("hook_rate_limit", "5m")
+	hookRateLimit = viper.GetDuration("hook_rate_limit")
+	if hookRateLimit < 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("hook_rate_limit", viper.GetString("hook_rate_limit")).
+			Msg("hook_rate_limit can not be negative")
+	}
+
+	viper.BindEnv("hook_timeout") //nolint:errcheck
+	viper.SetDefault("hook_timeout", "10s")
+	hookTimeout = viper.GetDuration("hook_timeout")
+	if hookTimeout <= 0 {
+		log.Fatal().
+			Str("func", "config").
+			Str("hook_timeout", viper.GetString("hook_timeout")).
+			Msg("hook_timeout value can not be equal zero or negative")
+	}
+
+	viper.BindEnv("mikrotik_shards") //nolint:errcheck
+	viper.SetDefault("mikrotik_shards", "1")
+	mikrotikShards = viper.GetInt("mikrotik_shards")
+	if mikrotikShards < 1 {
+		log.Fatal().
+			Str("func", "config").
+			Str("mikrotik_shards", viper.GetString("mikrotik_shards")).
+			Msg("mikrotik_shards can not be lower than 1")
+	}
+
+	// settings which can be reloaded, see reloadConfig
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("func", "config").
+			Msg("Invalid config")
+	}
+	live.Store(settings)
+	zerolog.SetGlobalLevel(settings.logLevel)
+
 	all := viper.AllSettings()
 
 	safeConfig := map[string]any{}
 	maps.Copy(safeConfig, all)
 	safeConfig["mikrotik_pass"] = fmt.Sprintf("%.*s...", 3, password)
 	safeConfig["crowdsec_bouncer_api_key"] = fmt.Sprintf("%.*s...", 3, crowdsecBouncerAPIKey)
+	if metricsBasicAuthPass != "" {
+		safeConfig["metrics_basic_auth_pass"] = "***"
+	}
+	if metricsBearerToken != "" {
+		safeConfig["metrics_bearer_token"] = "***"
+	}
+	if hookWebhookURL != "" {
+		safeConfig["hook_webhook_url"] = redactURL(hookWebhookURL)
+	}
 
 	for key, val := range safeConfig {
 		log.Info().
@@ -308,10 +951,10 @@ func initConfig() {
 	}
 	log.Info().
 		Str("func", "config").
-		Msgf("Setting default TTL to %v", defaultTTLD)
+		Msgf("Setting default TTL to %v", settings.defaultTTL)
 	log.Info().
 		Str("func", "config").
-		Msgf("Setting max TTL to %v", maxTTLD)
+		Msgf("Setting max TTL to %v", settings.maxTTL)
 	log.Info().
 		Str("func", "config").
 		Msgf("Setting mikrotik_timeout to %v", timeoutD)
@@ -324,35 +967,68 @@ func initConfig() {
 
 }
 
+// tlsConfigFromEnv binds <prefix>_* TLS options and builds TLS config from them,
+// returns nil if enabled is false
+func tlsConfigFromEnv(prefix string, enabled bool) *tls.Config {
+	viper.BindEnv(prefix + "_ca_file")              //nolint:errcheck
+	viper.BindEnv(prefix + "_fingerprint")          //nolint:errcheck
+	viper.BindEnv(prefix + "_cert_file")            //nolint:errcheck
+	viper.BindEnv(prefix + "_key_file")             //nolint:errcheck
+	viper.BindEnv(prefix + "_server_name")          //nolint:errcheck
+	viper.BindEnv(prefix + "_min_version")          //nolint:errcheck
+	viper.BindEnv(prefix + "_insecure_skip_verify") //nolint:errcheck
+	viper.SetDefault(prefix+"_min_version", "1.2")
+	viper.SetDefault(prefix+"_insecure_skip_verify", "false")
+	if !enabled {
+		return nil
+	}
+
+	insecure := viper.GetBool(prefix + "_insecure_skip_verify")
+	if insecure {
+		log.Warn().
+			Str("func", "config").
+			Msgf("%s_insecure_skip_verify is enabled, MikroTik certificate will not be verified", prefix)
+	}
+	cfg, err := newMikrotikTLSConfig(
+		viper.GetString(prefix+"_ca_file"),
+		viper.GetString(prefix+"_fingerprint"),
+		viper.GetString(prefix+"_cert_file"),
+		viper.GetString(prefix+"_key_file"),
+		viper.GetString(prefix+"_server_name"),
+		viper.GetString(prefix+"_min_version"),
+		insecure,
+	)
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("func", "config").
+			Msgf("Invalid %s_* settings", prefix)
+	}
+	return cfg
+}
+
 // cfgValidateFirewall checks if the input string is a valid mikrotik firewall format
 // so just numbers and commas
-func cfgValidateFirewall(name string) string {
+func cfgValidateFirewall(name string) (string, error) {
 
 	viper.BindEnv(name) //nolint:errcheck
 	value := viper.GetString(name)
 
 	if value == "" {
-		log.Fatal().
-			Str("func", "config").
-			Str(name, value).
-			Msgf("%s cannot be empty", name)
-
+		return "", fmt.Errorf("%s cannot be empty", name)
 	}
 
-	match, _ := regexp.MatchString("^([0-9]+,?)+$", value)
-	if !match {
-		log.Fatal().
-			Str("func", "config").
-			Str(name, value).
-			Msgf("%s can contain only numbers and commas, aborting", name)
+	if !ruleIdsRe.MatchString(value) {
+		return "", fmt.Errorf("%s can contain only numbers and commas, got '%s'", name, value)
 	}
 
-	return value
+	return value, nil
 }
 
-func getListName() string {
-	if listNameFormat == "static" {
-		return addressList
+// getListName returns address-list name for given prefix, depending on mikrotik_address_list_name_format
+func getListName(prefix string) string {
+	if live.Load().listNameFormat == "static" {
+		return prefix
 	}
-	return fmt.Sprintf("%s_%s", addressList, time.Now().Format("2006-01-02_15-04-05"))
+	return fmt.Sprintf("%s_%s", prefix, time.Now().Format("2006-01-02_15-04-05"))
 }
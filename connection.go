@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/rs/zerolog/log"
+)
+
+var errMikrotikUnreachable = errors.New("mikrotik is unreachable, waiting for reconnect")
+
+// mikrotikClient runs commands on MikroTik, implemented by binary API client and by restClient
+type mikrotikClient interface {
+	RunArgs(sentence []string) (*routeros.Reply, error)
+	Close() error
+}
+
+// mikrotikConnection keeps a single long-lived RouterOS API session
+//
+// the go-routeros client in sync mode is not safe for concurrent use,
+// so whoever wants to run commands must acquire() it and release() it afterwards
+type mikrotikConnection struct {
+	mutex sync.Mutex
+	c     mikrotikClient
+
+	// false for additional sessions, which do not report connection state metrics
+	primary bool
+
+	// number of consecutive failed connection attempts, 0 means we are not in backoff
+	failures int
+
+	// set when sync was skipped or aborted because router was not reachable,
+	// so that it is executed again as soon as connection is restored
+	pending atomic.Bool
+
+	// used to wake up keepalive loop when connection breaks
+	wake chan struct{}
+
+	// mikrotikConnect and time.After, replaced in tests
+	dial  func() (mikrotikClient, error)
+	after func(time.Duration) <-chan time.Time
+}
+
+func newMikrotikConnection() *mikrotikConnection {
+	return &mikrotikConnection{
+		primary: true,
+		wake:    make(chan struct{}, 1),
+		dial:    mikrotikConnect,
+		after:   time.After,
+	}
+}
+
+// newSessionConnection wraps additional connected client, such as used by shards,
+// so that commands run on it get the same error handling as on the main connection
+func newSessionConnection(c mikrotikClient) *mikrotikConnection {
+	return &mikrotikConnection{
+		c:    c,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// acquire returns connected client and holds the lock until release() is called
+//
+// if there is no connection then it tries to dial once, unless we are already
+// in reconnect backoff, in which case it fails fast and leaves reconnecting to the keepalive loop
+func (mc *mikrotikConnection) acquire() (mikrotikClient, error) {
+	mc.mutex.Lock()
+	if mc.c != nil {
+		mc.pending.Store(false)
+		return mc.c, nil
+	}
+	if mc.failures > 0 {
+		mc.mutex.Unlock()
+		mc.pending.Store(true)
+		return nil, errMikrotikUnreachable
+	}
+	if err := mc.connect(); err != nil {
+		mc.mutex.Unlock()
+		mc.pending.Store(true)
+		mc.notify()
+		return nil, err
+	}
+	mc.pending.Store(false)
+	return mc.c, nil
+}
+
+// release returns client acquired with acquire()
+func (mc *mikrotikConnection) release() {
+	mc.mutex.Unlock()
+}
+
+// invalidate drops current connection after a transport error, must be called while holding the lock
+//
+// sync is marked as pending so that it is retried after reconnect
+func (mc *mikrotikConnection) invalidate(err error) {
+	log.Warn().
+		Err(err).
+		Str("func", "invalidate").
+		Str("host", mikrotikHost).
+		Msg("Connection to mikrotik is broken, scheduling reconnect")
+	mc.disconnect()
+	mc.failures = 1
+	mc.pending.Store(true)
+	mc.notify()
+}
+
+// reconnect replaces broken connection with a new one, must be called while holding the lock
+func (mc *mikrotikConnection) reconnect() (mikrotikClient, error) {
+	mc.disconnect()
+	if err := mc.connect(); err != nil {
+		return nil, err
+	}
+	return mc.c, nil
+}
+
+// notify wakes up keepalive loop without blocking
+func (mc *mikrotikConnection) notify() {
+	select {
+	case mc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// connect dials mikrotik, must be called while holding the lock
+func (mc *mikrotikConnection) connect() error {
+	c, err := mc.dial()
+	if err != nil {
+		mc.failures++
+		mc.setConnected(0)
+		return err
+	}
+	mc.c = c
+	mc.failures = 0
+	mc.setConnected(1)
+	return nil
+}
+
+// disconnect closes current connection if any, must be called while holding the lock
+func (mc *mikrotikConnection) disconnect() {
+	if mc.c == nil {
+		return
+	}
+	_ = mikrotikClose(mc.c)
+	mc.c = nil
+	mc.setConnected(0)
+}
+
+// setConnected updates connection state metric, only for the main connection
+func (mc *mikrotikConnection) setConnected(value float64) {
+	if mc.primary {
+		metricMikrotikConnected.Set(value)
+	}
+}
+
+// ping runs cheap command to check if connection is still alive, must be called while holding the lock
+func (mc *mikrotikConnection) ping() error {
+	_, err := mc.c.RunArgs([]string{"/system/identity/print"})
+	if err != nil {
+		metricMikrotikKeepalive.WithLabelValues("error").Inc()
+		return err
+	}
+	metricMikrotikKeepalive.WithLabelValues("success").Inc()
+	return nil
+}
+
+// backoff returns exponential backoff with jitter for given number of consecutive failures
+func backoff(failures int) time.Duration {
+	d := reconnectBackoffMin
+	for i := 1; i < failures && d < reconnectBackoffMax; i++ {
+		d *= 2
+	}
+	d = min(d, reconnectBackoffMax)
+	// equal jitter, so that we never retry sooner than half of the backoff
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// keepaliveLoop checks connection health periodically and reconnects with backoff when it is broken
+//
+// onRecovered is called once connection is restored and there was a sync which failed in the meantime
+func (mc *mikrotikConnection) keepaliveLoop(onRecovered func()) {
+	for {
+		mc.mutex.Lock()
+		failures := mc.failures
+		mc.mutex.Unlock()
+
+		wait := keepaliveInterval
+		if failures > 0 {
+			wait = backoff(failures)
+		}
+
+		select {
+		case <-mc.after(wait):
+		case <-mc.wake:
+			continue
+		}
+
+		// if connection is in use then sync is running, and that is a health check on its own
+		if !mc.mutex.TryLock() {
+			continue
+		}
+
+		// followers do not keep sessions open, leader will connect on its own
+		if !isLeader() {
+			mc.disconnect()
+			mc.mutex.Unlock()
+			continue
+		}
+
+		if mc.c != nil {
+			if err := mc.ping(); err != nil {
+				log.Warn().
+					Err(err).
+					Str("func", "keepaliveLoop").
+					Str("host", mikrotikHost).
+					Msg("Mikrotik health check failed, reconnecting")
+				mc.disconnect()
+				mc.failures = 1
+			}
+			mc.mutex.Unlock()
+			continue
+		}
+
+		err := mc.connect()
+		mc.mutex.Unlock()
+		if err != nil {
+			metricMikrotikReconnect.WithLabelValues("error").Inc()
+			continue
+		}
+		metricMikrotikReconnect.WithLabelValues("success").Inc()
+		log.Info().
+			Str("func", "keepaliveLoop").
+			Str("host", mikrotikHost).
+			Msg("Reconnected to mikrotik")
+
+		if mc.pending.CompareAndSwap(true, false) {
+			log.Info().
+				Str("func", "keepaliveLoop").
+				Msg("Retrying failed mikrotik update after reconnect")
+			go onRecovered()
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/go-routeros/routeros/v3/proto"
+)
+
+// fakeRouter is RouterOS API stand-in, served over in-memory pipe
+type fakeRouter struct {
+	mutex    sync.Mutex
+	down     bool       // dial fails while set
+	commands [][]string // received sentences, without tag
+	conns    []net.Conn
+
+	// reply returns !re rows for given sentence,
+	// and message of !trap sentence if the command fails
+	reply func(words []string) ([]map[string]string, string)
+	// done returns attributes of !done sentence, such as ret of count-only print, optional
+	done func(words []string) map[string]string
+}
+
+func (fr *fakeRouter) setDown(down bool) {
+	fr.mutex.Lock()
+	fr.down = down
+	fr.mutex.Unlock()
+}
+
+func (fr *fakeRouter) dial() (mikrotikClient, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	if fr.down {
+		return nil, errors.New("dial tcp 192.0.2.1:8728: connect: connection refused")
+	}
+	client, server := net.Pipe()
+	fr.conns = append(fr.conns, server)
+	go fr.serve(server)
+	c, err := routeros.NewClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// drop closes all connections, as if the router rebooted
+func (fr *fakeRouter) drop() {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	for _, conn := range fr.conns {
+		conn.Close()
+	}
+	fr.conns = nil
+}
+
+// received returns received sentences joined with spaces
+func (fr *fakeRouter) received() []string {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	var out []string
+	for _, words := range fr.commands {
+		out = append(out, strings.Join(words, " "))
+	}
+	return out
+}
+
+func (fr *fakeRouter) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := proto.NewWriter(conn)
+	for {
+		var words []string
+		for {
+			word, err := readAPIWord(r)
+			if err != nil {
+				return
+			}
+			if word == "" {
+				break
+			}
+			if !strings.HasPrefix(word, ".tag=") {
+				words = append(words, word)
+			}
+		}
+
+		fr.mutex.Lock()
+		fr.commands = append(fr.commands, words)
+		reply, done := fr.reply, fr.done
+		fr.mutex.Unlock()
+
+		var rows []map[string]string
+		var trap string
+		if reply != nil {
+			rows, trap = reply(words)
+		}
+		for _, row := range rows {
+			w.BeginSentence()
+			w.WriteWord("!re")
+			for k, v := range row {
+				w.WriteWord("=" + k + "=" + v)
+			}
+			if err := w.EndSentence(); err != nil {
+				return
+			}
+		}
+		if trap != "" {
+			w.BeginSentence()
+			w.WriteWord("!trap")
+			w.WriteWord("=message=" + trap)
+			if err := w.EndSentence(); err != nil {
+				return
+			}
+		}
+		w.BeginSentence()
+		w.WriteWord("!done")
+		if done != nil {
+			for k, v := range done(words) {
+				w.WriteWord("=" + k + "=" + v)
+			}
+		}
+		if err := w.EndSentence(); err != nil {
+			return
+		}
+	}
+}
+
+// readAPIWord reads single length-prefixed word of RouterOS API sentence
+func readAPIWord(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	length, extra := int(b), 0
+	switch {
+	case b&0x80 == 0x00:
+	case b&0xC0 == 0x80:
+		length, extra = int(b&0x3F), 1
+	case b&0xE0 == 0xC0:
+		length, extra = int(b&0x1F), 2
+	case b&0xF0 == 0xE0:
+		length, extra = int(b&0x0F), 3
+	default:
+		length, extra = 0, 4
+	}
+	for range extra {
+		next, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		length = length<<8 | int(next)
+	}
+	word := make([]byte, length)
+	if _, err := io.ReadFull(r, word); err != nil {
+		return "", err
+	}
+	return string(word), nil
+}
+
+func TestBackoff(t *testing.T) {
+	reconnectBackoffMin, reconnectBackoffMax = time.Second, 30*time.Second
+	tests := []struct {
+		failures int
+		full     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		seen := map[time.Duration]bool{}
+		for range 200 {
+			d := backoff(tt.failures)
+			if d < tt.full/2 || d > tt.full {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.failures, d, tt.full/2, tt.full)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoff(%d) has no jitter", tt.failures)
+		}
+	}
+}
+
+// startKeepalive runs keepalive loop on connection to fr, which is down,
+// the loop waits on returned channel, and sends each requested wait to waits
+func startKeepalive(t *testing.T, fr *fakeRouter) (mc *mikrotikConnection, waits chan time.Duration, tick chan time.Time, recovered chan struct{}) {
+	t.Helper()
+	keepaliveInterval = time.Minute
+	reconnectBackoffMin, reconnectBackoffMax = time.Second, 4*time.Second
+
+	waits = make(chan time.Duration)
+	tick = make(chan time.Time)
+	recovered = make(chan struct{}, 4)
+	mc = newMikrotikConnection()
+	mc.dial = fr.dial
+	mc.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return tick
+	}
+	go mc.keepaliveLoop(func() { recovered <- struct{}{} })
+	return mc, waits, tick, recovered
+}
+
+func nextWait(t *testing.T, waits chan time.Duration) time.Duration {
+	t.Helper()
+	select {
+	case d := <-waits:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("keepalive loop is not waiting")
+	}
+	return 0
+}
+
+func TestKeepaliveReconnect(t *testing.T) {
+	fr := &fakeRouter{down: true}
+	mc, waits, tick, recovered := startKeepalive(t, fr)
+
+	// update failed because the router is down
+	if _, err := mc.acquire(); err == nil {
+		t.Fatal("acquire() succeeded while router is down")
+	}
+	if !mc.pending.Load() {
+		t.Fatal("failed update is not pending")
+	}
+
+	// loop is woken up by the failed dial, then backs off while router is down
+	nextWait(t, waits)
+	for failures, full := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		d := nextWait(t, waits)
+		if d < full/2 || d > full {
+			t.Errorf("wait after %d failures = %s, want between %s and %s", failures+1, d, full/2, full)
+		}
+		tick <- time.Now()
+	}
+	select {
+	case <-recovered:
+		t.Fatal("onRecovered called while router is down")
+	default:
+	}
+
+	fr.setDown(false)
+	nextWait(t, waits)
+	tick <- time.Now()
+	select {
+	case <-recovered:
+	case <-time.After(time.Second):
+		t.Fatal("onRecovered not called after reconnect with pending update")
+	}
+	if d := nextWait(t, waits); d != keepaliveInterval {
+		t.Errorf("wait after reconnect = %s, want keepalive_interval %s", d, keepaliveInterval)
+	}
+	if mc.pending.Load() {
+		t.Error("update still pending after onRecovered")
+	}
+}
+
+func TestKeepaliveReconnectWithoutPending(t *testing.T) {
+	fr := &fakeRouter{}
+	mc, waits, tick, recovered := startKeepalive(t, fr)
+
+	if _, err := mc.acquire(); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	mc.release()
+
+	// health check passes
+	nextWait(t, waits)
+	tick <- time.Now()
+	if d := nextWait(t, waits); d != keepaliveInterval {
+		t.Errorf("wait after health check = %s, want keepalive_interval %s", d, keepaliveInterval)
+	}
+
+	// router reboots between updates, health check fails and loop reconnects
+	fr.drop()
+	tick <- time.Now()
+	if d := nextWait(t, waits); d < reconnectBackoffMin/2 || d > reconnectBackoffMin {
+		t.Errorf("wait after failed health check = %s, want backoff of single failure", d)
+	}
+	tick <- time.Now()
+	if d := nextWait(t, waits); d != keepaliveInterval {
+		t.Errorf("wait after reconnect = %s, want keepalive_interval %s", d, keepaliveInterval)
+	}
+	select {
+	case <-recovered:
+		t.Error("onRecovered called without pending update")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := fr.received(); len(got) != 1 || got[0] != "/system/identity/print" {
+		t.Errorf("router received %q, want single health check", got)
+	}
+}
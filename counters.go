@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ruleCounter holds traffic counters of a single firewall rule
+type ruleCounter struct {
+	packets uint64
+	bytes   uint64
+}
+
+// readFirewallCounters returns counters of all rules in given firewall table, indexed by rule number
+//
+// proto - 'ip' or 'ipv6'
+//
+// mode - firewall table, such as 'filter' or 'raw'
+func readFirewallCounters(c mikrotikClient, proto string, mode string) ([]ruleCounter, error) {
+	r, err := c.RunArgs([]string{
+		fmt.Sprintf("/%s/firewall/%s/print", proto, mode),
+		"=stats=",
+		"=.proplist=bytes,packets",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make([]ruleCounter, 0, len(r.Re))
+	for _, re := range r.Re {
+		// missing or invalid values are counted as zero
+		packets, _ := strconv.ParseUint(re.Map["packets"], 10, 64)
+		bytes, _ := strconv.ParseUint(re.Map["bytes"], 10, 64)
+		counters = append(counters, ruleCounter{packets: packets, bytes: bytes})
+	}
+	return counters, nil
+}
+
+// sumRuleCounters sums counters of rules with given comma separated ids,
+// ids out of range are skipped
+func sumRuleCounters(counters []ruleCounter, ids string) ruleCounter {
+	var sum ruleCounter
+	for id := range strings.SplitSeq(ids, ",") {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 0 || n >= len(counters) {
+			continue
+		}
+		sum.packets += counters[n].packets
+		sum.bytes += counters[n].bytes
+	}
+	return sum
+}
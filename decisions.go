@@ -1,31 +1,48 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"strings"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/jellydator/ttlcache/v3"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (mal *mikrotikAddrList) add(decision *models.Decision) bool {
 
-	log.Info().
+	decisionType := decisionTypeOf(decision)
+	simulated := decision.Simulated != nil && *decision.Simulated
+
+	detailLog().Info().
 		Str("func", "add").
 		Str("duration", *decision.Duration).
 		Str("origin", *decision.Origin).
 		Str("scenario", *decision.Scenario).
 		Str("scope", *decision.Scope).
-		// Bool("simulated", *decision.Simulated).
+		Bool("simulated", simulated).
 		// Int64("id", decision.ID).
-		// Str("type", *decision.Type).
+		Str("type", decisionType).
 		// Str("until", decision.Until).
 		// Str("uuid", decision.UUID).
 		Str("value", *decision.Value).
 		Msg("Processing new decision to add")
+	audit.received("add", decision)
+
+	if scope := strings.ToLower(*decision.Scope); scope == scopeAS || scope == scopeCountry {
+		return mal.addGeo(decision, scope)
+	}
 
-	address := *decision.Value
+	return mal.addAddress(decision, *decision.Value, newCacheEntry(decision))
+}
+
+// addAddress adds single address or prefix of the decision to the cache
+func (mal *mikrotikAddrList) addAddress(decision *models.Decision, address string, entry cacheEntry) bool {
+	decisionType := decisionTypeOf(decision)
+	simulated := decision.Simulated != nil && *decision.Simulated
 	newTTL := setTTL(*decision.Duration)
 	proto := getProtoCmd(address)
 
@@ -35,7 +52,7 @@ func (mal *mikrotikAddrList) add(decision *models.Decision) bool {
 			Str("address", address).
 			Str("new_ttl", newTTL.String()).
 			Msg("skipping, IPv4 not enabled")
-		metricDecision.WithLabelValues(proto, "add", "skip").Inc()
+		metricDecision.WithLabelValues(proto, "add", "skip", decisionType).Inc()
 		return false
 	}
 
@@ -45,33 +62,64 @@ func (mal *mikrotikAddrList) add(decision *models.Decision) bool {
 			Str("address", address).
 			Str("new_ttl", newTTL.String()).
 			Msg("skipping, IPv6 not enabled")
-		metricDecision.WithLabelValues(proto, "add", "skip").Inc()
+		metricDecision.WithLabelValues(proto, "add", "skip", decisionType).Inc()
+		return false
+	}
+
+	if simulated {
+		log.Debug().
+			Str("func", "add").
+			Str("address", address).
+			Str("type", decisionType).
+			Msg("skipping, decision is simulated")
+		metricDecision.WithLabelValues(proto, "add", "simulated", decisionType).Inc()
+		return false
+	}
+
+	cache := mal.cacheFor(decisionType)
+	if cache == nil {
+		log.Debug().
+			Str("func", "add").
+			Str("address", address).
+			Str("type", decisionType).
+			Msg("skipping, decision type not enabled")
+		metricDecision.WithLabelValues(proto, "add", "skip_type", decisionType).Inc()
 		return false
 	}
 
-	if proto == "ipv6" && useIPV6 {
+	if proto == "ipv6" && useIPV6 && !strings.Contains(address, "/") {
 		address += "/128"
 	}
 
-	// TODO: allow formatting comment for decision
-	comment := fmt.Sprintf("%s %s %s", *decision.Origin, *decision.Scenario, *decision.Scope)
+	var item = &ttlcache.Item[string, cacheEntry]{}
+	prefix := mal.prefixFor(decisionType)
 
-	var item = &ttlcache.Item[string, string]{}
+	// address moves between lists when decision with or without TTL replaces the previous one
+	if permanent := mal.permanentFor(decisionType); permanent != nil {
+		if newTTL == 0 {
+			cache.Delete(address)
+			cache, prefix = permanent, permanentList
+		} else {
+			permanent.Delete(address)
+		}
+	}
 
-	if mal.cache.Has(address) {
+	if cache.Has(address) {
 		metricCache.WithLabelValues("add", "hit").Inc()
-		item = mal.cache.Get(address)
-		currentTTL := time.Until(item.ExpiresAt())
+		item = cache.Get(address)
+		currentTTL := remainingTTL(item)
 
 		switch {
 		case newTTL == currentTTL:
-			metricDecision.WithLabelValues(proto, "add", "update_equal").Inc()
+			metricDecision.WithLabelValues(proto, "add", "update_equal", decisionType).Inc()
 		case newTTL > currentTTL:
-			metricDecision.WithLabelValues(proto, "add", "update_extend").Inc()
+			metricDecision.WithLabelValues(proto, "add", "update_extend", decisionType).Inc()
+			audit.cached(auditTTLExtended, prefix, address, decision, newTTL)
 		case newTTL < currentTTL:
-			metricDecision.WithLabelValues(proto, "add", "update_shorten").Inc()
+			metricDecision.WithLabelValues(proto, "add", "update_shorten", decisionType).Inc()
+			audit.cached(auditTTLShortened, prefix, address, decision, newTTL)
 		}
-		log.Info().
+		detailLog().Info().
 			Str("func", "add").
 			Str("address", address).
 			Str("current_ttl", currentTTL.String()).
@@ -80,36 +128,50 @@ func (mal *mikrotikAddrList) add(decision *models.Decision) bool {
 
 	} else {
 		metricCache.WithLabelValues("add", "miss").Inc()
-		log.Info().
+		detailLog().Info().
 			Str("func", "add").
 			Str("address", address).
 			Str("new_ttl", newTTL.String()).
 			Msg("Address not in cache, adding")
-		metricDecision.WithLabelValues(proto, "add", "insert").Inc()
+		metricDecision.WithLabelValues(proto, "add", "insert", decisionType).Inc()
+		audit.cached(auditCached, prefix, address, decision, newTTL)
 	}
 
-	mal.cache.Set(address, comment, newTTL)
+	cache.Set(address, entry, newTTL)
 	return true
 }
 
 func (mal *mikrotikAddrList) remove(decision *models.Decision) bool {
 
-	log.Info().
+	decisionType := decisionTypeOf(decision)
+	simulated := decision.Simulated != nil && *decision.Simulated
+
+	detailLog().Info().
 		Str("func", "remove").
 		Str("duration", *decision.Duration).
 		Str("origin", *decision.Origin).
 		Str("scenario", *decision.Scenario).
 		Str("scope", *decision.Scope).
-		// Bool("simulated", *decision.Simulated).
+		Bool("simulated", simulated).
 		// Int64("id", decision.ID).
-		// Str("type", *decision.Type).
+		Str("type", decisionType).
 		// Str("until", decision.Until).
 		// Str("uuid", decision.UUID).
 		Str("value", *decision.Value).
 		Msg("Processing new decision to remove")
+	audit.received("remove", decision)
+
+	if scope := strings.ToLower(*decision.Scope); scope == scopeAS || scope == scopeCountry {
+		return mal.removeGeo(decision, scope)
+	}
+	return mal.removeAddress(decision, *decision.Value)
+}
 
-	proto := getProtoCmd(*decision.Value)
-	address := *decision.Value
+// removeAddress removes single address or prefix of the decision from the cache
+func (mal *mikrotikAddrList) removeAddress(decision *models.Decision, address string) bool {
+	decisionType := decisionTypeOf(decision)
+	simulated := decision.Simulated != nil && *decision.Simulated
+	proto := getProtoCmd(address)
 	newTTL := setTTL(*decision.Duration)
 	if proto == "ip" && !useIPV4 {
 		log.Debug().
@@ -117,7 +179,7 @@ func (mal *mikrotikAddrList) remove(decision *models.Decision) bool {
 			Str("address", address).
 			Str("new_ttl", newTTL.String()).
 			Msg("skipping, IPv4 not enabled")
-		metricDecision.WithLabelValues(proto, "remove", "skip").Inc()
+		metricDecision.WithLabelValues(proto, "remove", "skip", decisionType).Inc()
 		return false
 	}
 
@@ -127,34 +189,62 @@ func (mal *mikrotikAddrList) remove(decision *models.Decision) bool {
 			Str("address", address).
 			Str("new_ttl", newTTL.String()).
 			Msg("skipping, IPv6 not enabled")
-		metricDecision.WithLabelValues(proto, "remove", "skip").Inc()
+		metricDecision.WithLabelValues(proto, "remove", "skip", decisionType).Inc()
 		return false
 	}
 
-	var item = &ttlcache.Item[string, string]{}
+	// simulated decisions were never added, and the same address may have real decision in the cache
+	if simulated {
+		log.Debug().
+			Str("func", "remove").
+			Str("address", address).
+			Str("type", decisionType).
+			Msg("skipping, decision is simulated")
+		metricDecision.WithLabelValues(proto, "remove", "simulated", decisionType).Inc()
+		return false
+	}
+
+	cache := mal.cacheFor(decisionType)
+	if cache == nil {
+		log.Debug().
+			Str("func", "remove").
+			Str("address", address).
+			Str("type", decisionType).
+			Msg("skipping, decision type not enabled")
+		metricDecision.WithLabelValues(proto, "remove", "skip_type", decisionType).Inc()
+		return false
+	}
 
-	if mal.cache.Has(address) {
+	var item = &ttlcache.Item[string, cacheEntry]{}
+	prefix := mal.prefixFor(decisionType)
+
+	if permanent := mal.permanentFor(decisionType); permanent != nil && permanent.Has(address) {
+		cache, prefix = permanent, permanentList
+	}
+
+	if cache.Has(address) {
 		metricCache.WithLabelValues("del", "hit").Inc()
-		item = mal.cache.Get(address)
-		currentTTL := time.Until(item.ExpiresAt())
-		log.Info().
+		item = cache.Get(address)
+		currentTTL := remainingTTL(item)
+		detailLog().Info().
 			Str("func", "remove").
 			Str("address", address).
 			Str("ttl", currentTTL.String()).
 			Msgf("Address is in the cache, removing")
-		metricDecision.WithLabelValues(proto, "remove", "remove").Inc()
-		mal.cache.Delete(address)
+		metricDecision.WithLabelValues(proto, "remove", "remove", decisionType).Inc()
+		cache.Delete(address)
+		audit.removed(auditRemoved, prefix, address, decision)
 		return true
 
 	} else {
-		log.Info().
+		detailLog().Info().
 			Str("func", "remove").
 			Str("address", address).
 			Str("new_ttl", newTTL.String()).
 			Msg("Address not in cache, nothing to do")
 
 		metricCache.WithLabelValues("del", "miss").Inc()
-		metricDecision.WithLabelValues(proto, "remove", "no_op").Inc()
+		metricDecision.WithLabelValues(proto, "remove", "no_op", decisionType).Inc()
 		return false
 	}
 
@@ -169,13 +259,21 @@ func (mal *mikrotikAddrList) remove(decision *models.Decision) bool {
 // old rule should auto-expire so there is no need fo cleanups
 func (mal *mikrotikAddrList) decisionProcess(streamDecision *models.DecisionsStreamResponse) {
 
+	_, span := tracer.Start(context.Background(), "decisionProcess", trace.WithAttributes(
+		attribute.Int("decisions.new", len(streamDecision.New)),
+		attribute.Int("decisions.deleted", len(streamDecision.Deleted)),
+	))
+	defer span.End()
+
 	decisionsAdded := 0
 	decisionsDeleted := 0
 
 	for _, decision := range streamDecision.Deleted {
-		if mal.remove(decision) {
+		removed := mal.remove(decision)
+		if removed {
 			decisionsDeleted++
 		}
+		span.AddEvent("remove", trace.WithAttributes(decisionAttributes(decision, removed)...))
 		if decisionsDeleted == debugDecisionsMax {
 			break
 		}
@@ -183,20 +281,57 @@ func (mal *mikrotikAddrList) decisionProcess(streamDecision *models.DecisionsStr
 
 	for _, decision := range streamDecision.New {
 
-		if mal.add(decision) {
+		added := mal.add(decision)
+		if added {
 			decisionsAdded++
 		}
+		span.AddEvent("add", trace.WithAttributes(decisionAttributes(decision, added)...))
 		if decisionsAdded == debugDecisionsMax {
 			break
 		}
 	}
 
+	span.SetAttributes(
+		attribute.Int("decisions.added", decisionsAdded),
+		attribute.Int("decisions.removed", decisionsDeleted),
+	)
+
+	if (decisionsAdded > 0) || (decisionsDeleted > 0) {
+		mal.linkSync(span.SpanContext())
+	}
+
+	mal.streamReady.Store(true)
+
+	if mal.sched != nil {
+		mal.sched.observePull((decisionsAdded > 0) || (decisionsDeleted > 0))
+	}
+
 	if triggerOnUpdate && ((decisionsAdded > 0) || (decisionsDeleted > 0)) {
 		log.Info().
 			Str("func", "decisionProcess").
-			Msg("detected decision changes, triggering mikrotik update now")
-		runMikrotikCommands(mal)
+			Msg("detected decision changes, requesting mikrotik update")
+		mal.trigger.request("decisions")
+	}
+}
+
+// decisionAttributes returns span attributes describing decision,
+// cached tells if the cache was changed by it
+func decisionAttributes(decision *models.Decision, cached bool) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int64("decision.id", decision.ID),
+		attribute.String("decision.type", decisionTypeOf(decision)),
+		attribute.Bool("decision.cached", cached),
+	}
+	if decision.Value != nil {
+		attrs = append(attrs, attribute.String("decision.value", *decision.Value))
+	}
+	if decision.Origin != nil {
+		attrs = append(attrs, attribute.String("decision.origin", *decision.Origin))
+	}
+	if decision.Scenario != nil {
+		attrs = append(attrs, attribute.String("decision.scenario", *decision.Scenario))
 	}
+	return attrs
 }
 
 // setTTL parses input time string
@@ -204,7 +339,7 @@ func (mal *mikrotikAddrList) decisionProcess(streamDecision *models.DecisionsStr
 func setTTL(timeStr string) time.Duration {
 	ttl, err := ParseMikrotikDuration(timeStr)
 	if err != nil {
-		ttl = defaultTTL
+		ttl = live.Load().defaultTTL
 		log.Warn().Err(err).
 			Str("func", "setTTL").
 			Str("input", timeStr).
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricValue returns value of counter or gauge with given name and labels from default registry
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matched := 0
+			for _, label := range m.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func newDecision(value string, decisionType string, simulated bool) *models.Decision {
+	duration, origin, scenario, scope := "4h", "crowdsec", "crowdsecurity/ssh-bf", "Ip"
+	return &models.Decision{
+		Duration:  &duration,
+		Origin:    &origin,
+		Scenario:  &scenario,
+		Scope:     &scope,
+		Value:     &value,
+		Type:      &decisionType,
+		Simulated: &simulated,
+	}
+}
+
+func newTypedAddrList() *mikrotikAddrList {
+	return &mikrotikAddrList{
+		cache: ttlcache.New[string, cacheEntry](),
+		typed: map[string]*typedList{
+			"captcha": {decisionType: "captcha", prefix: "crowdsec_captcha", cache: ttlcache.New[string, cacheEntry]()},
+		},
+	}
+}
+
+func TestAddDecisionTypes(t *testing.T) {
+	useSettings(t, &settings{})
+	useIPV4, useIPV6 = true, true
+	tests := []struct {
+		name      string
+		decision  *models.Decision
+		want      bool
+		wantBan   bool
+		wantTyped bool
+		operation string // decisions_total operation label
+	}{
+		{"ban", newDecision("192.0.2.1", "ban", false), true, true, false, "insert"},
+		{"type is case insensitive", newDecision("192.0.2.2", "Captcha", false), true, false, true, "insert"},
+		{"not configured type", newDecision("192.0.2.3", "throttle", false), false, false, false, "skip_type"},
+		{"simulated ban", newDecision("192.0.2.4", "ban", true), false, false, false, "simulated"},
+		{"simulated captcha", newDecision("192.0.2.5", "captcha", true), false, false, false, "simulated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mal := newTypedAddrList()
+			decisionType := decisionTypeOf(tt.decision)
+			labels := map[string]string{"func": "add", "operation": tt.operation, "type": decisionType}
+			before := metricValue(t, "cs_mikrotik_bouncer_decisions_total", labels)
+
+			if got := mal.add(tt.decision); got != tt.want {
+				t.Errorf("add() = %v, want %v", got, tt.want)
+			}
+			address := *tt.decision.Value
+			if got := mal.cache.Has(address); got != tt.wantBan {
+				t.Errorf("address in ban cache = %v, want %v", got, tt.wantBan)
+			}
+			if got := mal.typed["captcha"].cache.Has(address); got != tt.wantTyped {
+				t.Errorf("address in captcha cache = %v, want %v", got, tt.wantTyped)
+			}
+			if got := metricValue(t, "cs_mikrotik_bouncer_decisions_total", labels) - before; got != 1 {
+				t.Errorf("decisions_total{operation=%q} increased by %v, want 1", tt.operation, got)
+			}
+		})
+	}
+}
+
+func TestRemoveDecisionTypes(t *testing.T) {
+	useSettings(t, &settings{})
+	useIPV4, useIPV6 = true, true
+	tests := []struct {
+		name      string
+		decision  *models.Decision
+		want      bool
+		keepBan   bool
+		keepTyped bool
+		operation string
+	}{
+		{"ban", newDecision("192.0.2.1", "ban", false), true, false, true, "remove"},
+		{"captcha", newDecision("192.0.2.1", "captcha", false), true, true, false, "remove"},
+		{"not configured type", newDecision("192.0.2.1", "throttle", false), false, true, true, "skip_type"},
+		// the same address may have real decision in the cache
+		{"simulated", newDecision("192.0.2.1", "ban", true), false, true, true, "simulated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mal := newTypedAddrList()
+			address := *tt.decision.Value
+			mal.cache.Set(address, cacheEntry{origin: "crowdsec"}, ttlcache.DefaultTTL)
+			mal.typed["captcha"].cache.Set(address, cacheEntry{origin: "crowdsec"}, ttlcache.DefaultTTL)
+			labels := map[string]string{"func": "remove", "operation": tt.operation, "type": decisionTypeOf(tt.decision)}
+			before := metricValue(t, "cs_mikrotik_bouncer_decisions_total", labels)
+
+			if got := mal.remove(tt.decision); got != tt.want {
+				t.Errorf("remove() = %v, want %v", got, tt.want)
+			}
+			if got := mal.cache.Has(address); got != tt.keepBan {
+				t.Errorf("address in ban cache = %v, want %v", got, tt.keepBan)
+			}
+			if got := mal.typed["captcha"].cache.Has(address); got != tt.keepTyped {
+				t.Errorf("address in captcha cache = %v, want %v", got, tt.keepTyped)
+			}
+			if got := metricValue(t, "cs_mikrotik_bouncer_decisions_total", labels) - before; got != 1 {
+				t.Errorf("decisions_total{operation=%q} increased by %v, want 1", tt.operation, got)
+			}
+		})
+	}
+}
+
+func TestDecisionTypeOf(t *testing.T) {
+	if got := decisionTypeOf(&models.Decision{}); got != decisionTypeBan {
+		t.Errorf("decision without type = %s, want %s", got, decisionTypeBan)
+	}
+	decision := newDecision("192.0.2.1", "CAPTCHA", false)
+	if got := decisionTypeOf(decision); got != "captcha" {
+		t.Errorf("decisionTypeOf() = %s, want captcha", got)
+	}
+}
+
+func TestParseTypeLists(t *testing.T) {
+	lists, err := parseTypeLists([]string{"captcha=crowdsec_captcha", "Throttle=crowdsec_throttle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 2 || lists["captcha"].prefix != "crowdsec_captcha" || lists["throttle"].prefix != "crowdsec_throttle" {
+		t.Errorf("parseTypeLists() = %v", lists)
+	}
+	for _, entries := range [][]string{{"captcha"}, {"=list"}, {"ban=crowdsec_ban"}, {"captcha=a", "captcha=b"}} {
+		if _, err := parseTypeLists(entries); err == nil {
+			t.Errorf("parseTypeLists(%q) succeeded, want error", entries)
+		}
+	}
+
+	rules, err := parseTypeRules([]string{"captcha=ip:nat:src:3,4"}, lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := firewallRule{proto: "ip", mode: "nat", where: "src", ids: "3,4"}
+	if got := rules["captcha"]; len(got) != 1 || got[0] != want {
+		t.Errorf("captcha rules = %v, want %v", got, want)
+	}
+	for _, entry := range []string{"ban=ip:filter:src:1", "captcha=ip:filter:src", "captcha=ip:input:src:1", "captcha=ip:nat:any:1", "captcha=ip:nat:src:a"} {
+		if _, err := parseTypeRules([]string{entry}, lists); err == nil {
+			t.Errorf("parseTypeRules(%q) succeeded, want error", entry)
+		}
+	}
+}
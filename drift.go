@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// drift policies, what to do when firewall rules on the router differ from what bouncer set
+const (
+	driftPolicyHeal  = "heal"  // set address-list back and enable disabled rules
+	driftPolicyAlert = "alert" // only log, count and send drift hook event
+)
+
+// kinds of firewall rule drift
+const (
+	driftListChanged = "list_changed" // rule uses other address-list than the last one set by bouncer
+	driftDisabled    = "disabled"     // rule is disabled
+	driftMissing     = "missing"      // rule number is out of range, rule was deleted
+)
+
+// expectedRule is single firewall rule number with address-list it should use,
+// list is empty if bouncer did not set any address-list to it yet
+type expectedRule struct {
+	firewallRule
+	id   string
+	list string
+}
+
+// driftRule is firewall rule as read from the router
+type driftRule struct {
+	id       string // item id, such as *1A
+	list     string
+	disabled bool
+}
+
+// expectedRules returns every configured firewall rule number with the address-list last set by bouncer
+func (mal *mikrotikAddrList) expectedRules() []expectedRule {
+	type prefixRules struct {
+		prefix string
+		rules  []firewallRule
+	}
+	lists := []prefixRules{{addressList, banRules()}}
+	for _, list := range mal.typed {
+		lists = append(lists, prefixRules{list.prefix, list.rules()})
+	}
+
+	var expected []expectedRule
+	if permanentList != "" {
+		// permanent_list is never sharded
+		for _, rule := range live.Load().permanentRules {
+			if (rule.proto == "ip" && !useIPV4) || (rule.proto == "ipv6" && !useIPV6) {
+				continue
+			}
+			list := ""
+			if _, ok := mal.currentLists.Load(permanentList); ok {
+				list = permanentList
+			}
+			for id := range strings.SplitSeq(rule.ids, ",") {
+				expected = append(expected, expectedRule{firewallRule: rule, id: id, list: list})
+			}
+		}
+	}
+	for _, l := range lists {
+		for _, rule := range l.rules {
+			if (rule.proto == "ip" && !useIPV4) || (rule.proto == "ipv6" && !useIPV6) {
+				continue
+			}
+			for shard := range mikrotikShards {
+				key := l.prefix
+				ids := rule.ids
+				if mikrotikShards > 1 {
+					key = fmt.Sprintf("%s_%d", l.prefix, shard)
+					ids = shardRuleIds(rule.ids, shard, mikrotikShards)
+				}
+				list := ""
+				if current, ok := mal.currentLists.Load(key); ok {
+					list = current.(string)
+				}
+				for id := range strings.SplitSeq(ids, ",") {
+					expected = append(expected, expectedRule{firewallRule: rule, id: id, list: list})
+				}
+			}
+		}
+	}
+	return expected
+}
+
+// readDriftRules returns address-list and disabled state of all rules in given firewall table, indexed by rule number
+func readDriftRules(c mikrotikClient, proto string, mode string, where string) ([]driftRule, error) {
+	whereStr := where + "-address-list"
+	r, err := c.RunArgs([]string{
+		fmt.Sprintf("/%s/firewall/%s/print", proto, mode),
+		"=.proplist=.id,disabled," + whereStr,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]driftRule, 0, len(r.Re))
+	for _, re := range r.Re {
+		rules = append(rules, driftRule{
+			id:       re.Map[".id"],
+			list:     re.Map[whereStr],
+			disabled: re.Map["disabled"] == "true",
+		})
+	}
+	return rules, nil
+}
+
+// driftLoop periodically checks configured firewall rules on the MikroTik
+func (mal *mikrotikAddrList) driftLoop() {
+	for {
+		time.Sleep(driftInterval)
+		mal.checkDrift()
+	}
+}
+
+// checkDrift compares configured firewall rules on the router with the address-lists last set by bouncer,
+// and depending on firewall_drift_policy sets them back
+//
+// it runs under the same lock as mikrotik updates, so rules are never checked in the middle of an update
+func (mal *mikrotikAddrList) checkDrift() {
+	mal.mutex.Lock()
+	defer mal.mutex.Unlock()
+
+	if !isLeader() {
+		return
+	}
+	c, err := mal.conn.acquire()
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Str("func", "checkDrift").
+			Msg("Mikrotik not available, skipping firewall drift check")
+		return
+	}
+	defer mal.conn.release()
+	mal.c = c
+
+	if mal.ruleIds == nil {
+		mal.ruleIds = map[string]string{}
+	}
+	tables := map[string][]driftRule{}
+	var drifts []string
+	for _, rule := range mal.expectedRules() {
+		table := rule.proto + "/" + rule.mode + "/" + rule.where
+		number := table + "/" + rule.id
+		current, ok := tables[table]
+		if !ok {
+			current, err = readDriftRules(c, rule.proto, rule.mode, rule.where)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("func", "checkDrift").
+					Str("proto", rule.proto).
+					Str("mode", rule.mode).
+					Msg("Failed to read firewall rules")
+				metricDriftChecks.WithLabelValues("error").Inc()
+				return
+			}
+			tables[table] = current
+		}
+
+		kind := ""
+		n, _ := strconv.Atoi(rule.id)
+		switch {
+		case n >= len(current):
+			kind = driftMissing
+		case rule.list != "" && current[n].list != rule.list:
+			kind = driftListChanged
+		case current[n].disabled:
+			kind = driftDisabled
+		default:
+			// rule uses expected address-list, remember which rule has this number
+			// so that other rule which takes the number later is not healed
+			if rule.list != "" {
+				mal.ruleIds[number] = current[n].id
+			}
+			continue
+		}
+
+		metricDrift.WithLabelValues(rule.proto, rule.mode, kind).Inc()
+		drift := fmt.Sprintf("%s firewall %s rule %s is %s", rule.proto, rule.mode, rule.id, strings.ReplaceAll(kind, "_", " "))
+		logger := log.Warn().
+			Str("func", "checkDrift").
+			Str("proto", rule.proto).
+			Str("mode", rule.mode).
+			Str("where", rule.where).
+			Str("number", rule.id).
+			Str("kind", kind).
+			Str("expected_list", rule.list)
+		if n < len(current) {
+			logger = logger.Str("current_list", current[n].list)
+		}
+		logger.Msg("Firewall rule drift detected")
+
+		// missing rule can not be recreated, bouncer does not know what it matched
+		if driftPolicy == driftPolicyHeal && kind != driftMissing && mal.healDrift(rule, current[n], kind, mal.ruleIds[number]) {
+			continue
+		}
+		drifts = append(drifts, drift)
+	}
+	metricDriftChecks.WithLabelValues("success").Inc()
+	metricDriftActive.Set(float64(len(drifts)))
+
+	if len(drifts) > 0 {
+		hooks.fire(hookDrift, strings.Join(drifts, "; "), nil, 0)
+	}
+}
+
+// healDrift sets expected address-list back to the rule, or enables it, returns true on success
+//
+// rules are set by number, so after rules were deleted, inserted or reordered a different rule
+// may have the number now, such rule is only reported:
+// address-list is set back only if the rule has the item id it had when it last used the expected
+// address-list (knownId), and disabled rule is enabled only if it still uses the expected address-list
+func (mal *mikrotikAddrList) healDrift(rule expectedRule, current driftRule, kind string, knownId string) bool {
+	var err error
+	switch kind {
+	case driftListChanged:
+		if knownId == "" || current.id != knownId {
+			log.Warn().
+				Str("func", "healDrift").
+				Str("proto", rule.proto).
+				Str("mode", rule.mode).
+				Str("number", rule.id).
+				Str("id", current.id).
+				Str("known_id", knownId).
+				Msg("Firewall rule number is used by other rule than before, not healing it")
+			return false
+		}
+		err = mal.setAddressListInFirewall(rule.proto, rule.mode, rule.list, rule.id, rule.where)
+	case driftDisabled:
+		if rule.list == "" || current.list != rule.list {
+			return false
+		}
+		err = mal.runCmd(rule.proto, rule.mode, "set", []string{
+			fmt.Sprintf("/%s/firewall/%s/set", rule.proto, rule.mode),
+			"=.id=" + current.id,
+			"=disabled=no",
+		})
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+		log.Error().
+			Err(err).
+			Str("func", "healDrift").
+			Str("proto", rule.proto).
+			Str("mode", rule.mode).
+			Str("number", rule.id).
+			Str("kind", kind).
+			Msg("Failed to heal firewall rule drift")
+	} else {
+		log.Info().
+			Str("func", "healDrift").
+			Str("proto", rule.proto).
+			Str("mode", rule.mode).
+			Str("number", rule.id).
+			Str("kind", kind).
+			Msg("Firewall rule drift healed")
+	}
+	metricDriftHeal.WithLabelValues(rule.proto, rule.mode, kind, result).Inc()
+	return err == nil
+}
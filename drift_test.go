@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpectedRules(t *testing.T) {
+	addressList = "crowdsec"
+	useIPV4, useIPV6 = true, false
+	useSettings(t, &settings{
+		banRules: []firewallRule{
+			{proto: "ip", mode: "filter", where: "src", ids: "1,2"},
+			{proto: "ipv6", mode: "filter", where: "src", ids: "3"},
+		},
+		typeRules: map[string][]firewallRule{
+			"captcha": {{proto: "ip", mode: "filter", where: "dst", ids: "7,8"}},
+		},
+	})
+	typed := map[string]*typedList{"captcha": {decisionType: "captcha", prefix: "crowdsec_captcha"}}
+
+	format := func(rules []expectedRule) []string {
+		var out []string
+		for _, r := range rules {
+			out = append(out, fmt.Sprintf("%s/%s/%s/%s=%s", r.proto, r.mode, r.where, r.id, r.list))
+		}
+		slices.Sort(out)
+		return out
+	}
+
+	t.Run("single list", func(t *testing.T) {
+		mikrotikShards = 1
+		mal := &mikrotikAddrList{typed: typed}
+		mal.currentLists.Store("crowdsec", "crowdsec_1700000000")
+
+		// rules of lists not set yet by bouncer are expected without address-list
+		want := []string{
+			"ip/filter/dst/7=",
+			"ip/filter/dst/8=",
+			"ip/filter/src/1=crowdsec_1700000000",
+			"ip/filter/src/2=crowdsec_1700000000",
+		}
+		if got := format(mal.expectedRules()); !slices.Equal(got, want) {
+			t.Errorf("expectedRules() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("shards", func(t *testing.T) {
+		mikrotikShards = 2
+		defer func() { mikrotikShards = 1 }()
+		mal := &mikrotikAddrList{}
+		mal.currentLists.Store("crowdsec_0", "crowdsec_0_1700000000")
+		mal.currentLists.Store("crowdsec_1", "crowdsec_1_1700000000")
+
+		want := []string{
+			"ip/filter/src/1=crowdsec_0_1700000000",
+			"ip/filter/src/2=crowdsec_1_1700000000",
+		}
+		if got := format(mal.expectedRules()); !slices.Equal(got, want) {
+			t.Errorf("expectedRules() = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestCheckDrift(t *testing.T) {
+	addressList = "crowdsec"
+	useIPV4, useIPV6 = true, false
+	useSettings(t, &settings{banRules: []firewallRule{{proto: "ip", mode: "filter", where: "src", ids: "0,1,2,5"}}})
+	mikrotikShards = 1
+	leader, hooks = nil, nil
+	errRetries = 0
+
+	expected := []map[string]string{
+		{".id": "*A", "src-address-list": "crowdsec_1700000000", "disabled": "false"},
+		{".id": "*B", "src-address-list": "crowdsec_1700000000", "disabled": "false"},
+		{".id": "*C", "src-address-list": "crowdsec_1700000000", "disabled": "false"},
+	}
+	changed := []map[string]string{
+		expected[0],
+		{".id": "*B", "src-address-list": "manual", "disabled": "false"},
+		{".id": "*C", "src-address-list": "crowdsec_1700000000", "disabled": "true"},
+	}
+	// rule *B was deleted and other rule took its number
+	replaced := []map[string]string{
+		expected[0],
+		{".id": "*D", "src-address-list": "manual", "disabled": "false"},
+		changed[2],
+	}
+
+	tests := []struct {
+		name       string
+		policy     string
+		rules      []map[string]string
+		wantSet    []string
+		wantActive float64
+	}{
+		// missing rule can not be healed
+		{"heal", driftPolicyHeal, changed, []string{
+			"/ip/firewall/filter/set =src-address-list=crowdsec_1700000000 =.id=1",
+			"/ip/firewall/filter/set =.id=*C =disabled=no",
+		}, 1},
+		{"heal other rule", driftPolicyHeal, replaced, []string{
+			"/ip/firewall/filter/set =.id=*C =disabled=no",
+		}, 2},
+		{"alert", driftPolicyAlert, changed, nil, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driftPolicy = tt.policy
+			rules := expected
+			fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+				if words[0] != "/ip/firewall/filter/print" {
+					return nil, ""
+				}
+				return rules, ""
+			}}
+			mal := &mikrotikAddrList{conn: newMikrotikConnection()}
+			mal.conn.dial = fr.dial
+			mal.currentLists.Store("crowdsec", "crowdsec_1700000000")
+
+			// rules are as expected on the first check, only rule 5 is missing
+			mal.checkDrift()
+			rules = tt.rules
+
+			labels := map[string]string{"proto": "ip", "mode": "filter", "kind": driftListChanged}
+			before := metricValue(t, "cs_mikrotik_bouncer_firewall_drift_total", labels)
+
+			mal.checkDrift()
+
+			var set []string
+			for _, command := range fr.received() {
+				if strings.HasPrefix(command, "/ip/firewall/filter/set") {
+					set = append(set, command)
+				}
+			}
+			if !slices.Equal(set, tt.wantSet) {
+				t.Errorf("set commands = %q, want %q", set, tt.wantSet)
+			}
+			if got := metricValue(t, "cs_mikrotik_bouncer_firewall_drift_rules", nil); got != tt.wantActive {
+				t.Errorf("firewall_drift_rules = %v, want %v", got, tt.wantActive)
+			}
+			if got := metricValue(t, "cs_mikrotik_bouncer_firewall_drift_total", labels) - before; got != 1 {
+				t.Errorf("list_changed drift increased by %v, want 1", got)
+			}
+		})
+	}
+}
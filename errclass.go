@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+)
+
+// error classes for failed mikrotik commands, used in metrics and to pick error policy
+const (
+	errClassNone       = "none"       // no error
+	errClassExists     = "exists"     // 'already have such entry', harmless
+	errClassNotFound   = "not_found"  // 'no such item', usually config drift such as deleted firewall rule
+	errClassDevice     = "device"     // any other !trap returned by the device
+	errClassFatal      = "fatal"      // !fatal returned by the device, it closes the connection
+	errClassTimeout    = "timeout"    // network timeout
+	errClassConnection = "connection" // connection reset, broken pipe, EOF etc
+)
+
+// error policies which can be assigned to error classes
+const (
+	errPolicyIgnore    = "ignore"    // log and continue as if command succeeded
+	errPolicyRetry     = "retry"     // retry command up to mikrotik_error_retries times
+	errPolicyAbort     = "abort"     // abort current update run
+	errPolicyUnhealthy = "unhealthy" // drop the connection, abort current update run and retry it after reconnect
+)
+
+// errRetryDelayMax caps delay between retries of failed command,
+// commands are retried while holding the update lock, so the delay must stay short
+const errRetryDelayMax = 5 * time.Second
+
+var errClasses = []string{
+	errClassExists,
+	errClassNotFound,
+	errClassDevice,
+	errClassFatal,
+	errClassTimeout,
+	errClassConnection,
+}
+
+// defaultErrPolicy is used for classes not overridden by mikrotik_error_policy
+var defaultErrPolicy = map[string]string{
+	errClassExists:     errPolicyIgnore,
+	errClassNotFound:   errPolicyAbort,
+	errClassDevice:     errPolicyAbort,
+	errClassFatal:      errPolicyUnhealthy,
+	errClassTimeout:    errPolicyRetry,
+	errClassConnection: errPolicyRetry,
+}
+
+// classifyError returns error class for error returned by go-routeros client
+func classifyError(err error) string {
+	if err == nil {
+		return errClassNone
+	}
+
+	var devErr *routeros.DeviceError
+	if errors.As(err, &devErr) {
+		if devErr.Sentence.Word == "!fatal" {
+			return errClassFatal
+		}
+		return classifyDeviceMessage(devErr.Sentence.Map["message"])
+	}
+
+	var restErr *restError
+	if errors.As(err, &restErr) {
+		return classifyDeviceMessage(restErr.Detail)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errClassTimeout
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return errClassTimeout
+	}
+
+	return errClassConnection
+}
+
+// classifyDeviceMessage returns error class for error message reported by the device
+func classifyDeviceMessage(msg string) string {
+	switch {
+	case strings.Contains(msg, "already have such entry"):
+		return errClassExists
+	case strings.Contains(msg, "no such item"):
+		return errClassNotFound
+	}
+	return errClassDevice
+}
+
+// retryDelay returns delay before given retry of failed command,
+// starting at mikrotik_error_retry_delay and doubled on each retry, up to errRetryDelayMax
+func retryDelay(attempt int) time.Duration {
+	d := errRetryDelay
+	for i := 1; i < attempt && d < errRetryDelayMax; i++ {
+		d *= 2
+	}
+	return min(d, errRetryDelayMax)
+}
+
+// isTransportErrClass returns true if error class means that connection is no longer usable
+func isTransportErrClass(class string) bool {
+	return class == errClassTimeout || class == errClassConnection || class == errClassFatal
+}
+
+// parseErrPolicy parses comma separated list of class=policy pairs
+// and returns it merged with defaultErrPolicy
+func parseErrPolicy(value string) (map[string]string, error) {
+	policy := maps.Clone(defaultErrPolicy)
+
+	if value == "" {
+		return policy, nil
+	}
+
+	for pair := range strings.SplitSeq(value, ",") {
+		class, p, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry '%s', expected class=policy", pair)
+		}
+		if _, known := defaultErrPolicy[class]; !known {
+			return nil, fmt.Errorf("unknown error class '%s'", class)
+		}
+		switch p {
+		case errPolicyIgnore, errPolicyRetry, errPolicyAbort, errPolicyUnhealthy:
+		default:
+			return nil, fmt.Errorf("unknown error policy '%s' for class '%s'", p, class)
+		}
+		policy[class] = p
+	}
+	return policy, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/go-routeros/routeros/v3/proto"
+)
+
+func deviceError(word string, message string) error {
+	return &routeros.DeviceError{Sentence: &proto.Sentence{Word: word, Map: map[string]string{"message": message}}}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, errClassNone},
+		{"exists", deviceError("!trap", "failure: already have such entry"), errClassExists},
+		{"not found", deviceError("!trap", "no such item"), errClassNotFound},
+		{"other trap", deviceError("!trap", "input does not match any value of interface"), errClassDevice},
+		{"fatal", deviceError("!fatal", "session terminated on request"), errClassFatal},
+		{"wrapped device error", fmt.Errorf("add: %w", deviceError("!trap", "no such item")), errClassNotFound},
+		{"deadline", os.ErrDeadlineExceeded, errClassTimeout},
+		{"context deadline", fmt.Errorf("run: %w", context.DeadlineExceeded), errClassTimeout},
+		{"eof", io.EOF, errClassConnection},
+		{"other", errors.New("broken pipe"), errClassConnection},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string // overrides of defaultErrPolicy
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{name: "single", value: "not_found=unhealthy", want: map[string]string{errClassNotFound: errPolicyUnhealthy}},
+		{name: "spaces", value: "device=retry, exists=abort", want: map[string]string{errClassDevice: errPolicyRetry, errClassExists: errPolicyAbort}},
+		{name: "missing policy", value: "device", wantErr: true},
+		{name: "unknown class", value: "none=ignore", wantErr: true},
+		{name: "unknown policy", value: "device=skip", wantErr: true},
+		{name: "trailing comma", value: "device=retry,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseErrPolicy(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseErrPolicy() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseErrPolicy() error = %v", err)
+			}
+			for class, policy := range defaultErrPolicy {
+				want := policy
+				if override, ok := tt.want[class]; ok {
+					want = override
+				}
+				if got[class] != want {
+					t.Errorf("policy of %s = %s, want %s", class, got[class], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	errRetryDelay = 500 * time.Millisecond
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 500 * time.Millisecond},
+		{2, time.Second},
+		{4, 4 * time.Second},
+		{5, errRetryDelayMax},
+		{50, errRetryDelayMax},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// decision scopes resolved to prefixes with geo databases
+const (
+	scopeAS      = "as"
+	scopeCountry = "country"
+)
+
+var errGeoNotFound = errors.New("no prefixes found in geo database")
+
+// geo is nil when no geo database is configured
+var geo *geoDB
+
+// geoDB holds aggregated prefixes of countries and autonomous systems loaded from MMDB or CSV files,
+// files are loaded into memory and reloaded when they change on disk
+type geoDB struct {
+	mutex   sync.RWMutex
+	country map[string][]netip.Prefix // country ISO code -> prefixes
+	asn     map[string][]netip.Prefix // AS number -> prefixes
+	loaded  map[string]time.Time      // file -> modification time when it was loaded
+}
+
+func newGeoDB() (*geoDB, error) {
+	g := &geoDB{}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// load reads all configured files and replaces prefixes only if all of them were read successfully
+func (g *geoDB) load() error {
+	loadStart := time.Now()
+	country := map[string][]netip.Prefix{}
+	asn := map[string][]netip.Prefix{}
+	loaded := map[string]time.Time{}
+
+	for _, db := range []struct {
+		files  []string
+		scope  string
+		target map[string][]netip.Prefix
+	}{
+		{geoCountryDB, scopeCountry, country},
+		{geoASNDB, scopeAS, asn},
+	} {
+		for _, file := range db.files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			if strings.EqualFold(filepath.Ext(file), ".mmdb") {
+				err = loadMMDB(file, db.scope, db.target)
+			} else {
+				err = loadGeoCSV(file, db.scope, db.target)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", file, err)
+			}
+			loaded[file] = info.ModTime()
+		}
+		for key, prefixes := range db.target {
+			db.target[key] = aggregatePrefixes(prefixes)
+		}
+	}
+
+	g.mutex.Lock()
+	g.country, g.asn, g.loaded = country, asn, loaded
+	g.mutex.Unlock()
+
+	metricGeoEntries.WithLabelValues(scopeCountry).Set(float64(len(country)))
+	metricGeoEntries.WithLabelValues(scopeAS).Set(float64(len(asn)))
+	metricGeoLoadTimestamp.SetToCurrentTime()
+	log.Info().
+		Str("func", "geo").
+		Int("countries", len(country)).
+		Int("autonomous_systems", len(asn)).
+		Str("duration", time.Since(loadStart).String()).
+		Msg("Geo database loaded")
+	return nil
+}
+
+// changed returns true if any of the loaded files has different modification time than when it was loaded
+func (g *geoDB) changed() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for file, modTime := range g.loaded {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads files every geo_reload_interval if they changed, until ctx is done,
+// failed reload keeps previously loaded prefixes
+func (g *geoDB) watch(ctx context.Context) error {
+	if geoReloadInterval == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(geoReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if !g.changed() {
+			continue
+		}
+		if err := g.load(); err != nil {
+			metricGeoReload.WithLabelValues("error").Inc()
+			log.Error().
+				Err(err).
+				Str("func", "geo").
+				Msg("Failed to reload geo database, keeping previous one")
+			continue
+		}
+		metricGeoReload.WithLabelValues("success").Inc()
+	}
+}
+
+// geoKey normalizes decision value, such as 'AS13335' or '13335' for AS, and 'cn' for country
+func geoKey(scope string, value string) string {
+	value = strings.TrimSpace(value)
+	if scope == scopeAS {
+		if len(value) > 2 && strings.EqualFold(value[:2], "as") {
+			value = value[2:]
+		}
+		return value
+	}
+	return strings.ToUpper(value)
+}
+
+// lookup returns aggregated prefixes of given country or AS,
+// prefixes of disabled IP families are left out
+func (g *geoDB) lookup(scope string, value string) ([]netip.Prefix, error) {
+	g.mutex.RLock()
+	var prefixes []netip.Prefix
+	switch scope {
+	case scopeCountry:
+		prefixes = g.country[geoKey(scope, value)]
+	case scopeAS:
+		prefixes = g.asn[geoKey(scope, value)]
+	}
+	g.mutex.RUnlock()
+
+	var enabled []netip.Prefix
+	for _, p := range prefixes {
+		if (p.Addr().Is4() && useIPV4) || (p.Addr().Is6() && useIPV6) {
+			enabled = append(enabled, p)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil, errGeoNotFound
+	}
+	return enabled, nil
+}
+
+// aggregatePrefixes returns the smallest set of prefixes covering the same addresses,
+// prefixes contained in other prefixes are dropped, and adjacent halves are merged into their parent
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		sorted = append(sorted, p.Masked())
+	}
+	slices.SortFunc(sorted, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+
+	var out []netip.Prefix
+	for _, p := range sorted {
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			if last.Bits() <= p.Bits() && last.Contains(p.Addr()) {
+				continue
+			}
+		}
+		out = append(out, p)
+		for len(out) > 1 {
+			a, b := out[len(out)-2], out[len(out)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			out = append(out[:len(out)-2], parent)
+		}
+	}
+	return out
+}
+
+// geoRecord is the part of GeoLite2/GeoIP2 Country and ASN records used by the bouncer
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// key returns country code or AS number of the record for given scope
+func (r geoRecord) key(scope string) string {
+	if scope == scopeAS {
+		if r.ASN == 0 {
+			return ""
+		}
+		return fmt.Sprint(r.ASN)
+	}
+	if r.Country.ISOCode != "" {
+		return r.Country.ISOCode
+	}
+	return r.RegisteredCountry.ISOCode
+}
+
+// loadMMDB adds all networks from MaxMind database file to target
+func loadMMDB(file string, scope string, target map[string][]netip.Prefix) error {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(raw)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	networks := reader.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record geoRecord
+		network, err := networks.Network(&record)
+		if err != nil {
+			return err
+		}
+		key := record.key(scope)
+		if key == "" {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(network.IP)
+		if !ok {
+			continue
+		}
+		bits, _ := network.Mask.Size()
+		target[key] = append(target[key], netip.PrefixFrom(addr.Unmap(), bits))
+	}
+	return networks.Err()
+}
+
+// loadGeoCSV adds networks from CSV file with header to target,
+// 'network' column has the prefix and country or AS number is taken from the first known column:
+// country_iso_code, country, autonomous_system_number, asn
+func loadGeoCSV(file string, scope string, target map[string][]netip.Prefix) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	networkCol, keyCol := -1, -1
+	keyColumns := []string{"country_iso_code", "country"}
+	if scope == scopeAS {
+		keyColumns = []string{"autonomous_system_number", "asn"}
+	}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "network" {
+			networkCol = i
+		}
+		if keyCol == -1 && slices.Contains(keyColumns, name) {
+			keyCol = i
+		}
+	}
+	if networkCol == -1 || keyCol == -1 {
+		return fmt.Errorf("header must have 'network' and one of '%s' columns", strings.Join(keyColumns, "', '"))
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key := geoKey(scope, record[keyCol])
+		if key == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(record[networkCol])
+		if err != nil {
+			return err
+		}
+		target[key] = append(target[key], prefix)
+	}
+}
+
+// geoDecision identifies AS or country decision, prefixes added for it are kept under this key
+type geoDecision struct {
+	decisionType string
+	entry        cacheEntry
+}
+
+// addGeo adds all prefixes of AS or country decision to the cache, each with the decision TTL,
+// and remembers them, so that removeGeo removes the same prefixes after geo database reload
+func (mal *mikrotikAddrList) addGeo(decision *models.Decision, scope string) bool {
+	prefixes, ok := geoPrefixes(decision, scope, "add")
+	if !ok {
+		return false
+	}
+	entry := geoEntry(decision, scope)
+	key := geoDecision{decisionTypeOf(decision), entry}
+	added := false
+	for _, p := range prefixes {
+		added = mal.addAddress(decision, p.String(), entry) || added
+		if !slices.Contains(mal.geoAdded[key], p) {
+			mal.geoAdded[key] = append(mal.geoAdded[key], p)
+		}
+	}
+	return added
+}
+
+// removeGeo removes prefixes added for AS or country decision from the cache,
+// prefixes which are in the cache because of other decisions are kept
+func (mal *mikrotikAddrList) removeGeo(decision *models.Decision, scope string) bool {
+	entry := geoEntry(decision, scope)
+	key := geoDecision{decisionTypeOf(decision), entry}
+	prefixes, ok := mal.geoAdded[key]
+	if ok {
+		delete(mal.geoAdded, key)
+		metricGeoDecisions.WithLabelValues(scope, "remove", "added").Inc()
+	} else {
+		// decision was not added since start, such as when it was skipped, resolve it again
+		prefixes, ok = geoPrefixes(decision, scope, "remove")
+		if !ok {
+			return false
+		}
+	}
+	cache := mal.cacheFor(decisionTypeOf(decision))
+	removed := false
+	for _, p := range prefixes {
+		if cache != nil {
+			if item := cache.Get(p.String()); item != nil && item.Value() != entry {
+				continue
+			}
+		}
+		removed = mal.removeAddress(decision, p.String()) || removed
+	}
+	return removed
+}
+
+// geoEntry returns cache entry of prefixes added by AS or country decision,
+// with comment such as 'crowdsec manual Country:CN'
+func geoEntry(decision *models.Decision, scope string) cacheEntry {
+	entry := newCacheEntry(decision)
+	entry.scope = fmt.Sprintf("%s:%s", *decision.Scope, geoKey(scope, *decision.Value))
+	return entry
+}
+
+// geoPrefixes resolves AS or country decision to prefixes, returns false if it can not be resolved
+// or has more than geo_max_prefixes prefixes
+func geoPrefixes(decision *models.Decision, scope string, action string) ([]netip.Prefix, bool) {
+	if geo == nil {
+		log.Warn().
+			Str("func", "geo").
+			Str("scope", *decision.Scope).
+			Str("value", *decision.Value).
+			Msg("skipping, geo database is not configured")
+		metricGeoDecisions.WithLabelValues(scope, action, "no_database").Inc()
+		return nil, false
+	}
+	prefixes, err := geo.lookup(scope, *decision.Value)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("func", "geo").
+			Str("scope", *decision.Scope).
+			Str("value", *decision.Value).
+			Msg("skipping, decision can not be resolved to prefixes")
+		metricGeoDecisions.WithLabelValues(scope, action, "not_found").Inc()
+		return nil, false
+	}
+	if len(prefixes) > geoMaxPrefixes {
+		log.Warn().
+			Str("func", "geo").
+			Str("scope", *decision.Scope).
+			Str("value", *decision.Value).
+			Int("prefixes", len(prefixes)).
+			Int("geo_max_prefixes", geoMaxPrefixes).
+			Msg("skipping, decision has too many prefixes")
+		metricGeoDecisions.WithLabelValues(scope, action, "too_large").Inc()
+		return nil, false
+	}
+	log.Info().
+		Str("func", "geo").
+		Str("scope", *decision.Scope).
+		Str("value", *decision.Value).
+		Int("prefixes", len(prefixes)).
+		Msg("Decision resolved to prefixes")
+	metricGeoDecisions.WithLabelValues(scope, action, "resolved").Inc()
+	metricGeoPrefixes.WithLabelValues(scope).Observe(float64(len(prefixes)))
+	return prefixes, true
+}
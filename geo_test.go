@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"single", "10.0.0.0/8", "10.0.0.0/8"},
+		{"contained", "10.0.0.0/8,10.1.0.0/16,10.1.2.0/24", "10.0.0.0/8"},
+		{"contained first", "10.1.2.0/24,10.0.0.0/8", "10.0.0.0/8"},
+		{"adjacent halves", "192.168.0.0/25,192.168.0.128/25", "192.168.0.0/24"},
+		{"merge cascade", "10.0.0.0/24,10.0.1.0/24,10.0.2.0/23", "10.0.0.0/22"},
+		{"not aligned", "10.0.1.0/24,10.0.2.0/24", "10.0.1.0/24,10.0.2.0/24"},
+		{"different sizes", "10.0.0.0/24,10.0.1.0/25", "10.0.0.0/24,10.0.1.0/25"},
+		{"unmasked", "10.0.0.5/24,10.0.1.7/24", "10.0.0.0/23"},
+		{"duplicates", "10.0.0.0/24,10.0.0.0/24", "10.0.0.0/24"},
+		{"ipv6", "2001:db8::/33,2001:db8:8000::/33,2001:db8:1::/48", "2001:db8::/32"},
+		{"mixed families", "2001:db8::/32,10.0.0.0/8", "10.0.0.0/8,2001:db8::/32"},
+		{"whole space", "0.0.0.0/1,128.0.0.0/1", "0.0.0.0/0"},
+		{"zero bits", "0.0.0.0/0,10.0.0.0/8", "0.0.0.0/0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in []netip.Prefix
+			if tt.in != "" {
+				for p := range strings.SplitSeq(tt.in, ",") {
+					in = append(in, netip.MustParsePrefix(p))
+				}
+			}
+			var got []string
+			for _, p := range aggregatePrefixes(in) {
+				got = append(got, p.String())
+			}
+			if joined := strings.Join(got, ","); joined != tt.want {
+				t.Errorf("aggregatePrefixes(%s) = %s, want %s", tt.in, joined, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregatePrefixesKeepsInput(t *testing.T) {
+	in := []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24"), netip.MustParsePrefix("10.0.0.0/24")}
+	orig := slices.Clone(in)
+	aggregatePrefixes(in)
+	if !slices.Equal(in, orig) {
+		t.Errorf("aggregatePrefixes modified input: %v", in)
+	}
+}
+
+func TestGeoCSV(t *testing.T) {
+	dir := t.TempDir()
+	countryFile := filepath.Join(dir, "country.csv")
+	asnFile := filepath.Join(dir, "asn.csv")
+	if err := os.WriteFile(countryFile, []byte("network,geoname_id,country_iso_code\n"+
+		"192.0.2.0/25,1,nl\n192.0.2.128/25,1,NL\n2001:db8::/32,1,NL\n198.51.100.0/24,2,\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(asnFile, []byte("Network,ASN\n203.0.113.0/24,AS64500\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geoCountryDB, geoASNDB = []string{countryFile}, []string{asnFile}
+	useIPV4, useIPV6 = true, false
+
+	g, err := newGeoDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.lookup(scopeCountry, "nl"); err != nil || len(got) != 1 || got[0].String() != "192.0.2.0/24" {
+		t.Errorf("lookup(country, nl) = %v, %v, want aggregated IPv4 prefix only", got, err)
+	}
+	for _, value := range []string{"AS64500", "as64500", "64500"} {
+		if got, err := g.lookup(scopeAS, value); err != nil || len(got) != 1 || got[0].String() != "203.0.113.0/24" {
+			t.Errorf("lookup(as, %s) = %v, %v", value, got, err)
+		}
+	}
+	if _, err := g.lookup(scopeCountry, "US"); !errors.Is(err, errGeoNotFound) {
+		t.Errorf("lookup of unknown country error = %v, want %v", err, errGeoNotFound)
+	}
+	if g.changed() {
+		t.Error("files changed right after load")
+	}
+
+	// invalid file keeps previously loaded prefixes
+	if err := os.WriteFile(asnFile, []byte("prefix,asn\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.load(); err == nil {
+		t.Error("load() of file without network column succeeded")
+	}
+	if _, err := g.lookup(scopeAS, "64500"); err != nil {
+		t.Errorf("lookup after failed reload error = %v", err)
+	}
+}
+
+func TestGeoRemoveAfterReload(t *testing.T) {
+	useSettings(t, &settings{defaultTTL: time.Hour})
+	countryFile := filepath.Join(t.TempDir(), "country.csv")
+	writeCountries := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(countryFile, []byte("network,geoname_id,country_iso_code\n"+content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCountries("192.0.2.0/25,1,NL\n")
+	geoCountryDB, geoASNDB = []string{countryFile}, nil
+	useIPV4, useIPV6 = true, false
+	geoMaxPrefixes = 100
+	g, err := newGeoDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo = g
+	defer func() { geo = nil }()
+
+	mal := newTypedAddrList()
+	mal.geoAdded = map[geoDecision][]netip.Prefix{}
+	country := func(value string) *models.Decision {
+		d := newDecision(value, "ban", false)
+		scope := "Country"
+		d.Scope = &scope
+		return d
+	}
+	mal.add(country("NL"))
+	mal.add(newDecision("198.51.100.0/24", "ban", false))
+
+	// database changed while the decision was active
+	writeCountries("198.51.100.0/24,1,NL\n")
+	if err := g.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !mal.remove(country("NL")) {
+		t.Error("remove() of added country decision returned false")
+	}
+	if mal.cache.Has("192.0.2.0/25") {
+		t.Error("prefix added for the decision is still cached")
+	}
+	if !mal.cache.Has("198.51.100.0/24") {
+		t.Error("prefix of other decision was removed")
+	}
+	if len(mal.geoAdded) != 0 {
+		t.Errorf("prefixes of removed decision are still remembered: %v", mal.geoAdded)
+	}
+
+	// decision which was not added since start is resolved again
+	mal.add(newDecision("198.51.100.0/24", "ban", false))
+	if mal.remove(country("NL")) || !mal.cache.Has("198.51.100.0/24") {
+		t.Error("prefix of other decision was removed by decision which was never added")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hook events
+const (
+	hookSyncFailure         = "sync_failure"         // single mikrotik update failed
+	hookConsecutiveFailures = "consecutive_failures" // hook_consecutive_failures updates failed in a row
+	hookRecovery            = "recovery"             // mikrotik update succeeded after failures
+	hookDrift               = "drift"                // firewall rules on the router differ from expected
+)
+
+var hookEvents = []string{hookSyncFailure, hookConsecutiveFailures, hookRecovery, hookDrift}
+
+// webhook payload templates for chat services, anything else is a path to template file
+var hookTemplates = map[string]string{
+	"slack":      `{"text":{{json .Text}}}`,
+	"mattermost": `{"text":{{json .Text}}}`,
+	"teams":      `{"@type":"MessageCard","@context":"https://schema.org/extensions","summary":{{json .Event}},"text":{{json .Text}}}`,
+}
+
+// hooks is nil when neither webhook nor exec hook is configured
+var hooks *notifier
+
+// hookPayload is sent as JSON to webhook and to stdin of exec hook, and is available in webhook template
+type hookPayload struct {
+	Event      string    `json:"event"`
+	Message    string    `json:"message"`
+	Error      string    `json:"error,omitempty"`
+	Failures   int       `json:"failures"`   // consecutive failed updates
+	Suppressed int       `json:"suppressed"` // notifications of this event dropped by rate limit since the previous one
+	Device     string    `json:"device"`
+	Instance   string    `json:"instance"`
+	Time       time.Time `json:"time"`
+}
+
+// Text returns payload as single line for chat messages
+func (p hookPayload) Text() string {
+	text := fmt.Sprintf("[%s] %s on %s: %s", bouncerType, p.Event, p.Device, p.Message)
+	if p.Error != "" {
+		text += ": " + p.Error
+	}
+	if p.Suppressed > 0 {
+		text += fmt.Sprintf(" (%d similar notifications suppressed)", p.Suppressed)
+	}
+	return text
+}
+
+// redactURL returns only scheme and host of webhook url for logs,
+// path of Slack, Teams and Mattermost incoming webhooks contains their secret token
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "***"
+	}
+	return u.Scheme + "://" + u.Host + "/***"
+}
+
+// notifier sends hook events to webhook and exec hook,
+// each event is sent at most once per hook_rate_limit so that flapping router does not flood the channel
+//
+// events are sent one by one in the background, so that slow webhook does not delay mikrotik updates
+// and recovery is never delivered before the failure it follows
+type notifier struct {
+	webhookURL string
+	exec       string
+	timeout    time.Duration
+	template   *template.Template // nil sends payload as is
+	http       *http.Client
+	events     map[string]bool
+	queue      chan hookPayload
+
+	mutex      sync.Mutex
+	failures   int
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+}
+
+func newNotifier() (*notifier, error) {
+	n := &notifier{
+		webhookURL: hookWebhookURL,
+		exec:       hookExec,
+		timeout:    hookTimeout,
+		http:       &http.Client{Timeout: hookTimeout},
+		events:     map[string]bool{},
+		queue:      make(chan hookPayload, 16),
+		lastSent:   map[string]time.Time{},
+		suppressed: map[string]int{},
+	}
+	for _, event := range hookEnabledEvents {
+		n.events[event] = true
+	}
+
+	if hookWebhookTemplate != "" && hookWebhookTemplate != "generic" {
+		source, ok := hookTemplates[hookWebhookTemplate]
+		if !ok {
+			raw, err := os.ReadFile(hookWebhookTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read webhook template: %w", err)
+			}
+			source = string(raw)
+		}
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v any) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+		n.template = tmpl
+	}
+	go func() {
+		for p := range n.queue {
+			n.send(p)
+		}
+	}()
+	return n, nil
+}
+
+// syncResult records result of mikrotik update and sends failure or recovery events
+func (n *notifier) syncResult(err error) {
+	if n == nil {
+		return
+	}
+	n.mutex.Lock()
+	if err == nil {
+		failures := n.failures
+		n.failures = 0
+		n.mutex.Unlock()
+		if failures > 0 {
+			n.fire(hookRecovery, fmt.Sprintf("mikrotik update succeeded after %d failed updates", failures), nil, failures)
+		}
+		return
+	}
+	n.failures++
+	failures := n.failures
+	n.mutex.Unlock()
+
+	n.fire(hookSyncFailure, "mikrotik update failed", err, failures)
+	if failures == hookConsecutiveFailureCount {
+		n.fire(hookConsecutiveFailures, fmt.Sprintf("%d mikrotik updates failed in a row", failures), err, failures)
+	}
+}
+
+// fire queues event for configured hooks, unless event is disabled or rate limited
+func (n *notifier) fire(event string, message string, err error, failures int) {
+	if n == nil || !n.events[event] {
+		return
+	}
+
+	n.mutex.Lock()
+	if last, ok := n.lastSent[event]; ok && time.Since(last) < hookRateLimit {
+		n.suppressed[event]++
+		n.mutex.Unlock()
+		metricHookSuppressed.WithLabelValues(event).Inc()
+		log.Debug().
+			Str("func", "hooks").
+			Str("event", event).
+			Msg("Hook event suppressed by rate limit")
+		return
+	}
+	p := hookPayload{
+		Event:      event,
+		Message:    message,
+		Failures:   failures,
+		Suppressed: n.suppressed[event],
+		Device:     mikrotikHost,
+		Instance:   leaderIdentity,
+		Time:       time.Now(),
+	}
+	n.lastSent[event] = p.Time
+	n.suppressed[event] = 0
+	n.mutex.Unlock()
+
+	if err != nil {
+		p.Error = err.Error()
+	}
+	if mikrotikTransport == transportREST {
+		p.Device = mikrotikRESTURL
+	}
+	select {
+	case n.queue <- p:
+	default:
+		metricHookNotifications.WithLabelValues("queue", event, "error").Inc()
+		log.Warn().
+			Str("func", "hooks").
+			Str("event", event).
+			Msg("Hook queue is full, event dropped")
+	}
+}
+
+func (n *notifier) send(p hookPayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	if n.webhookURL != "" {
+		n.result("webhook", p.Event, n.sendWebhook(ctx, p))
+	}
+	if n.exec != "" {
+		n.result("exec", p.Event, n.runExec(ctx, p))
+	}
+}
+
+func (n *notifier) result(hook string, event string, err error) {
+	if err != nil {
+		metricHookNotifications.WithLabelValues(hook, event, "error").Inc()
+		log.Error().
+			Err(err).
+			Str("func", "hooks").
+			Str("hook", hook).
+			Str("event", event).
+			Msg("Failed to send hook event")
+		return
+	}
+	metricHookNotifications.WithLabelValues(hook, event, "success").Inc()
+	log.Info().
+		Str("func", "hooks").
+		Str("hook", hook).
+		Str("event", event).
+		Msg("Hook event sent")
+}
+
+func (n *notifier) sendWebhook(ctx context.Context, p hookPayload) error {
+	var body bytes.Buffer
+	if n.template != nil {
+		if err := n.template.Execute(&body, p); err != nil {
+			return fmt.Errorf("failed to render webhook template: %w", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(p); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.http.Do(req)
+	if err != nil {
+		// url.Error includes full webhook url
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s %s: %w", urlErr.Op, redactURL(n.webhookURL), urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// runExec runs exec hook with payload on stdin and its fields in HOOK_* environment variables,
+// environment of the bouncer is not passed to the hook, as it contains mikrotik password and LAPI key
+func (n *notifier) runExec(ctx context.Context, p hookPayload) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, n.exec)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOOK_EVENT=" + p.Event,
+		"HOOK_MESSAGE=" + p.Message,
+		"HOOK_ERROR=" + p.Error,
+		"HOOK_FAILURES=" + strconv.Itoa(p.Failures),
+		"HOOK_DEVICE=" + p.Device,
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newQueuedNotifier returns notifier with all events enabled, which only queues events
+func newQueuedNotifier(queue int) *notifier {
+	n := &notifier{
+		events:     map[string]bool{},
+		queue:      make(chan hookPayload, queue),
+		lastSent:   map[string]time.Time{},
+		suppressed: map[string]int{},
+	}
+	for _, event := range hookEvents {
+		n.events[event] = true
+	}
+	return n
+}
+
+// queued returns events waiting in the queue
+func queued(n *notifier) []hookPayload {
+	var out []hookPayload
+	for {
+		select {
+		case p := <-n.queue:
+			out = append(out, p)
+		default:
+			return out
+		}
+	}
+}
+
+func TestHookRateLimit(t *testing.T) {
+	hookRateLimit = time.Hour
+	n := newQueuedNotifier(16)
+	labels := map[string]string{"event": hookSyncFailure}
+	before := metricValue(t, "cs_mikrotik_bouncer_hook_suppressed_total", labels)
+
+	n.fire(hookSyncFailure, "mikrotik update failed", errors.New("timeout"), 1)
+	n.fire(hookSyncFailure, "mikrotik update failed", errors.New("timeout"), 2)
+	n.fire(hookSyncFailure, "mikrotik update failed", errors.New("timeout"), 3)
+	// rate limit is per event
+	n.fire(hookRecovery, "mikrotik update succeeded", nil, 3)
+
+	got := queued(n)
+	if len(got) != 2 || got[0].Event != hookSyncFailure || got[0].Error != "timeout" || got[1].Event != hookRecovery {
+		t.Fatalf("queued events = %+v, want single sync_failure and recovery", got)
+	}
+	if d := metricValue(t, "cs_mikrotik_bouncer_hook_suppressed_total", labels) - before; d != 2 {
+		t.Errorf("hook_suppressed_total increased by %v, want 2", d)
+	}
+
+	// the next event after rate limit tells how many were suppressed
+	n.lastSent[hookSyncFailure] = time.Now().Add(-2 * time.Hour)
+	n.fire(hookSyncFailure, "mikrotik update failed", nil, 4)
+	got = queued(n)
+	if len(got) != 1 || got[0].Suppressed != 2 || !strings.Contains(got[0].Text(), "2 similar notifications suppressed") {
+		t.Errorf("event after rate limit = %+v, want 2 suppressed", got)
+	}
+}
+
+func TestHookQueueOverflow(t *testing.T) {
+	hookRateLimit = 0
+	n := newQueuedNotifier(1)
+	labels := map[string]string{"hook": "queue", "event": hookDrift, "result": "error"}
+	before := metricValue(t, "cs_mikrotik_bouncer_hook_notifications_total", labels)
+
+	n.fire(hookSyncFailure, "mikrotik update failed", nil, 1)
+	n.fire(hookDrift, "firewall rules changed", nil, 0)
+
+	if got := queued(n); len(got) != 1 || got[0].Event != hookSyncFailure {
+		t.Errorf("queued events = %+v, want only the first one", got)
+	}
+	if d := metricValue(t, "cs_mikrotik_bouncer_hook_notifications_total", labels) - before; d != 1 {
+		t.Errorf("dropped events increased by %v, want 1", d)
+	}
+}
+
+func TestHookSyncResult(t *testing.T) {
+	hookRateLimit = 0
+	hookConsecutiveFailureCount = 2
+	n := newQueuedNotifier(16)
+
+	n.syncResult(nil)
+	n.syncResult(errors.New("timeout"))
+	n.syncResult(errors.New("timeout"))
+	n.syncResult(errors.New("timeout"))
+	n.syncResult(nil)
+	n.syncResult(nil)
+
+	var events []string
+	for _, p := range queued(n) {
+		events = append(events, p.Event)
+	}
+	want := []string{hookSyncFailure, hookSyncFailure, hookConsecutiveFailures, hookSyncFailure, hookRecovery}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+
+	// disabled events are not sent at all
+	n.events = map[string]bool{hookRecovery: true}
+	n.syncResult(errors.New("timeout"))
+	if got := queued(n); len(got) != 0 {
+		t.Errorf("disabled events queued: %+v", got)
+	}
+
+	var none *notifier
+	none.syncResult(errors.New("timeout"))
+}
+
+func TestHookWebhookTemplate(t *testing.T) {
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer srv.Close()
+
+	hookWebhookURL, hookExec, hookWebhookTemplate = srv.URL, "", "slack"
+	hookEnabledEvents, hookRateLimit, hookTimeout = []string{hookDrift}, 0, time.Second
+	mikrotikHost = "192.0.2.1:8728"
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.fire(hookDrift, "firewall rules changed", nil, 0)
+
+	select {
+	case body := <-received:
+		var payload struct{ Text string }
+		if err := json.Unmarshal([]byte(body), &payload); err != nil {
+			t.Fatalf("invalid slack payload %s: %v", body, err)
+		}
+		if want := "drift on 192.0.2.1:8728: firewall rules changed"; !strings.Contains(payload.Text, want) {
+			t.Errorf("text = %q, want %q", payload.Text, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := map[string]string{
+		"https://hooks.slack.com/services/T000/B000/secret": "https://hooks.slack.com/***",
+		"http://192.0.2.1:8080/hook?token=secret":           "http://192.0.2.1:8080/***",
+		"not a url": "***",
+		"::invalid": "***",
+	}
+	for raw, want := range tests {
+		if got := redactURL(raw); got != want {
+			t.Errorf("redactURL(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestHookWebhookErrorRedacted(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // connection is refused
+
+	hookWebhookURL, hookExec, hookWebhookTemplate = srv.URL+"/services/T000/B000/secret", "", ""
+	hookEnabledEvents, hookRateLimit, hookTimeout = []string{hookDrift}, 0, time.Second
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.sendWebhook(t.Context(), hookPayload{Event: hookDrift})
+	if err == nil {
+		t.Fatal("expected error from closed webhook server")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error contains webhook token: %s", err)
+	}
+	if !strings.Contains(err.Error(), srv.URL+"/***") {
+		t.Errorf("error does not name webhook host: %s", err)
+	}
+}
+
+func TestHookExecEnv(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nenv > "+out+".env\ncat > "+out+".json\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MIKROTIK_PASS", "secret")
+
+	n := &notifier{exec: script}
+	p := hookPayload{Event: hookSyncFailure, Message: "update failed", Error: "timeout", Failures: 3, Device: "192.0.2.1:8728"}
+	if err := n.runExec(t.Context(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := os.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"HOOK_EVENT=" + hookSyncFailure, "HOOK_MESSAGE=update failed", "HOOK_ERROR=timeout",
+		"HOOK_FAILURES=3", "HOOK_DEVICE=192.0.2.1:8728", "PATH=",
+	} {
+		if !strings.Contains(string(env), want) {
+			t.Errorf("hook environment is missing %s:\n%s", want, env)
+		}
+	}
+	if strings.Contains(string(env), "MIKROTIK_PASS") {
+		t.Errorf("bouncer environment passed to hook:\n%s", env)
+	}
+
+	stdin, err := os.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got hookPayload
+	if err := json.Unmarshal(stdin, &got); err != nil || got.Failures != 3 || got.Event != hookSyncFailure {
+		t.Errorf("payload on stdin = %s, err %v", stdin, err)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// leader election backends
+const (
+	leaderElectionNone       = ""
+	leaderElectionFile       = "file"
+	leaderElectionKubernetes = "kubernetes"
+)
+
+var errNotLeader = errors.New("not a leader, mikrotik is updated by another replica")
+
+// leader is set when leader_election is enabled, nil means that this replica always writes to mikrotik
+var leader *leadership
+
+// isLeader returns true if this replica should write to mikrotik
+func isLeader() bool {
+	return leader == nil || leader.leader.Load()
+}
+
+// leadership tracks if this replica is the leader,
+// only the leader talks to mikrotik, followers keep processing decisions so that their cache is warm
+type leadership struct {
+	leader    atomic.Bool
+	onElected func() // called when this replica becomes the leader
+}
+
+func (l *leadership) set(value bool) {
+	if l.leader.Swap(value) == value {
+		return
+	}
+	if value {
+		metricLeader.Set(1)
+		metricLeaderTransitions.WithLabelValues("elected").Inc()
+		log.Info().
+			Str("func", "leadership").
+			Str("identity", leaderIdentity).
+			Msg("Became the leader, taking over mikrotik updates")
+		if l.onElected != nil {
+			l.onElected()
+		}
+		return
+	}
+	metricLeader.Set(0)
+	metricLeaderTransitions.WithLabelValues("lost").Inc()
+	log.Warn().
+		Str("func", "leadership").
+		Str("identity", leaderIdentity).
+		Msg("Lost leadership, stopping mikrotik updates")
+}
+
+// run campaigns for leadership with configured backend until ctx is done
+func (l *leadership) run(ctx context.Context) error {
+	defer l.set(false)
+	switch leaderElection {
+	case leaderElectionFile:
+		return l.runFile(ctx)
+	case leaderElectionKubernetes:
+		return l.runLease(ctx)
+	}
+	return fmt.Errorf("unknown leader_election '%s'", leaderElection)
+}
+
+// runFile holds exclusive lock on leader_lock_file while being the leader,
+// lock is released by the kernel when the process dies, so that other replica
+// sharing the same file takes over within leader_retry_interval
+func (l *leadership) runFile(ctx context.Context) error {
+	f, err := os.OpenFile(leaderLockFile, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open leader lock file: %w", err)
+	}
+	defer f.Close()
+
+	for {
+		if !l.leader.Load() {
+			err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			switch {
+			case err == nil:
+				_ = f.Truncate(0)
+				_, _ = f.WriteAt([]byte(leaderIdentity+"\n"), 0)
+				l.set(true)
+			case errors.Is(err, syscall.EWOULDBLOCK):
+				metricLeader.Set(0)
+			default:
+				log.Error().
+					Err(err).
+					Str("func", "leadership").
+					Str("leader_lock_file", leaderLockFile).
+					Msg("Failed to lock leader lock file")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if l.leader.Load() {
+				_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			}
+			return nil
+		case <-time.After(leaderRetryInterval):
+		}
+	}
+}
+
+// leaseSpec is a subset of coordination.k8s.io/v1 LeaseSpec
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+// lease is a subset of coordination.k8s.io/v1 Lease, used to create and read it,
+// existing lease is updated as map, so that its other fields are sent back unchanged
+type lease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       leaseSpec      `json:"spec"`
+}
+
+// leaseSpecOf returns spec of lease decoded as map, adding it if missing
+func leaseSpecOf(raw map[string]any) map[string]any {
+	spec, ok := raw["spec"].(map[string]any)
+	if !ok {
+		spec = map[string]any{}
+		raw["spec"] = spec
+	}
+	return spec
+}
+
+// leaseTimeFormat is MicroTime format used by kubernetes
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubeClient talks to kubernetes API with in-cluster service account
+type kubeClient struct {
+	baseURL   string
+	tokenFile string
+	http      *http.Client
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in kubernetes, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	pem, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		http: &http.Client{
+			Timeout: leaderRetryInterval,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}, nil
+}
+
+// do sends request to kubernetes API, returns response status and body
+func (k *kubeClient) do(ctx context.Context, method string, path string, body any) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	// token is re-read every time because kubelet rotates it
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// runLease holds kubernetes Lease leader_lease_name while being the leader
+//
+// leader renews the lease every leader_retry_interval, followers take it over
+// when it was not renewed for leader_lease_duration, measured with local clock
+// since the last observed change, so that clock skew between nodes does not matter
+//
+// lease is released on shutdown, so that other replica takes over immediately
+func (l *leadership) runLease(ctx context.Context) error {
+	k, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	namespace := leaderLeaseNamespace
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return fmt.Errorf("failed to read namespace, set leader_lease_namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", namespace, leaderLeaseName)
+
+	var observed string // last observed holder and renew time
+	var observedAt time.Time
+	var lastRenew time.Time
+
+	for {
+		held, err := l.tryLease(ctx, k, namespace, path, &observed, &observedAt)
+		switch {
+		case err != nil:
+			log.Warn().
+				Err(err).
+				Str("func", "leadership").
+				Str("lease", namespace+"/"+leaderLeaseName).
+				Msg("Failed to acquire or renew leader lease")
+		case held:
+			lastRenew = time.Now()
+		}
+		// leader steps down before the lease expires for others, if it cannot renew it
+		if held || (l.leader.Load() && time.Since(lastRenew) < leaderLeaseDuration*2/3) {
+			l.set(true)
+		} else {
+			l.set(false)
+		}
+
+		select {
+		case <-ctx.Done():
+			if l.leader.Load() {
+				l.releaseLease(k, path)
+			}
+			return nil
+		case <-time.After(leaderRetryInterval):
+		}
+	}
+}
+
+// tryLease creates, renews or takes over expired lease, returns true if this replica holds it
+func (l *leadership) tryLease(ctx context.Context, k *kubeClient, namespace string, path string, observed *string, observedAt *time.Time) (bool, error) {
+	now := time.Now()
+	nowStr := now.UTC().Format(leaseTimeFormat)
+	duration := int(math.Ceil(leaderLeaseDuration.Seconds()))
+	identity := leaderIdentity
+
+	status, data, err := k.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		transitions := 0
+		created := lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]any{"name": leaderLeaseName, "namespace": namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &nowStr,
+				RenewTime:            &nowStr,
+				LeaseTransitions:     &transitions,
+			},
+		}
+		status, data, err = k.do(ctx, http.MethodPost, path[:strings.LastIndex(path, "/")], created)
+		if err != nil {
+			return false, err
+		}
+		if status == http.StatusConflict {
+			return false, nil
+		}
+		if status != http.StatusCreated {
+			return false, fmt.Errorf("create lease: %d %s", status, data)
+		}
+		return true, nil
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("get lease: %d %s", status, data)
+	}
+
+	// lease is updated as received, so that fields unknown to the bouncer are kept
+	var raw map[string]any
+	var current lease
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return false, fmt.Errorf("invalid lease: %w", err)
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return false, fmt.Errorf("invalid lease: %w", err)
+	}
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	renew := ""
+	if current.Spec.RenewTime != nil {
+		renew = *current.Spec.RenewTime
+	}
+	if record := holder + "@" + renew; record != *observed {
+		*observed = record
+		*observedAt = now
+	}
+
+	leaseDuration := leaderLeaseDuration
+	if current.Spec.LeaseDurationSeconds != nil {
+		leaseDuration = time.Duration(*current.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if holder != "" && holder != identity && now.Before(observedAt.Add(leaseDuration)) {
+		return false, nil
+	}
+
+	spec := leaseSpecOf(raw)
+	if holder != identity {
+		transitions := 1
+		if current.Spec.LeaseTransitions != nil {
+			transitions = *current.Spec.LeaseTransitions + 1
+		}
+		spec["leaseTransitions"] = transitions
+		spec["acquireTime"] = nowStr
+		log.Info().
+			Str("func", "leadership").
+			Str("previous_holder", holder).
+			Msg("Taking over leader lease")
+	}
+	spec["holderIdentity"] = identity
+	spec["leaseDurationSeconds"] = duration
+	spec["renewTime"] = nowStr
+
+	// resourceVersion from metadata makes update fail with conflict if someone else changed the lease meanwhile
+	status, data, err = k.do(ctx, http.MethodPut, path, raw)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("update lease: %d %s", status, data)
+	}
+	return true, nil
+}
+
+// releaseLease clears holder of the lease, so that followers do not need to wait for it to expire
+func (l *leadership) releaseLease(k *kubeClient, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaderRetryInterval)
+	defer cancel()
+
+	status, data, err := k.do(ctx, http.MethodGet, path, nil)
+	if err != nil || status != http.StatusOK {
+		return
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return
+	}
+	spec := leaseSpecOf(raw)
+	if spec["holderIdentity"] != leaderIdentity {
+		return
+	}
+	spec["holderIdentity"] = ""
+	if _, _, err := k.do(ctx, http.MethodPut, path, raw); err != nil {
+		log.Warn().
+			Err(err).
+			Str("func", "leadership").
+			Msg("Failed to release leader lease")
+		return
+	}
+	log.Info().
+		Str("func", "leadership").
+		Msg("Leader lease released")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitLeader waits until l has expected leadership state
+func waitLeader(t *testing.T, l *leadership, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for l.leader.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader = %v, want %v", !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLeaderFile(t *testing.T) {
+	leaderElection = leaderElectionFile
+	leaderLockFile = filepath.Join(t.TempDir(), "leader.lock")
+	leaderRetryInterval = 10 * time.Millisecond
+	leaderIdentity = "replica-a"
+
+	elected := make(chan string, 4)
+	a := &leadership{onElected: func() { elected <- "a" }}
+	b := &leadership{onElected: func() { elected <- "b" }}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan struct{})
+	go func() {
+		defer close(doneA)
+		if err := a.run(ctxA); err != nil {
+			t.Errorf("run() error = %v", err)
+		}
+	}()
+	waitLeader(t, a, true)
+	if data, _ := os.ReadFile(leaderLockFile); strings.TrimSpace(string(data)) != "replica-a" {
+		t.Errorf("lock file contains %q, want leader identity", data)
+	}
+
+	// second replica sharing the file waits while the first one holds the lock
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneB := make(chan struct{})
+	defer func() {
+		cancelB()
+		<-doneB
+	}()
+	go func() {
+		defer close(doneB)
+		_ = b.run(ctxB)
+	}()
+	time.Sleep(10 * leaderRetryInterval)
+	if b.leader.Load() {
+		t.Fatal("both replicas are leaders")
+	}
+
+	// first replica stops and releases the lock, second one takes over
+	cancelA()
+	<-doneA
+	if a.leader.Load() {
+		t.Error("stopped replica is still the leader")
+	}
+	waitLeader(t, b, true)
+
+	if got := []string{<-elected, <-elected}; got[0] != "a" || got[1] != "b" {
+		t.Errorf("onElected called for %v, want [a b]", got)
+	}
+}
+
+func TestLeaderNotConfigured(t *testing.T) {
+	leader = nil
+	if !isLeader() {
+		t.Error("replica without leader_election is not the leader")
+	}
+}
+
+// fakeLeaseAPI is kubernetes API server storing single Lease object
+type fakeLeaseAPI struct {
+	lease    map[string]any
+	version  int
+	conflict bool // next update fails with conflict
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	write := func(status int, obj any) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(obj)
+	}
+	var body map[string]any
+	if r.Body != nil {
+		data, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &body)
+	}
+	switch {
+	case r.Method == http.MethodGet && f.lease == nil:
+		write(http.StatusNotFound, map[string]any{"kind": "Status"})
+	case r.Method == http.MethodGet:
+		write(http.StatusOK, f.lease)
+	case r.Method == http.MethodPost && f.lease != nil:
+		write(http.StatusConflict, map[string]any{"kind": "Status"})
+	case r.Method == http.MethodPost:
+		f.store(body)
+		write(http.StatusCreated, f.lease)
+	case r.Method == http.MethodPut:
+		metadata, _ := body["metadata"].(map[string]any)
+		if f.conflict || metadata["resourceVersion"] != f.lease["metadata"].(map[string]any)["resourceVersion"] {
+			f.conflict = false
+			write(http.StatusConflict, map[string]any{"kind": "Status"})
+			return
+		}
+		f.store(body)
+		write(http.StatusOK, f.lease)
+	default:
+		write(http.StatusMethodNotAllowed, nil)
+	}
+}
+
+func (f *fakeLeaseAPI) store(obj map[string]any) {
+	f.version++
+	obj["metadata"].(map[string]any)["resourceVersion"] = fmt.Sprint(f.version)
+	f.lease = obj
+}
+
+func (f *fakeLeaseAPI) spec() map[string]any {
+	return f.lease["spec"].(map[string]any)
+}
+
+func TestLeaderLease(t *testing.T) {
+	leaderLeaseName = "bouncer"
+	leaderLeaseDuration = 15 * time.Second
+	leaderRetryInterval = time.Second
+	api := &fakeLeaseAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k := &kubeClient{baseURL: srv.URL, tokenFile: tokenFile, http: srv.Client()}
+	path := "/apis/coordination.k8s.io/v1/namespaces/default/leases/bouncer"
+	ctx := context.Background()
+	a, b := &leadership{}, &leadership{}
+	var observedA, observedB string
+	var observedAtA, observedAtB time.Time
+
+	// acquire: lease does not exist yet and is created
+	leaderIdentity = "replica-a"
+	if held, err := a.tryLease(ctx, k, "default", path, &observedA, &observedAtA); err != nil || !held {
+		t.Fatalf("acquire: tryLease() = %v, %v, want true", held, err)
+	}
+	if got := api.spec()["holderIdentity"]; got != "replica-a" {
+		t.Fatalf("holder after acquire = %v, want replica-a", got)
+	}
+
+	// renew: fields unknown to the bouncer are sent back unchanged
+	api.spec()["strategy"] = "OldestEmulationVersion"
+	api.lease["metadata"].(map[string]any)["labels"] = map[string]any{"app": "bouncer"}
+	acquired := api.spec()["acquireTime"]
+	if held, err := a.tryLease(ctx, k, "default", path, &observedA, &observedAtA); err != nil || !held {
+		t.Fatalf("renew: tryLease() = %v, %v, want true", held, err)
+	}
+	if api.spec()["strategy"] != "OldestEmulationVersion" || api.lease["metadata"].(map[string]any)["labels"] == nil {
+		t.Errorf("unknown fields lost on renew: %v", api.lease)
+	}
+	if api.spec()["acquireTime"] != acquired || api.spec()["leaseTransitions"] != float64(0) {
+		t.Errorf("renew changed acquireTime or leaseTransitions: %v", api.spec())
+	}
+
+	// conflict: lease changed between read and update
+	api.conflict = true
+	if held, err := a.tryLease(ctx, k, "default", path, &observedA, &observedAtA); err != nil || held {
+		t.Fatalf("conflict: tryLease() = %v, %v, want false", held, err)
+	}
+
+	// follower does not take over lease which is renewed
+	leaderIdentity = "replica-b"
+	if held, err := b.tryLease(ctx, k, "default", path, &observedB, &observedAtB); err != nil || held {
+		t.Fatalf("follower: tryLease() = %v, %v, want false", held, err)
+	}
+
+	// takeover: lease was not renewed for lease duration
+	observedAtB = observedAtB.Add(-leaderLeaseDuration)
+	if held, err := b.tryLease(ctx, k, "default", path, &observedB, &observedAtB); err != nil || !held {
+		t.Fatalf("takeover: tryLease() = %v, %v, want true", held, err)
+	}
+	if api.spec()["holderIdentity"] != "replica-b" || api.spec()["leaseTransitions"] != float64(1) {
+		t.Errorf("lease after takeover = %v, want holder replica-b with 1 transition", api.spec())
+	}
+
+	// release clears holder only
+	b.releaseLease(k, path)
+	if api.spec()["holderIdentity"] != "" || api.spec()["strategy"] != "OldestEmulationVersion" {
+		t.Errorf("lease after release = %v, want empty holder", api.spec())
+	}
+	if held, err := a.tryLease(ctx, k, "default", path, &observedA, &observedAtA); err != nil || !held {
+		t.Fatalf("after release: tryLease() = %v, %v, want true", held, err)
+	}
+}
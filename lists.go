@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// decisionTypeBan is the only decision type blocked via mikrotik_address_list
+const decisionTypeBan = "ban"
+
+// firewallRule describes firewall rules which should point to the address-list
+type firewallRule struct {
+	proto string // 'ip' or 'ipv6'
+	mode  string // firewall table, such as 'filter', 'raw', 'nat' or 'mangle'
+	where string // 'src' or 'dst'
+	ids   string // comma separated rule ids
+}
+
+// typedList is a separate address-list for decisions of type other than ban,
+// for example captcha decisions used by dst-nat redirect rule,
+// or throttle decisions used by mangle rule marking packets for a queue
+type typedList struct {
+	decisionType string
+	prefix       string // address-list name prefix, same as mikrotik_address_list but per type
+	cache        *ttlcache.Cache[string, cacheEntry]
+}
+
+// decisionTypeOf returns lower case decision type, decisions without type are treated as bans
+func decisionTypeOf(decision *models.Decision) string {
+	if decision.Type == nil {
+		return decisionTypeBan
+	}
+	return strings.ToLower(*decision.Type)
+}
+
+// cacheFor returns cache for given decision type, or nil if that type is not handled
+func (mal *mikrotikAddrList) cacheFor(decisionType string) *ttlcache.Cache[string, cacheEntry] {
+	if decisionType == decisionTypeBan {
+		return mal.cache
+	}
+	if list, ok := mal.typed[decisionType]; ok {
+		return list.cache
+	}
+	return nil
+}
+
+// prefixFor returns address-list prefix for given decision type
+func (mal *mikrotikAddrList) prefixFor(decisionType string) string {
+	if list, ok := mal.typed[decisionType]; ok {
+		return list.prefix
+	}
+	return addressList
+}
+
+// parseTypeLists parses space separated list of type=list_prefix entries
+func parseTypeLists(entries []string) (map[string]*typedList, error) {
+	lists := map[string]*typedList{}
+	for _, entry := range entries {
+		decisionType, prefix, ok := strings.Cut(entry, "=")
+		decisionType = strings.ToLower(decisionType)
+		if !ok || decisionType == "" || prefix == "" {
+			return nil, fmt.Errorf("invalid entry '%s', expected type=list_prefix", entry)
+		}
+		if decisionType == decisionTypeBan {
+			return nil, fmt.Errorf("type '%s' always uses mikrotik_address_list", decisionTypeBan)
+		}
+		if _, exists := lists[decisionType]; exists {
+			return nil, fmt.Errorf("duplicate entry for type '%s'", decisionType)
+		}
+		lists[decisionType] = &typedList{
+			decisionType: decisionType,
+			prefix:       prefix,
+		}
+	}
+	return lists, nil
+}
+
+var ruleIdsRe = regexp.MustCompile("^([0-9]+,?)+$")
+
+// parseTypeRules parses space separated list of type=proto:table:where:ids entries
+// and returns rules of each list returned by parseTypeLists
+func parseTypeRules(entries []string, lists map[string]*typedList) (map[string][]firewallRule, error) {
+	rules := map[string][]firewallRule{}
+	for _, entry := range entries {
+		decisionType, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry '%s', expected type=proto:table:where:ids", entry)
+		}
+		list, exists := lists[strings.ToLower(decisionType)]
+		if !exists {
+			return nil, fmt.Errorf("no address-list defined for type '%s'", decisionType)
+		}
+
+		rule, err := parseRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry '%s': %w", entry, err)
+		}
+		rules[list.decisionType] = append(rules[list.decisionType], rule)
+	}
+	return rules, nil
+}
+
+// parseRules parses space separated list of proto:table:where:ids entries
+func parseRules(entries []string) ([]firewallRule, error) {
+	var rules []firewallRule
+	for _, entry := range entries {
+		rule, err := parseRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry '%s': %w", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseRule parses single proto:table:where:ids firewall rule specification
+func parseRule(spec string) (firewallRule, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 4 {
+		return firewallRule{}, fmt.Errorf("expected proto:table:where:ids")
+	}
+	rule := firewallRule{proto: parts[0], mode: parts[1], where: parts[2], ids: parts[3]}
+	if rule.proto != "ip" && rule.proto != "ipv6" {
+		return firewallRule{}, fmt.Errorf("invalid proto '%s', valid values are 'ip' or 'ipv6'", rule.proto)
+	}
+	switch rule.mode {
+	case "filter", "raw", "nat", "mangle":
+	default:
+		return firewallRule{}, fmt.Errorf("invalid table '%s', valid values are 'filter', 'raw', 'nat' or 'mangle'", rule.mode)
+	}
+	if rule.where != "src" && rule.where != "dst" {
+		return firewallRule{}, fmt.Errorf("invalid where '%s', valid values are 'src' or 'dst'", rule.where)
+	}
+	if !ruleIdsRe.MatchString(rule.ids) {
+		return firewallRule{}, fmt.Errorf("rule ids '%s' can contain only numbers and commas", rule.ids)
+	}
+	return rule, nil
+}
+
+// banRules returns firewall rules configured for ban address-list, for enabled protocols and tables
+func banRules() []firewallRule {
+	return live.Load().banRules
+}
+
+// rules returns firewall rules configured for the list
+func (list *typedList) rules() []firewallRule {
+	return live.Load().typeRules[list.decisionType]
+}
@@ -3,28 +3,52 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
-	"github.com/go-routeros/routeros/v3"
 	"github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
+	"github.com/sirupsen/logrus"
 
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 
 	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
-
-	"net/http"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type mikrotikAddrList struct {
-	c *routeros.Client
+	c        mikrotikClient
+	conn     *mikrotikConnection
+	progress prometheus.Gauge // counts added addresses, set only for shard sessions
+	summary  *syncSummary     // counts added addresses, set only while address-list is filled
 	// cache map[string]string
-	cache *ttlcache.Cache[string, string]
-	mutex sync.Mutex
+	cache     *ttlcache.Cache[string, cacheEntry]
+	permanent *ttlcache.Cache[string, cacheEntry] // bans without TTL kept in permanent_list, nil if it is disabled
+	typed     map[string]*typedList               // address-lists for decision types other than ban
+
+	currentLists sync.Map           // list prefix -> name of the last address-list filled by the bouncer
+	ruleIds      map[string]string  // firewall table and rule number -> item id of the rule, see checkDrift
+	streamReady  atomic.Bool        // set once the first batch of decisions from LAPI was processed
+	trigger      *syncTrigger       // coalesces requests to run mikrotik update
+	sched        *adaptiveScheduler // tunes pull interval and update spacing, nil if adaptive_schedule is disabled
+	mutex        sync.Mutex
+
+	// prefixes added for AS and country decisions, used only by decisionProcess
+	geoAdded map[geoDecision][]netip.Prefix
+
+	// counters of ban firewall rules per ip_type, read by the last mikrotik update for usage metrics
+	dropped atomic.Pointer[map[string]ruleCounter]
+
+	// spans of stream batches which changed the cache since the last mikrotik update
+	syncLinks  []trace.Link
+	linksMutex sync.Mutex
 }
 
 // inspired by https://www.piotrbelina.com/blog/go-build-info-debug-readbuildinfo-ldflags/
@@ -69,26 +93,42 @@ func main() {
 
 	initConfig()
 
-	// prometheus metrics
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		if err := http.ListenAndServe(":2112", nil); err != nil && err != http.ErrServerClosed {
+	if otelTracesEnable || otelMetricsEnable {
+		shutdownTelemetry, err := initTelemetry(context.Background())
+		if err != nil {
 			log.Fatal().
 				Err(err).
-				Str("metrics_address", metricsAddr).
-				Msg("Failed to start metrics server on desired address")
+				Str("func", "main").
+				Msg("OpenTelemetry init failed")
 		}
-	}()
-	log.Info().
-		Str("func", "main").
-		Msgf("Metrics server started")
+		defer func() {
+			if err := shutdownTelemetry(context.Background()); err != nil {
+				log.Error().
+					Err(err).
+					Str("func", "main").
+					Msg("OpenTelemetry shutdown failed")
+			}
+		}()
+	}
+
+	// prometheus metrics, health and debug endpoints
+	server := newHTTPServer()
+	server.start()
 	intitMetrics()
 
 	bouncer := &csbouncer.StreamBouncer{
-		APIKey:         crowdsecBouncerAPIKey,
-		APIUrl:         crowdsecBouncerURL,
-		TickerInterval: tickerInterval.String(),
-		Origins:        crowdsecOrigins,
+		APIKey:                 crowdsecBouncerAPIKey,
+		APIUrl:                 crowdsecBouncerURL,
+		CertPath:               crowdsecCertPath,
+		KeyPath:                crowdsecKeyPath,
+		CAPath:                 crowdsecCAPath,
+		InsecureSkipVerify:     crowdsecInsecureSkipVerify,
+		RetryInitialConnect:    crowdsecRetryInitConnect,
+		TickerInterval:         tickerInterval.String(),
+		Origins:                crowdsecOrigins,
+		Scopes:                 crowdsecScopes,
+		ScenariosContaining:    crowdsecScenariosContain,
+		ScenariosNotContaining: crowdsecScenariosNotContain,
 	}
 	if err := bouncer.Init(); err != nil {
 		log.Fatal().
@@ -99,17 +139,121 @@ func main() {
 
 	var mal mikrotikAddrList
 
-	mal.cache = ttlcache.New[string, string](
-		ttlcache.WithDisableTouchOnHit[string, string](), // do not update TTL when reading items
+	if auditLogPath != "" {
+		audit = newAuditLog()
+	}
+	if len(geoCountryDB) > 0 || len(geoASNDB) > 0 {
+		var err error
+		if geo, err = newGeoDB(); err != nil {
+			log.Fatal().
+				Err(err).
+				Str("func", "main").
+				Msg("Geo database init failed")
+		}
+	}
+	if hookWebhookURL != "" || hookExec != "" {
+		var err error
+		if hooks, err = newNotifier(); err != nil {
+			log.Fatal().
+				Err(err).
+				Str("func", "main").
+				Msg("Hooks init failed")
+		}
+	}
+	mal.cache = ttlcache.New[string, cacheEntry](
+		ttlcache.WithDisableTouchOnHit[string, cacheEntry](), // do not update TTL when reading items
 	)
+	mal.conn = newMikrotikConnection()
+	if adaptiveSchedule {
+		mal.sched = newAdaptiveScheduler()
+	}
+	mal.trigger = newSyncTrigger(func() { runMikrotikCommands(&mal) }, mal.sched)
+	if leaderElection != leaderElectionNone {
+		// only the leader updates mikrotik, followers just keep the cache
+		leader = &leadership{onElected: func() { mal.trigger.request("leader") }}
+	}
+
+	mal.typed = typedLists
+	for _, list := range mal.typed {
+		list.cache = ttlcache.New[string, cacheEntry](
+			ttlcache.WithDisableTouchOnHit[string, cacheEntry](),
+		)
+		audit.watchExpired(list.prefix, list.cache)
+		go list.cache.Start()
+	}
+	audit.watchExpired(addressList, mal.cache)
+	if permanentList != "" {
+		mal.permanent = ttlcache.New[string, cacheEntry]()
+	}
+	mal.geoAdded = map[geoDecision][]netip.Prefix{}
+
 	go mal.cache.Start()             // starts automatic expired item deletion
 	go recordMetrics(&mal)           // record metrics
+	go mal.trigger.loop()            // run requested updates of MikroTik, one at a time
 	go runMikrotikCommandsLoop(&mal) // process cached addresses and insert them to MikroTik
 
-	g, ctx := errgroup.WithContext(context.Background())
+	if routerStatsInterval > 0 {
+		go mal.routerStatsLoop() // collect address-list sizes and firewall rule counters from MikroTik
+	}
+
+	if preflightEnable {
+		go mal.preflight() // report configuration errors before the first update
+	}
+
+	if driftInterval > 0 {
+		go mal.driftLoop() // check that firewall rules still use address-lists set by the bouncer
+	}
+
+	// keep connection to MikroTik alive and rerun updates which failed while it was unreachable
+	go mal.conn.keepaliveLoop(func() { mal.trigger.request("reconnect") })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return server.shutdown()
+	})
+
+	if leader != nil {
+		g.Go(func() error {
+			return leader.run(ctx)
+		})
+	}
+
+	if geo != nil {
+		g.Go(func() error {
+			return geo.watch(ctx)
+		})
+	}
 
 	g.Go(func() error {
-		err := bouncer.Run(ctx)
+		return runReloader(ctx, func() { mal.trigger.request("reload") })
+	})
+
+	if usageMetricsInterval > 0 {
+		um := &usageMetrics{mal: &mal}
+		metricsProvider, err := csbouncer.NewMetricsProvider(bouncer.APIClient, bouncerType, um.update, logrus.StandardLogger())
+		if err != nil {
+			log.Fatal().
+				Err(err).
+				Str("func", "main").
+				Msg("Failed to create usage metrics provider")
+		}
+		metricsProvider.Interval = usageMetricsInterval
+		g.Go(func() error {
+			return metricsProvider.Run(ctx)
+		})
+	}
+
+	g.Go(func() error {
+		var err error
+		if mal.sched != nil {
+			err = runAdaptiveStream(ctx, bouncer, mal.sched)
+		} else {
+			err = bouncer.Run(ctx)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to run bouncer stream")
 		}
@@ -128,7 +272,11 @@ func main() {
 					Str("func", "main").
 					Msg("Terminating bouncer process")
 				return ctx.Err()
-			case decisions := <-bouncer.Stream:
+			case decisions, ok := <-bouncer.Stream:
+				if !ok {
+					// stream is closed when the first pull from LAPI failed
+					return fmt.Errorf("bouncer stream closed")
+				}
 				mal.decisionProcess(decisions)
 			}
 		}
@@ -7,62 +7,418 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// metricsNamespace is used as a prefix for metrics following prometheus naming conventions
+const metricsNamespace = "cs_mikrotik_bouncer"
+
+// syncBuckets cover address-list updates from a few entries to tens of thousands on slow devices
+var syncBuckets = []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600}
+
 var (
 	metricTTLCacheStats = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "ttlcache_stats",
-			Help: "generic ttlcache stats by operation, notice that by implementation those are counters and not gauge",
+			Namespace: metricsNamespace,
+			Name:      "ttlcache_stats",
+			Help:      "generic ttlcache stats by operation, notice that by implementation those are counters and not gauge",
 		},
 		[]string{"operation"},
 	)
 
+	metricCacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_entries",
+		Help:      "Current number of addresses in the cache, by address-list prefix",
+	},
+		[]string{"proto", "list"},
+	)
+
 	metricCache = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "cache_count",
-		Help: "Cache hit/miss, func is add/remove address from address-list, operation is insert/hit/miss etc",
+		Namespace: metricsNamespace,
+		Name:      "cache_count",
+		Help:      "Cache hit/miss, func is add/remove address from address-list, operation is insert/hit/miss etc",
 	},
 		[]string{"func", "operation"},
 	)
 
 	metricDecision = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "decisions_total",
-		Help: "Total number of decisions processed",
+		Namespace: metricsNamespace,
+		Name:      "decisions_total",
+		Help:      "Total number of decisions processed, by decision type such as ban or captcha",
 	},
-		[]string{"proto", "func", "operation"},
+		[]string{"proto", "func", "operation", "type"},
 	)
 
 	metricTTLTruncated = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "truncated_ttl_total",
-		Help: "Total number of decisions processed which had effective ttl set to default_ttl_max",
+		Namespace: metricsNamespace,
+		Name:      "truncated_ttl_total",
+		Help:      "Total number of decisions processed which had effective ttl set to default_ttl_max",
 	},
 		[]string{"proto", "truncated"},
 	)
 	metricPermBans = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "permban_total",
-		Help: "Total number of decisions without ttl",
+		Namespace: metricsNamespace,
+		Name:      "permban_total",
+		Help:      "Total number of decisions without ttl",
 	},
 		[]string{"proto"},
 	)
 	metricMikrotikClient = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "mikrotik_client_total",
-		Help: "Total number of connection actions executed to mikrotik, such as connect/disconnect",
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_client_total",
+		Help:      "Total number of connection actions executed to mikrotik, such as connect/disconnect",
 	},
 		[]string{"func", "result"},
 	)
 
+	metricMikrotikConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_connected",
+		Help:      "State of the connection to mikrotik, 1 if connected, 0 if disconnected",
+	},
+	)
+	metricMikrotikReconnect = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_reconnect_total",
+		Help:      "Total number of reconnect attempts to mikrotik executed by keepalive loop",
+	},
+		[]string{"result"},
+	)
+	metricMikrotikKeepalive = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_keepalive_total",
+		Help:      "Total number of health checks executed on the connection to mikrotik",
+	},
+		[]string{"result"},
+	)
+
+	metricMikrotikTLSHandshake = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_tls_handshake_total",
+		Help:      "Total number of TLS handshakes with mikrotik",
+	},
+		[]string{"result"},
+	)
+	metricMikrotikTLSInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_tls_info",
+		Help:      "TLS version and cipher suite negotiated in the last handshake with mikrotik",
+	},
+		[]string{"version", "cipher"},
+	)
+	metricMikrotikTLSCertExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_tls_cert_expiry_timestamp_seconds",
+		Help:      "Expiry time of the certificate presented by mikrotik, as unix timestamp",
+	},
+	)
+
+	metricRouterStats = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_stats_total",
+		Help:      "Total number of address-list and firewall rule counters collections from mikrotik",
+	},
+		[]string{"result"},
+	)
+	metricRouterListEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_address_list_entries",
+		Help:      "Number of entries in the last address-list created by the bouncer, as reported by mikrotik, by address-list prefix",
+	},
+		[]string{"proto", "list"},
+	)
+	metricRouterRulePackets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_firewall_rule_packets",
+		Help:      "Packets matched by configured firewall rule, as reported by mikrotik",
+	},
+		[]string{"proto", "table", "direction", "rule", "list"},
+	)
+	metricRouterRuleBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_firewall_rule_bytes",
+		Help:      "Bytes matched by configured firewall rule, as reported by mikrotik",
+	},
+		[]string{"proto", "table", "direction", "rule", "list"},
+	)
+
 	metricMikrotikCmd = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "mikrotik_cmd_total",
-		Help: "Total number of commands executed in mikrotik",
+		Namespace: metricsNamespace,
+		Name:      "mikrotik_cmd_total",
+		Help:      "Total number of commands executed in mikrotik, error_class tells why command failed",
+	},
+		[]string{"proto", "func", "operation", "result", "error_class"},
+	)
+	metricSyncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of the whole mikrotik update, from acquiring connection to the last firewall rule update",
+		Buckets:   syncBuckets,
 	},
-		[]string{"proto", "func", "operation", "result"},
+		[]string{"result"},
 	)
-	metricMikrotikCmdDur = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mikrotik_cmd_duration_total",
-		Help: "Total time spend executing commands in mikrotik, in microseconds",
+	metricConnectDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "connect_duration_seconds",
+		Help:      "Duration of connecting and logging in to mikrotik",
+		Buckets:   prometheus.DefBuckets,
 	},
 	)
-	metricLockWait = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lock_wait_duration_total",
-		Help: "Total time spend waiting to get lock to execute commands in mikrotik, in microseconds",
+	metricInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "address_list_insert_duration_seconds",
+		Help:      "Duration of adding all cached addresses to the new address-list, by address-list prefix",
+		Buckets:   syncBuckets,
+	},
+		[]string{"list"},
+	)
+	metricFirewallUpdateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "firewall_update_duration_seconds",
+		Help:      "Duration of setting new address-list in firewall rules",
+		Buckets:   prometheus.DefBuckets,
+	},
+		[]string{"proto", "table", "direction"},
+	)
+	metricLockWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lock_wait_duration_seconds",
+		Help:      "Time spent waiting to get lock to execute commands in mikrotik",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	},
+	)
+	metricSyncRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_requests_total",
+		Help:      "Total number of requested mikrotik updates, by source, requests received before update starts are merged into it",
+	},
+		[]string{"source"},
+	)
+	metricSyncDelay = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_delay_seconds",
+		Help:      "Time between the first request for mikrotik update and start of the update",
+		Buckets:   syncBuckets,
+	},
+	)
+	metricAdaptiveTicker = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "adaptive_ticker_interval_seconds",
+		Help:      "Interval between LAPI pulls chosen by adaptive scheduler",
+	},
+	)
+	metricAdaptiveSpacing = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "adaptive_sync_min_spacing_seconds",
+		Help:      "Minimum time between mikrotik updates chosen by adaptive scheduler",
+	},
+	)
+	metricAdaptiveSyncCost = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "adaptive_sync_cost_seconds",
+		Help:      "Moving average of mikrotik update duration used by adaptive scheduler",
+	},
+	)
+	metricAdaptiveBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "adaptive_busy_ratio",
+		Help:      "Moving average of LAPI pulls which brought decision changes, from 0 to 1, used by adaptive scheduler",
+	},
+	)
+	metricScriptRunDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "script_run_duration_seconds",
+		Help:      "Duration of running single generated script adding addresses on mikrotik, with script sync strategy",
+		Buckets:   syncBuckets,
+	},
+		[]string{"proto"},
+	)
+	metricScriptVerify = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "script_verify_total",
+		Help:      "Total number of address-list verifications after running generated scripts, by result",
+	},
+		[]string{"proto", "result"},
+	)
+	metricShardEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shard_entries",
+		Help:      "Number of addresses assigned to address-list shard in the current or last mikrotik update",
+	},
+		[]string{"list", "shard"},
+	)
+	metricShardProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shard_progress_entries",
+		Help:      "Number of addresses already added to address-list shard in the current or last mikrotik update",
+	},
+		[]string{"list", "shard"},
+	)
+	metricShardInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "shard_insert_duration_seconds",
+		Help:      "Duration of filling single address-list shard",
+		Buckets:   syncBuckets,
+	},
+		[]string{"list", "shard"},
+	)
+	metricLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "1 if this replica is the leader which updates mikrotik, 0 if it is a follower",
+	},
+	)
+	metricLeaderTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader_transitions_total",
+		Help:      "Total number of leadership changes of this replica, event is elected or lost",
+	},
+		[]string{"event"},
+	)
+	metricLastSyncTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Time when the last mikrotik update finished, as unix timestamp",
+	},
+	)
+	metricLastSyncSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_sync_success",
+		Help:      "1 if the last mikrotik update succeeded, 0 otherwise",
+	},
+	)
+	metricLastSyncEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_sync_entries",
+		Help:      "Number of addresses pushed to the new address-list in the last mikrotik update, by address-list prefix",
+	},
+		[]string{"list"},
+	)
+	metricHookNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hook_notifications_total",
+		Help:      "Total number of hook events sent, by hook (webhook, exec, or queue for events dropped when queue is full), event and result",
+	},
+		[]string{"hook", "event", "result"},
+	)
+	metricHookSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hook_suppressed_total",
+		Help:      "Total number of hook events dropped by hook_rate_limit, by event",
+	},
+		[]string{"event"},
+	)
+	metricGeoEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "geo_entries",
+		Help:      "Number of countries or autonomous systems in loaded geo database, by scope",
+	},
+		[]string{"scope"},
+	)
+	metricGeoLoadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "geo_load_timestamp_seconds",
+		Help:      "Time when geo database was loaded, as unix timestamp",
+	},
+	)
+	metricGeoReload = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "geo_reload_total",
+		Help:      "Total number of geo database reloads after files changed, by result",
+	},
+		[]string{"result"},
+	)
+	metricGeoDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "geo_decisions_total",
+		Help:      "Total number of AS and Country decisions, by scope, action and result of resolving them to prefixes",
+	},
+		[]string{"scope", "action", "result"},
+	)
+	metricGeoPrefixes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "geo_decision_prefixes",
+		Help:      "Number of prefixes AS and Country decisions were resolved to, by scope",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	},
+		[]string{"scope"},
+	)
+	metricDriftChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "firewall_drift_checks_total",
+		Help:      "Total number of firewall rule drift checks, by result",
+	},
+		[]string{"result"},
+	)
+	metricDrift = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "firewall_drift_total",
+		Help:      "Total number of firewall rules found different than set by bouncer, by proto, table and kind: list_changed, disabled or missing",
+	},
+		[]string{"proto", "mode", "kind"},
+	)
+	metricDriftHeal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "firewall_drift_heal_total",
+		Help:      "Total number of attempts to set drifted firewall rules back, by proto, table, kind and result",
+	},
+		[]string{"proto", "mode", "kind", "result"},
+	)
+	metricDriftActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "firewall_drift_rules",
+		Help:      "Number of firewall rules which differed from expected and were not healed in the last drift check",
+	},
+	)
+	metricPreflightChecks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "preflight_checks",
+		Help:      "Number of checks in the last preflight, by status: ok, warn or fail",
+	},
+		[]string{"status"},
+	)
+	metricPreflightReady = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "preflight_ready",
+		Help:      "1 if no check failed in the last preflight, 0 otherwise",
+	},
+	)
+	metricConfigReload = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reload_total",
+		Help:      "Total number of config reloads, by source: signal or file, and result",
+	},
+		[]string{"source", "result"},
+	)
+	metricConfigReloadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reload_timestamp_seconds",
+		Help:      "Unix time of the last successful config reload",
+	},
+	)
+	metricCacheOrigins = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_origin_entries",
+		Help:      "Current number of addresses in the cache, by address-list prefix, proto and decision origin",
+	},
+		[]string{"list", "proto", "origin"},
+	)
+	metricCacheScenarios = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_scenario_entries",
+		Help:      "Current number of addresses in the cache, by address-list prefix and scenario, only for top scenarios, the rest is counted as 'other'",
+	},
+		[]string{"list", "scenario"},
+	)
+	metricPermanentChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "permanent_list_changes_total",
+		Help:      "Total number of entries added to or removed from permanent_list, by proto, action and result",
+	},
+		[]string{"proto", "action", "result"},
+	)
+	metricHTTPUnauthorized = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_unauthorized_total",
+		Help:      "Total number of requests to metrics server rejected because of missing or invalid credentials",
 	},
 	)
 )
@@ -71,6 +427,8 @@ var (
 // thus grafana dashboard is not empty
 func intitMetrics() {
 
+	prometheus.MustRegister(cacheTTL)
+
 	if useIPV4 {
 		intitMetricsProto("ip")
 	}
@@ -83,31 +441,64 @@ func intitMetrics() {
 		metricMikrotikClient.WithLabelValues(m, "error").Add(0)
 		metricMikrotikClient.WithLabelValues(m, "success").Add(0)
 	}
+	metricLeader.Set(1)
+	if leaderElection != leaderElectionNone {
+		metricLeader.Set(0)
+	}
+	for _, event := range []string{"elected", "lost"} {
+		metricLeaderTransitions.WithLabelValues(event).Add(0)
+	}
+	for _, event := range hookEvents {
+		metricHookSuppressed.WithLabelValues(event).Add(0)
+	}
+	for _, source := range []string{"decisions", "periodic", "reconnect", "leader", "reload"} {
+		metricSyncRequests.WithLabelValues(source).Add(0)
+	}
+	for _, source := range []string{"signal", "file"} {
+		metricConfigReload.WithLabelValues(source, "error").Add(0)
+		metricConfigReload.WithLabelValues(source, "success").Add(0)
+	}
+	for _, r := range []string{"error", "success"} {
+		if useTLS {
+			metricMikrotikTLSHandshake.WithLabelValues(r).Add(0)
+		}
+		metricMikrotikReconnect.WithLabelValues(r).Add(0)
+		metricMikrotikKeepalive.WithLabelValues(r).Add(0)
+	}
 }
 
 // intitMetricsProto for given protocol such as ip or ipv6
 func intitMetricsProto(proto string) {
-	add := []string{"insert", "skip", "update_equal", "update_shorten"}
-	for _, v := range add {
-		metricDecision.WithLabelValues(proto, "add", v).Add(0)
+	types := []string{decisionTypeBan}
+	for decisionType := range typedLists {
+		types = append(types, decisionType)
 	}
+	for _, decisionType := range types {
+		add := []string{"insert", "skip", "simulated", "update_equal", "update_shorten"}
+		for _, v := range add {
+			metricDecision.WithLabelValues(proto, "add", v, decisionType).Add(0)
+		}
 
-	remove := []string{"no_op", "remove", "skip"}
-	for _, v := range remove {
-		metricDecision.WithLabelValues(proto, "remove", v).Add(0)
+		remove := []string{"no_op", "remove", "simulated", "skip"}
+		for _, v := range remove {
+			metricDecision.WithLabelValues(proto, "remove", v, decisionType).Add(0)
+		}
 	}
 
 	metricTTLTruncated.WithLabelValues(proto, "false").Add(0)
 	metricTTLTruncated.WithLabelValues(proto, "true").Add(0)
 	metricPermBans.WithLabelValues(proto).Add(0)
 
-	metricMikrotikCmd.WithLabelValues(proto, "address_list", "add", "error").Add(0)
-	metricMikrotikCmd.WithLabelValues(proto, "address_list", "add", "success").Add(0)
-
-	modes := []string{"filter", "raw"}
-	for _, mode := range modes {
-		metricMikrotikCmd.WithLabelValues(proto, mode, "set", "error").Add(0)
-		metricMikrotikCmd.WithLabelValues(proto, mode, "set", "success").Add(0)
+	cmds := [][]string{
+		{"address_list", "add"},
+		{"filter", "set"},
+		{"raw", "set"},
+	}
+	for _, cmd := range cmds {
+		metricMikrotikCmd.WithLabelValues(proto, cmd[0], cmd[1], "success", errClassNone).Add(0)
+		for _, class := range errClasses {
+			metricMikrotikCmd.WithLabelValues(proto, cmd[0], cmd[1], "error", class).Add(0)
+		}
 	}
 }
 
@@ -120,6 +511,14 @@ func recordMetrics(mal *mikrotikAddrList) {
 			metricTTLCacheStats.WithLabelValues("hits").Set(float64(mal.cache.Metrics().Hits))
 			metricTTLCacheStats.WithLabelValues("misses").Set(float64(mal.cache.Metrics().Misses))
 			metricTTLCacheStats.WithLabelValues("evictions").Set(float64(mal.cache.Metrics().Evictions))
+
+			recordCacheComposition(addressList, mal.cache.Items())
+			for _, list := range mal.typed {
+				recordCacheComposition(list.prefix, list.cache.Items())
+			}
+			if mal.permanent != nil {
+				recordCacheComposition(permanentList, mal.permanent.Items())
+			}
 		}
 	}()
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -9,16 +11,25 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/go-routeros/routeros/v3"
+	"github.com/jellydator/ttlcache/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func dial() (*routeros.Client, error) {
+var errFirewallUpdate = errors.New("failed to update some firewall rules")
+
+func dial() (mikrotikClient, error) {
+	if mikrotikTransport == transportREST {
+		return dialREST()
+	}
 	if useTLS {
-		return routeros.DialTLSTimeout(mikrotikHost, username, password, nil, timeout)
+		return dialTLS()
 	}
 	return routeros.DialTimeout(mikrotikHost, username, password, timeout)
 }
 
-// runMikrotikCommandsLoop does just basic loop with sleep + run commands to update MikroTik
+// runMikrotikCommandsLoop does just basic loop with sleep + request to update MikroTik
 func runMikrotikCommandsLoop(mal *mikrotikAddrList) {
 	go func() {
 		for {
@@ -27,16 +38,12 @@ func runMikrotikCommandsLoop(mal *mikrotikAddrList) {
 			// and in that case it will trigger runMikrotikCommands() anyway
 
 			time.Sleep(updateFreq)
-			runMikrotikCommands(mal)
+			mal.trigger.request("periodic")
 
 		}
 	}()
 }
 
-func runMikrotikCommandsMetric(startTime int64) {
-	metricMikrotikCmdDur.Add(float64(time.Now().UnixMicro() - startTime))
-}
-
 // runMikrotikCommands walks over the cached address list
 // and adds addresses to new address-list in MikroTik
 // and updates firewall rules to use that new address list
@@ -44,89 +51,229 @@ func runMikrotikCommandsMetric(startTime int64) {
 // we need it to be executed periodically to ensure that if we use default_ttl_max
 // then we readd address prior expiry
 func runMikrotikCommands(mal *mikrotikAddrList) {
-	lockWaitStart := time.Now().UnixMicro()
+	lockWaitStart := time.Now()
 	mal.mutex.Lock()
-	lockWaitEnd := time.Now().UnixMicro()
-	metricLockWait.Add(float64(lockWaitEnd - lockWaitStart))
-
+	metricLockWait.Observe(time.Since(lockWaitStart).Seconds())
 	defer mal.mutex.Unlock()
-	defer runMikrotikCommandsMetric(lockWaitStart)
 
-	// TODO: allow defining custom format of target address-list name
-	//listName := fmt.Sprintf("%s_%s", addressList, time.Now().Format("2006-01-02_15-04-05"))
-	listName := getListName()
-	var err error
-	var conn *routeros.Client
-	conn, err = mikrotikConnect()
-	if err != nil {
+	if !isLeader() {
+		log.Debug().
+			Str("func", "runMikrotikCommands").
+			Msg("Not a leader, skipping mikrotik update")
 		return
 	}
-	mal.c = conn
 
+	ctx, span := tracer.Start(context.Background(), "runMikrotikCommands",
+		trace.WithNewRoot(),
+		trace.WithLinks(mal.takeSyncLinks()...),
+	)
+
+	syncStart := time.Now()
+	var syncErr error
 	defer func() {
-		if errClose := mikrotikClose(mal.c); errClose != nil {
-			log.Error().
-				Str("func", "mikrotikClose").
-				Str("list_name", listName).
-				Msgf("Error closing connection to mikrotik: %v", errClose)
+		hooks.syncResult(syncErr)
+		result := "error"
+		metricLastSyncSuccess.Set(0)
+		if syncErr == nil {
+			result = "success"
+			metricLastSyncSuccess.Set(1)
+		} else {
+			span.SetStatus(codes.Error, "mikrotik update failed")
 		}
+		span.End()
+		metricSyncDuration.WithLabelValues(result).Observe(time.Since(syncStart).Seconds())
+		metricLastSyncTimestamp.SetToCurrentTime()
 	}()
 
-	for _, item := range mal.cache.Items() {
-		address := item.Key()
-		ttl := item.TTL()
-		comment := item.Value()
-		err := mal.addToAddressList(listName, address, ttl, comment)
+	_, connSpan := tracer.Start(ctx, "connect")
+	conn, err := mal.conn.acquire()
+	endSpan(connSpan, err)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("func", "runMikrotikCommands").
+			Msg("Mikrotik not available, update will be retried after reconnect")
+		syncErr = fmt.Errorf("mikrotik not available: %w", err)
+		return
+	}
+	defer mal.conn.release()
+	mal.c = conn
+
+	if preflightEnable {
+		_, preflightSpan := tracer.Start(ctx, "preflight")
+		report := mal.runPreflight(conn)
+		preflightSpan.SetAttributes(attribute.Bool("ready", report.Ready))
+		preflightSpan.End()
+	}
+
+	// before firewall rules are set, as changing a rule may reset its counters
+	if usageMetricsInterval > 0 {
+		mal.snapshotDropped(conn)
+	}
+
+	firewallOK := true
+	if mal.permanent != nil {
+		firewallOK, err = mal.syncPermanent(ctx)
 		if err != nil {
+			syncErr = err
 			return
 		}
 	}
 
-	if useIPV4 {
-		if enableFirewallFilter {
-			_ = mal.setAddressListInFirewall("ip", "filter", listName, srcFilterRuleIdsIPv4, "src")
-			_ = mal.setAddressListInFirewall("ip", "filter", listName, dstFilterRuleIdsIPv4, "dst")
+	banOK, err := mal.syncList(ctx, addressList, mal.cache, banRules())
+	if err != nil {
+		syncErr = err
+		return
+	}
+	firewallOK = firewallOK && banOK
+
+	for _, list := range mal.typed {
+		typedOK, err := mal.syncList(ctx, list.prefix, list.cache, list.rules())
+		if err != nil {
+			syncErr = err
+			return
 		}
-		if enableFirewallRaw {
-			_ = mal.setAddressListInFirewall("ip", "raw", listName, srcRawRuleIdsIPv4, "src")
-			_ = mal.setAddressListInFirewall("ip", "raw", listName, dstRawRuleIdsIPv4, "dst")
+		firewallOK = firewallOK && typedOK
+	}
+	if !firewallOK {
+		syncErr = errFirewallUpdate
+	}
+}
+
+// syncList creates new address-list with given prefix, fills it with addresses from the cache
+// and then updates firewall rules to use it
+//
+// returns error if adding addresses failed, in which case firewall rules are not updated,
+// and false if any of the firewall rules failed to update
+func (mal *mikrotikAddrList) syncList(ctx context.Context, prefix string, cache *ttlcache.Cache[string, cacheEntry], rules []firewallRule) (bool, error) {
+	if syncStrategy == syncStrategyScript {
+		// scripts of all interrupted updates are removed once, before shard sessions start,
+		// each session removes only scripts of its own address-list, as other sessions run in parallel
+		proto := "ip"
+		if !useIPV4 {
+			proto = "ipv6"
 		}
-	} else {
-		log.Debug().
-			Str("func", "runMikrotikCommands").
-			Str("list_name", listName).
-			Msgf("Skipping setAddressListInFirewall, because IPv4 support is disabled")
+		mal.cleanupScripts(proto, bouncerType+"-")
+	}
+	if mikrotikShards > 1 {
+		return mal.syncShards(ctx, prefix, cache, rules)
+	}
+
+	// TODO: allow defining custom format of target address-list name
+	listName := getListName(prefix)
+
+	ctx, span := tracer.Start(ctx, "syncList", trace.WithAttributes(
+		attribute.String("list.prefix", prefix),
+		attribute.String("list.name", listName),
+	))
+	defer span.End()
+
+	insertStart := time.Now()
+	items := cache.Items()
+	mal.summary = newSyncSummary()
+	entries, err := mal.fillList(ctx, listName, items)
+	mal.summary.log(prefix, listName, err)
+	mal.summary = nil
+	if err != nil {
+		endSpan(span, err)
+		return false, err
 	}
+	audit.pushedToList(prefix, listName, items)
+	span.SetAttributes(attribute.Int("list.entries", entries))
 
-	if useIPV6 {
-		if enableFirewallFilter {
-			_ = mal.setAddressListInFirewall("ipv6", "filter", listName, srcFilterRuleIdsIPv6, "src")
-			_ = mal.setAddressListInFirewall("ipv6", "filter", listName, dstFilterRuleIdsIPv6, "dst")
+	metricInsertDuration.WithLabelValues(prefix).Observe(time.Since(insertStart).Seconds())
+	metricLastSyncEntries.WithLabelValues(prefix).Set(float64(entries))
+	mal.currentLists.Store(prefix, listName)
+
+	return mal.updateFirewall(ctx, listName, rules), nil
+}
+
+// fillList adds given addresses to address-list using configured sync strategy,
+// returns number of added addresses
+func (mal *mikrotikAddrList) fillList(ctx context.Context, listName string, items map[string]*ttlcache.Item[string, cacheEntry]) (int, error) {
+	if syncStrategy == syncStrategyScript {
+		return mal.uploadScript(ctx, listName, items)
+	}
+	return mal.insertEach(ctx, listName, items)
+}
+
+// updateFirewall sets listName in given firewall rules, returns false if any of them failed to update
+func (mal *mikrotikAddrList) updateFirewall(ctx context.Context, listName string, rules []firewallRule) bool {
+	firewallOK := true
+	for _, rule := range rules {
+		if (rule.proto == "ip" && !useIPV4) || (rule.proto == "ipv6" && !useIPV6) {
+			log.Debug().
+				Str("func", "updateFirewall").
+				Str("list_name", listName).
+				Msgf("Skipping setAddressListInFirewall, because %s support is disabled", rule.proto)
+			continue
 		}
-		if enableFirewallRaw {
-			_ = mal.setAddressListInFirewall("ipv6", "raw", listName, srcRawRuleIdsIPv6, "src")
-			_ = mal.setAddressListInFirewall("ipv6", "raw", listName, dstRawRuleIdsIPv6, "dst")
+		_, fwSpan := tracer.Start(ctx, "firewallUpdate", trace.WithAttributes(
+			attribute.String("proto", rule.proto),
+			attribute.String("table", rule.mode),
+			attribute.String("direction", rule.where),
+			attribute.String("rules", rule.ids),
+			attribute.String("list.name", listName),
+		))
+		err := mal.setAddressListInFirewall(rule.proto, rule.mode, listName, rule.ids, rule.where)
+		endSpan(fwSpan, err)
+		if err != nil {
+			firewallOK = false
 		}
-	} else {
-		log.Debug().
-			Str("func", "runMikrotikCommands").
-			Str("list_name", listName).
-			Msgf("Skipping setAddressListInFirewall, because IPv6 support is disabled")
 	}
+	return firewallOK
+}
 
+// insertEach adds addresses to address-list one by one, returns number of added addresses
+//
+// it stops when ctx is done, such as when other shard of the same address-list failed
+func (mal *mikrotikAddrList) insertEach(ctx context.Context, listName string, items map[string]*ttlcache.Item[string, cacheEntry]) (int, error) {
+	entries := 0
+	_, batch := tracer.Start(ctx, "insert")
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			batch.SetAttributes(attribute.Int("entries", entries%insertSpanBatch))
+			endSpan(batch, err)
+			return entries, err
+		}
+		address := item.Key()
+		ttl := item.TTL()
+		comment := item.Value().comment()
+		err := mal.addToAddressList(listName, address, ttl, comment)
+		if err != nil {
+			batch.SetAttributes(attribute.Int("entries", entries%insertSpanBatch))
+			endSpan(batch, err)
+			return entries, err
+		}
+		entries++
+		if mal.progress != nil {
+			mal.progress.Inc()
+		}
+		if entries%insertSpanBatch == 0 {
+			batch.SetAttributes(attribute.Int("entries", insertSpanBatch))
+			batch.End()
+			_, batch = tracer.Start(ctx, "insert")
+		}
+	}
+	batch.SetAttributes(attribute.Int("entries", entries%insertSpanBatch))
+	batch.End()
+	return entries, nil
 }
 
-func mikrotikConnect() (*routeros.Client, error) {
+func mikrotikConnect() (mikrotikClient, error) {
 
 	log.Info().
 		Str("func", "mikrotikConnect").
+		Str("transport", mikrotikTransport).
 		Str("host", mikrotikHost).
 		Str("username", username).
 		Bool("useTLS", useTLS).
 		Str("timeout", timeout.String()).
 		Msg("Connecting to mikrotik")
 
+	connectStart := time.Now()
 	c, err := dial()
+	metricConnectDuration.Observe(time.Since(connectStart).Seconds())
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -146,7 +293,7 @@ func mikrotikConnect() (*routeros.Client, error) {
 
 }
 
-func mikrotikClose(c *routeros.Client) error {
+func mikrotikClose(c mikrotikClient) error {
 
 	log.Info().
 		Str("func", "mikrotikClose").
@@ -235,6 +382,93 @@ func getProtoCmd(address string) string {
 
 }
 
+// runCmd executes command in MikroTik and applies error policy for the class of the returned error
+//
+// proto, fn and operation are used as metric labels
+//
+// returns nil if command succeeded or if the error was ignored by policy
+func (mal *mikrotikAddrList) runCmd(proto string, fn string, operation string, cmd []string) error {
+	_, err := mal.runCmdReply(proto, fn, operation, cmd)
+	return err
+}
+
+// runCmdReply is runCmd which also returns reply of the command,
+// reply is nil if the error was ignored by policy
+func (mal *mikrotikAddrList) runCmdReply(proto string, fn string, operation string, cmd []string) (*routeros.Reply, error) {
+	for attempt := 1; ; attempt++ {
+		if mal.c == nil {
+			return nil, errMikrotikUnreachable
+		}
+		// leadership can be lost in the middle of the update, new leader takes over from scratch
+		if !isLeader() {
+			return nil, errNotLeader
+		}
+
+		r, err := mal.c.RunArgs(cmd)
+		log.Debug().
+			Str("func", "runCmd").
+			Msgf("response: '%v'", r)
+
+		class := classifyError(err)
+		if class == errClassNone {
+			metricMikrotikCmd.WithLabelValues(proto, fn, operation, "success", class).Inc()
+			return r, nil
+		}
+
+		policy := errPolicy[class]
+		if policy == errPolicyRetry {
+			if attempt <= errRetries {
+				metricMikrotikCmd.WithLabelValues(proto, fn, operation, "retry", class).Inc()
+				delay := retryDelay(attempt)
+				log.Warn().
+					Err(err).
+					Str("func", "runCmd").
+					Str("error_class", class).
+					Int("attempt", attempt).
+					Str("delay", delay.String()).
+					Msgf("Command failed, retrying")
+				time.Sleep(delay)
+
+				if isTransportErrClass(class) {
+					c, errConn := mal.conn.reconnect()
+					if errConn != nil {
+						mal.conn.invalidate(errConn)
+						mal.c = nil
+						return nil, errConn
+					}
+					mal.c = c
+				}
+				continue
+			}
+
+			// retries exhausted
+			policy = errPolicyAbort
+			if isTransportErrClass(class) {
+				policy = errPolicyUnhealthy
+			}
+		}
+
+		switch policy {
+		case errPolicyIgnore:
+			metricMikrotikCmd.WithLabelValues(proto, fn, operation, "ignored", class).Inc()
+			log.Debug().
+				Err(err).
+				Str("func", "runCmd").
+				Str("error_class", class).
+				Msg("Command failed, ignoring")
+			return nil, nil
+		case errPolicyUnhealthy:
+			metricMikrotikCmd.WithLabelValues(proto, fn, operation, "error", class).Inc()
+			mal.conn.invalidate(err)
+			mal.c = nil
+			return nil, err
+		default:
+			metricMikrotikCmd.WithLabelValues(proto, fn, operation, "error", class).Inc()
+			return nil, err
+		}
+	}
+}
+
 // addToAddressList adds address to address-list in MikroTik
 //
 // listName - address-list-name
@@ -257,34 +491,17 @@ func (mal *mikrotikAddrList) addToAddressList(listName string, address string, t
 		return nil
 	}
 
-	if ttl == 0*time.Second {
-		newTTL := 2 * updateFreq
-		log.Info().
-			Str("func", "addToAddressList").
-			Str("ttl", ttl.String()).
-			Str("ttl_updated", newTTL.String()).
-			Msgf("Ban without TTL converted to expiring ban")
-		metricPermBans.WithLabelValues(proto).Inc()
-		ttl = newTTL
-	}
-
-	ttlTruncated := "false"
-	if useMaxTTL && ttl > maxTTL {
-		ttl = maxTTL
-		ttlTruncated = "true"
-	}
-	metricTTLTruncated.WithLabelValues(proto, ttlTruncated).Inc()
+	permanent := ttl == 0
+	ttl, ttlTruncated := addressTTL(proto, ttl)
+	mal.summary.prepared(proto, permanent, ttlTruncated)
 
-	log.Debug().
+	detailLog().Debug().
 		Str("func", "addToAddressList").
 		Msgf("mikrotik: /%s firewall address-list add list=%s address=%s comment='%s' timeout=%s", proto, listName, address, comment, ttl)
 
 	cmd := fmt.Sprintf("/%s/firewall/address-list/add#=list=%s#=address=%s#=comment=%s#=timeout=%s", proto, listName, address, comment, ttl)
 
-	r, err := mal.c.RunArgs(strings.Split(cmd, "#"))
-	log.Debug().
-		Str("func", "addToAddressList").
-		Msgf("response: '%v'", r)
+	err := mal.runCmd(proto, "address_list", "add", strings.Split(cmd, "#"))
 	if err != nil {
 		log.Error().Err(err).
 			Str("func", "addToAddressList").
@@ -295,13 +512,13 @@ func (mal *mikrotikAddrList) addToAddressList(listName string, address string, t
 			Str("ttl_truncated", ttlTruncated).
 			// Str("comment", comment).
 			Msgf("Failed to add address to adress-list")
-		metricMikrotikCmd.WithLabelValues(proto, "address_list", "add", "error").Inc()
+		mal.summary.result(proto, 1, err)
 		return err
 
 	}
-	metricMikrotikCmd.WithLabelValues(proto, "address_list", "add", "success").Inc()
 
-	log.Info().
+	mal.summary.result(proto, 1, nil)
+	detailLog().Debug().
 		Str("func", "addToAddressList").
 		Str("proto", proto).
 		Str("list_name", listName).
@@ -313,6 +530,31 @@ func (mal *mikrotikAddrList) addToAddressList(listName string, address string, t
 	return nil
 }
 
+// addressTTL returns timeout to set for address-list entry,
+// converts bans without ttl to expiring ones and truncates ttl to default_ttl_max if needed
+//
+// second returned value tells if ttl was truncated, as string used in metrics
+func addressTTL(proto string, ttl time.Duration) (time.Duration, string) {
+	if ttl == 0*time.Second {
+		newTTL := 2 * updateFreq
+		detailLog().Debug().
+			Str("func", "addressTTL").
+			Str("ttl", ttl.String()).
+			Str("ttl_updated", newTTL.String()).
+			Msgf("Ban without TTL converted to expiring ban")
+		metricPermBans.WithLabelValues(proto).Inc()
+		ttl = newTTL
+	}
+
+	ttlTruncated := "false"
+	if s := live.Load(); s.useMaxTTL && ttl > s.maxTTL {
+		ttl = s.maxTTL
+		ttlTruncated = "true"
+	}
+	metricTTLTruncated.WithLabelValues(proto, ttlTruncated).Inc()
+	return ttl, ttlTruncated
+}
+
 // setAddressListInFirewall sets given listName as src-address-list in firewall filter/raw rule in MikroTik
 //
 // proto - protocol such as 'ip' for IPV4 or 'ip6' for IPv6
@@ -360,10 +602,9 @@ func (mal *mikrotikAddrList) setAddressListInFirewall(proto string, mode string,
 
 	cmd := fmt.Sprintf("/%s/firewall/%s/set#=%s=%s#=.id=%s", proto, mode, whereStr, listName, firewallRuleIds)
 
-	r, err := mal.c.RunArgs(strings.Split(cmd, "#"))
-	log.Debug().
-		Str("func", "setAddressListInFirewall").
-		Msgf("response: '%v'", r)
+	updateStart := time.Now()
+	err := mal.runCmd(proto, mode, "set", strings.Split(cmd, "#"))
+	metricFirewallUpdateDuration.WithLabelValues(proto, mode, where).Observe(time.Since(updateStart).Seconds())
 	if err != nil {
 		log.Error().Err(err).
 			Str("func", "setAddressListInFirewall").
@@ -372,11 +613,9 @@ func (mal *mikrotikAddrList) setAddressListInFirewall(proto string, mode string,
 			Str(whereStr, listName).
 			Str("number", firewallRuleIds).
 			Msgf("Failed to set %s in firewall", whereStr)
-		metricMikrotikCmd.WithLabelValues(proto, mode, "set", "error").Inc()
 		return err
 
 	}
-	metricMikrotikCmd.WithLabelValues(proto, mode, "set", "success").Inc()
 	log.Info().
 		Str("func", "setAddressListInFirewall").
 		Str("proto", proto).
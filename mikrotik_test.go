@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// connectedAddrList returns address-list connected to fr, holding the connection like mikrotik update does
+func connectedAddrList(t *testing.T, fr *fakeRouter) *mikrotikAddrList {
+	t.Helper()
+	reconnectBackoffMin, reconnectBackoffMax = time.Millisecond, 4*time.Millisecond
+	mc := newMikrotikConnection()
+	mc.dial = fr.dial
+	c, err := mc.acquire()
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	t.Cleanup(mc.release)
+	return &mikrotikAddrList{c: c, conn: mc}
+}
+
+func TestRunCmd(t *testing.T) {
+	cmd := []string{"/ip/firewall/address-list/add", "=list=crowdsec", "=address=192.0.2.1"}
+	tests := []struct {
+		name     string
+		policy   string
+		traps    []string // message of !trap returned by each attempt, empty for success
+		wantErr  bool
+		attempts int
+	}{
+		{name: "success", traps: []string{""}, attempts: 1},
+		{name: "ignored exists", traps: []string{"failure: already have such entry"}, attempts: 1},
+		{name: "abort not found", traps: []string{"no such item"}, wantErr: true, attempts: 1},
+		{name: "retry device", policy: "device=retry", traps: []string{"busy", "busy", ""}, attempts: 3},
+		{name: "retries exhausted", policy: "device=retry", traps: []string{"busy", "busy", "busy", ""}, wantErr: true, attempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			errPolicy, err = parseErrPolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			errRetries = 2
+
+			attempt := 0
+			fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+				trap := tt.traps[attempt]
+				attempt++
+				return nil, trap
+			}}
+			mal := connectedAddrList(t, fr)
+
+			err = mal.runCmd("ip", "addToAddressList", "add", cmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runCmd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempt != tt.attempts {
+				t.Errorf("command sent %d times, want %d", attempt, tt.attempts)
+			}
+			if mal.c == nil {
+				t.Error("connection dropped after device error")
+			}
+		})
+	}
+}
+
+func TestRunCmdReconnect(t *testing.T) {
+	errPolicy, _ = parseErrPolicy("")
+	errRetries = 2
+
+	// first command breaks the connection, like router reboot
+	fr := &fakeRouter{}
+	commands := 0
+	fr.reply = func(words []string) ([]map[string]string, string) {
+		commands++
+		if commands == 1 {
+			fr.drop()
+		}
+		return nil, ""
+	}
+	mal := connectedAddrList(t, fr)
+	first := mal.c
+
+	if err := mal.runCmd("ip", "addToAddressList", "add", []string{"/ip/firewall/address-list/add"}); err != nil {
+		t.Fatalf("runCmd() error = %v", err)
+	}
+	if mal.c == nil || mal.c == first {
+		t.Error("command was not retried over new connection")
+	}
+	if commands != 2 {
+		t.Errorf("command sent %d times, want 2", commands)
+	}
+}
+
+func TestRunCmdUnhealthy(t *testing.T) {
+	errPolicy, _ = parseErrPolicy("")
+	errRetries = 1
+
+	// every command breaks the connection
+	fr := &fakeRouter{}
+	fr.reply = func(words []string) ([]map[string]string, string) {
+		fr.drop()
+		return nil, ""
+	}
+	mal := connectedAddrList(t, fr)
+
+	if err := mal.runCmd("ip", "addToAddressList", "add", []string{"/ip/firewall/address-list/add"}); err == nil {
+		t.Fatal("runCmd() succeeded on broken connection")
+	}
+	if mal.c != nil {
+		t.Error("broken connection kept after retries were exhausted")
+	}
+	if !mal.conn.pending.Load() {
+		t.Error("aborted update is not pending for retry after reconnect")
+	}
+	if got := len(fr.received()); got != 2 {
+		t.Errorf("command sent %d times, want 2", got)
+	}
+}
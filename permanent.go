@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// permanentFor returns cache of permanent_list if bans without TTL of given decision type go there, or nil
+func (mal *mikrotikAddrList) permanentFor(decisionType string) *ttlcache.Cache[string, cacheEntry] {
+	if decisionType != decisionTypeBan {
+		return nil
+	}
+	return mal.permanent
+}
+
+// normalizeAddress returns address or prefix in the same form for cache keys and router entries,
+// such as '2a00::1/128' and '1.2.3.4' for single addresses
+func normalizeAddress(address string) string {
+	if p, err := netip.ParsePrefix(address); err == nil {
+		if p.IsSingleIP() && p.Addr().Is4() {
+			return p.Addr().String()
+		}
+		return p.Masked().String()
+	}
+	if a, err := netip.ParseAddr(address); err == nil && a.Is6() {
+		return netip.PrefixFrom(a, a.BitLen()).String()
+	}
+	return address
+}
+
+// readPermanentList returns entries of permanent_list on the router, normalized address -> item id,
+// entries added by hand with timeout are dynamic and are left alone
+func readPermanentList(c mikrotikClient, proto string) (map[string]string, error) {
+	r, err := c.RunArgs([]string{
+		fmt.Sprintf("/%s/firewall/address-list/print", proto),
+		"?list=" + permanentList,
+		"?dynamic=false",
+		"=.proplist=.id,address",
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string, len(r.Re))
+	for _, re := range r.Re {
+		entries[normalizeAddress(re.Map["address"])] = re.Map[".id"]
+	}
+	return entries, nil
+}
+
+// syncPermanent updates permanent_list on the router to match the cache of bans without TTL,
+// unlike other address-lists it is never recreated, only missing entries are added without timeout
+// and entries of deleted decisions are removed, and then firewall rules are set to use it
+//
+// the cache is not persisted, so until the first batch of decisions is received after start
+// nothing is removed, otherwise update run before it would empty the address-list
+//
+// returns error if updating address-list failed, and false if any of the firewall rules failed to update
+func (mal *mikrotikAddrList) syncPermanent(ctx context.Context) (bool, error) {
+	ctx, span := tracer.Start(ctx, "syncPermanent", trace.WithAttributes(
+		attribute.String("list.name", permanentList),
+	))
+	defer span.End()
+
+	start := time.Now()
+	items := mal.permanent.Items()
+	added, removed := 0, 0
+	for _, proto := range []string{"ip", "ipv6"} {
+		if (proto == "ip" && !useIPV4) || (proto == "ipv6" && !useIPV6) {
+			continue
+		}
+		if mal.c == nil {
+			endSpan(span, errMikrotikUnreachable)
+			return false, errMikrotikUnreachable
+		}
+		current, err := readPermanentList(mal.c, proto)
+		if err != nil {
+			err = fmt.Errorf("failed to read %s address-list %s: %w", proto, permanentList, err)
+			endSpan(span, err)
+			return false, err
+		}
+
+		for address, item := range items {
+			if getProtoCmd(address) != proto {
+				continue
+			}
+			key := normalizeAddress(address)
+			if _, ok := current[key]; ok {
+				delete(current, key)
+				continue
+			}
+			err := mal.runCmd(proto, "address_list", "add", []string{
+				fmt.Sprintf("/%s/firewall/address-list/add", proto),
+				"=list=" + permanentList,
+				"=address=" + address,
+				"=comment=" + item.Value().comment(),
+			})
+			if err != nil {
+				metricPermanentChanges.WithLabelValues(proto, "add", "error").Inc()
+				err = fmt.Errorf("failed to add %s to address-list %s: %w", address, permanentList, err)
+				endSpan(span, err)
+				return false, err
+			}
+			metricPermanentChanges.WithLabelValues(proto, "add", "success").Inc()
+			added++
+			detailLog().Debug().
+				Str("func", "syncPermanent").
+				Str("proto", proto).
+				Str("address", address).
+				Msg("Address added to permanent address-list")
+		}
+
+		// what is left was removed from the cache since the previous update
+		if !mal.streamReady.Load() {
+			if len(current) > 0 {
+				log.Info().
+					Str("func", "syncPermanent").
+					Str("proto", proto).
+					Str("list_name", permanentList).
+					Int("entries", len(current)).
+					Msg("Decisions not received from LAPI yet, keeping entries of permanent address-list")
+			}
+			continue
+		}
+		for address, id := range current {
+			err := mal.runCmd(proto, "address_list", "remove", []string{
+				fmt.Sprintf("/%s/firewall/address-list/remove", proto),
+				"=.id=" + id,
+			})
+			if err != nil {
+				metricPermanentChanges.WithLabelValues(proto, "remove", "error").Inc()
+				err = fmt.Errorf("failed to remove %s from address-list %s: %w", address, permanentList, err)
+				endSpan(span, err)
+				return false, err
+			}
+			metricPermanentChanges.WithLabelValues(proto, "remove", "success").Inc()
+			removed++
+			detailLog().Debug().
+				Str("func", "syncPermanent").
+				Str("proto", proto).
+				Str("address", address).
+				Msg("Address removed from permanent address-list")
+		}
+	}
+	audit.pushedToList(permanentList, permanentList, items)
+	span.SetAttributes(attribute.Int("list.entries", len(items)))
+	metricLastSyncEntries.WithLabelValues(permanentList).Set(float64(len(items)))
+	mal.currentLists.Store(permanentList, permanentList)
+
+	log.Info().
+		Str("func", "syncPermanent").
+		Str("list_name", permanentList).
+		Int("entries", len(items)).
+		Int("added", added).
+		Int("removed", removed).
+		Str("duration", time.Since(start).String()).
+		Msg("Permanent address-list updated")
+
+	return mal.updateFirewall(ctx, permanentList, live.Load().permanentRules), nil
+}
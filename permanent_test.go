@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1/32", "192.0.2.1"},
+		{"192.0.2.7/24", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::1/128", "2001:db8::1/128"},
+		{"2001:db8::1/64", "2001:db8::/64"},
+		{"not-an-address", "not-an-address"},
+	}
+	for _, tt := range tests {
+		if got := normalizeAddress(tt.address); got != tt.want {
+			t.Errorf("normalizeAddress(%s) = %s, want %s", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestSyncPermanent(t *testing.T) {
+	useIPV4, useIPV6 = true, false
+	permanentList = "crowdsec_permanent"
+	t.Cleanup(func() { permanentList = "" })
+	useSettings(t, &settings{})
+
+	tests := []struct {
+		name        string
+		streamReady bool
+		want        []string // add and remove commands sent to the router
+	}{
+		{
+			name: "before first decisions",
+			want: []string{"/ip/firewall/address-list/add =list=crowdsec_permanent =address=192.0.2.2"},
+		},
+		{
+			name:        "after first decisions",
+			streamReady: true,
+			want: []string{
+				"/ip/firewall/address-list/add =list=crowdsec_permanent =address=192.0.2.2",
+				"/ip/firewall/address-list/remove =.id=*2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+				if words[0] != "/ip/firewall/address-list/print" {
+					return nil, ""
+				}
+				// 192.0.2.1 is in the cache, 192.0.2.9 was deleted or added by hand
+				return []map[string]string{
+					{".id": "*1", "address": "192.0.2.1"},
+					{".id": "*2", "address": "192.0.2.9"},
+				}, ""
+			}}
+			mal := connectedAddrList(t, fr)
+			mal.permanent = ttlcache.New[string, cacheEntry]()
+			mal.permanent.Set("192.0.2.1", cacheEntry{origin: "cscli"}, ttlcache.DefaultTTL)
+			mal.permanent.Set("192.0.2.2", cacheEntry{origin: "cscli"}, ttlcache.DefaultTTL)
+			mal.streamReady.Store(tt.streamReady)
+
+			firewallOK, err := mal.syncPermanent(context.Background())
+			if err != nil || !firewallOK {
+				t.Fatalf("syncPermanent() = %v, %v", firewallOK, err)
+			}
+			var got []string
+			for _, cmd := range fr.received() {
+				if strings.Contains(cmd, "/add ") || strings.Contains(cmd, "/remove ") {
+					// comment depends on cache entry and is not checked
+					got = append(got, strings.Split(cmd, " =comment=")[0])
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
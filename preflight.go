@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-routeros/routeros/v3/proto"
+	"github.com/rs/zerolog/log"
+)
+
+// preflight check results
+const (
+	preflightOK   = "ok"
+	preflightWarn = "warn" // bouncer works, but probably not as intended
+	preflightFail = "fail" // mikrotik update will fail
+)
+
+// properties of firewall rule which do not limit what packets it matches
+var ruleNonMatchers = []string{
+	".id", ".nextid", "chain", "action", "comment", "disabled", "dynamic", "invalid",
+	"log", "log-prefix", "bytes", "packets", "jump-target",
+}
+
+// lastPreflight is the result of the last preflight, nil until the first one finishes
+var lastPreflight atomic.Pointer[preflightReport]
+
+type preflightCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// preflightReport is served on /preflight, and tells if bouncer is ready on /readyz
+type preflightReport struct {
+	Time   time.Time        `json:"time"`
+	Ready  bool             `json:"ready"` // no check failed
+	Checks []preflightCheck `json:"checks"`
+}
+
+func (r *preflightReport) add(name string, status string, format string, args ...any) {
+	r.Checks = append(r.Checks, preflightCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+	if status == preflightFail {
+		r.Ready = false
+	}
+}
+
+// preflight runs preflight on startup, so that configuration errors are reported
+// before the first mikrotik update
+func (mal *mikrotikAddrList) preflight() {
+	mal.mutex.Lock()
+	defer mal.mutex.Unlock()
+
+	if !isLeader() {
+		return
+	}
+	c, err := mal.conn.acquire()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("func", "preflight").
+			Msg("Mikrotik not available, preflight will run before the first update")
+		return
+	}
+	defer mal.conn.release()
+	mal.runPreflight(c)
+}
+
+// runPreflight checks that the router matches configuration: API user policies, IPv6 support,
+// and configured firewall rules, and publishes the report
+func (mal *mikrotikAddrList) runPreflight(c mikrotikClient) *preflightReport {
+	report := &preflightReport{Time: time.Now(), Ready: true}
+
+	checkPolicies(c, report)
+	if useIPV6 {
+		checkIPv6(c, report)
+	}
+	checkRules(c, mal.expectedRules(), report)
+
+	for _, check := range report.Checks {
+		if check.Status == preflightOK {
+			continue
+		}
+		logger := log.Warn()
+		if check.Status == preflightFail {
+			logger = log.Error()
+		}
+		logger.
+			Str("func", "preflight").
+			Str("check", check.Name).
+			Str("status", check.Status).
+			Msg(check.Message)
+	}
+
+	previous := lastPreflight.Swap(report)
+	if previous == nil || previous.Ready != report.Ready {
+		log.Info().
+			Str("func", "preflight").
+			Bool("ready", report.Ready).
+			Int("checks", len(report.Checks)).
+			Msg("Preflight finished")
+	}
+	for _, status := range []string{preflightOK, preflightWarn, preflightFail} {
+		count := 0
+		for _, check := range report.Checks {
+			if check.Status == status {
+				count++
+			}
+		}
+		metricPreflightChecks.WithLabelValues(status).Set(float64(count))
+	}
+	metricPreflightReady.Set(0)
+	if report.Ready {
+		metricPreflightReady.Set(1)
+	}
+	return report
+}
+
+// firstItem returns properties of the first item in print reply, REST returns them in !done
+func firstItem(r *proto.Sentence, re []*proto.Sentence) map[string]string {
+	if len(re) > 0 {
+		return re[0].Map
+	}
+	if r != nil {
+		return r.Map
+	}
+	return nil
+}
+
+// checkPolicies checks that group of the API user has read, write and api or rest-api policies
+func checkPolicies(c mikrotikClient, report *preflightReport) {
+	const name = "user policies"
+	r, err := c.RunArgs([]string{"/user/print", "?name=" + username, "=.proplist=group"})
+	if err != nil {
+		report.add(name, preflightFail, "failed to read user %s: %s", username, err)
+		return
+	}
+	group := firstItem(r.Done, r.Re)["group"]
+	if group == "" {
+		report.add(name, preflightFail, "user %s not found", username)
+		return
+	}
+	r, err = c.RunArgs([]string{"/user/group/print", "?name=" + group, "=.proplist=policy"})
+	if err != nil {
+		report.add(name, preflightFail, "failed to read group %s: %s", group, err)
+		return
+	}
+	policies := strings.Split(firstItem(r.Done, r.Re)["policy"], ",")
+
+	required := []string{"read", "write", "api"}
+	if mikrotikTransport == transportREST {
+		required = []string{"read", "write", "rest-api"}
+	}
+	var missing []string
+	for _, policy := range required {
+		if !slices.Contains(policies, policy) {
+			missing = append(missing, policy)
+		}
+	}
+	if len(missing) > 0 {
+		report.add(name, preflightFail, "group %s of user %s is missing policies: %s", group, username, strings.Join(missing, ","))
+		return
+	}
+	report.add(name, preflightOK, "group %s", group)
+}
+
+// checkIPv6 checks that IPv6 is not disabled on the router
+func checkIPv6(c mikrotikClient, report *preflightReport) {
+	const name = "ipv6"
+	r, err := c.RunArgs([]string{"/ipv6/settings/print"})
+	if err != nil {
+		report.add(name, preflightFail, "failed to read ipv6 settings, is ipv6 package enabled: %s", err)
+		return
+	}
+	if firstItem(r.Done, r.Re)["disable-ipv6"] == "true" {
+		report.add(name, preflightFail, "ipv6 is disabled on the router, enable it or set mikrotik_ipv6 to false")
+		return
+	}
+	report.add(name, preflightOK, "")
+}
+
+// checkRules checks that each configured firewall rule exists in its table, is enabled,
+// and is not placed after a rule which accepts all packets in the same chain
+func checkRules(c mikrotikClient, rules []expectedRule, report *preflightReport) {
+	tables := map[string][]*proto.Sentence{}
+	for _, rule := range rules {
+		name := fmt.Sprintf("%s firewall %s %s rule %s", rule.proto, rule.mode, rule.where, rule.id)
+		table := rule.proto + "/" + rule.mode
+		items, ok := tables[table]
+		if !ok {
+			r, err := c.RunArgs([]string{fmt.Sprintf("/%s/firewall/%s/print", rule.proto, rule.mode)})
+			if err != nil {
+				report.add(name, preflightFail, "failed to read /%s firewall %s: %s", rule.proto, rule.mode, err)
+				continue
+			}
+			items = r.Re
+			tables[table] = items
+		}
+
+		n, _ := strconv.Atoi(rule.id)
+		if n >= len(items) {
+			report.add(name, preflightFail, "rule does not exist, /%s firewall %s has %d rules", rule.proto, rule.mode, len(items))
+			continue
+		}
+		item := items[n].Map
+		if item["disabled"] == "true" {
+			report.add(name, preflightWarn, "rule is disabled")
+			continue
+		}
+		if shadow := shadowingRule(items[:n], item["chain"]); shadow >= 0 {
+			report.add(name, preflightWarn, "rule is placed after rule %d with action %s in chain %s, which may accept packets before they reach it",
+				shadow, items[shadow].Map["action"], item["chain"])
+			continue
+		}
+		report.add(name, preflightOK, "chain %s, action %s", item["chain"], item["action"])
+	}
+}
+
+// shadowingRule returns number of the first enabled rule in given chain which fasttracks connections
+// or accepts all packets, or -1 if there is none
+func shadowingRule(items []*proto.Sentence, chain string) int {
+	for i, item := range items {
+		m := item.Map
+		if m["chain"] != chain || m["disabled"] == "true" {
+			continue
+		}
+		if m["action"] == "fasttrack-connection" {
+			return i
+		}
+		if m["action"] != "accept" {
+			continue
+		}
+		matchAll := true
+		for key := range m {
+			if !slices.Contains(ruleNonMatchers, key) {
+				matchAll = false
+				break
+			}
+		}
+		if matchAll {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-routeros/routeros/v3/proto"
+)
+
+func firewallItem(m map[string]string) *proto.Sentence {
+	return &proto.Sentence{Word: "!re", Map: m}
+}
+
+func TestShadowingRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []*proto.Sentence
+		want  int
+	}{
+		{"no rules", nil, -1},
+		{"accept all", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "input", "action": "accept", "comment": "allow"}),
+		}, 0},
+		{"accept with matcher", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "input", "action": "accept", "connection-state": "established"}),
+		}, -1},
+		{"other chain", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "forward", "action": "accept"}),
+		}, -1},
+		{"disabled", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "input", "action": "accept", "disabled": "true"}),
+		}, -1},
+		{"drop", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "input", "action": "drop"}),
+		}, -1},
+		{"fasttrack", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "input", "action": "accept", "protocol": "icmp"}),
+			firewallItem(map[string]string{".id": "*2", "chain": "input", "action": "fasttrack-connection", "connection-state": "established"}),
+		}, 1},
+		{"first shadowing", []*proto.Sentence{
+			firewallItem(map[string]string{".id": "*1", "chain": "input", "action": "accept", "log": "true"}),
+			firewallItem(map[string]string{".id": "*2", "chain": "input", "action": "accept"}),
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shadowingRule(tt.items, "input"); got != tt.want {
+				t.Errorf("shadowingRule() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	addressList, username = "crowdsec", "bouncer"
+	useIPV4, useIPV6 = true, true
+	useSettings(t, &settings{banRules: []firewallRule{
+		{proto: "ip", mode: "filter", where: "src", ids: "1,2"},
+		{proto: "ipv6", mode: "filter", where: "dst", ids: "0"},
+	}})
+	mikrotikShards = 1
+	mikrotikTransport = transportAPI
+
+	tests := []struct {
+		name      string
+		policy    string
+		ipv6      string
+		wantReady bool
+		want      map[string]string // check name -> status
+	}{
+		{"ready", "read,write,api,test", "false", true, map[string]string{
+			"user policies":                   preflightOK,
+			"ipv6":                            preflightOK,
+			"ip firewall filter src rule 1":   preflightWarn,
+			"ip firewall filter src rule 2":   preflightWarn,
+			"ipv6 firewall filter dst rule 0": preflightOK,
+		}},
+		{"missing policy", "read,api", "true", false, map[string]string{
+			"user policies": preflightFail,
+			"ipv6":          preflightFail,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+				switch words[0] {
+				case "/user/print":
+					return []map[string]string{{"group": "bouncers"}}, ""
+				case "/user/group/print":
+					return []map[string]string{{"policy": tt.policy}}, ""
+				case "/ipv6/settings/print":
+					return []map[string]string{{"disable-ipv6": tt.ipv6}}, ""
+				case "/ip/firewall/filter/print":
+					return []map[string]string{
+						{".id": "*1", "chain": "input", "action": "fasttrack-connection", "connection-state": "established"},
+						{".id": "*2", "chain": "input", "action": "drop", "src-address-list": "crowdsec_1"},
+						{".id": "*3", "chain": "forward", "action": "drop", "disabled": "true"},
+					}, ""
+				case "/ipv6/firewall/filter/print":
+					return []map[string]string{{".id": "*1", "chain": "input", "action": "drop"}}, ""
+				}
+				return nil, "no such command"
+			}}
+			mal := connectedAddrList(t, fr)
+			report := mal.runPreflight(mal.c)
+
+			if report.Ready != tt.wantReady {
+				t.Errorf("ready = %v, want %v", report.Ready, tt.wantReady)
+			}
+			got := map[string]string{}
+			for _, check := range report.Checks {
+				got[check.Name] = check.Status
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("check %q = %q, want %q", name, got[name], want)
+				}
+			}
+			if lastPreflight.Load() != report {
+				t.Error("report is not published")
+			}
+			if want := map[bool]float64{true: 1}[tt.wantReady]; metricValue(t, "cs_mikrotik_bouncer_preflight_ready", nil) != want {
+				t.Errorf("preflight_ready metric does not match report")
+			}
+		})
+	}
+}
+
+func TestPreflightRuleChecks(t *testing.T) {
+	report := &preflightReport{Ready: true}
+	fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+		return []map[string]string{{".id": "*1", "chain": "input", "action": "drop", "disabled": "true"}}, ""
+	}}
+	mal := connectedAddrList(t, fr)
+	checkRules(mal.c, []expectedRule{
+		{firewallRule: firewallRule{proto: "ip", mode: "raw", where: "src"}, id: "0"},
+		{firewallRule: firewallRule{proto: "ip", mode: "raw", where: "src"}, id: "3"},
+	}, report)
+
+	if len(report.Checks) != 2 {
+		t.Fatalf("checks = %+v, want 2", report.Checks)
+	}
+	if c := report.Checks[0]; c.Status != preflightWarn || !strings.Contains(c.Message, "disabled") {
+		t.Errorf("check of disabled rule = %+v, want warning", c)
+	}
+	if c := report.Checks[1]; c.Status != preflightFail || !strings.Contains(c.Message, "does not exist") {
+		t.Errorf("check of missing rule = %+v, want failure", c)
+	}
+	if report.Ready {
+		t.Error("missing rule does not fail readiness")
+	}
+	// table is read once for all its rules
+	if got := fr.received(); len(got) != 1 {
+		t.Errorf("router received %q, want single print", got)
+	}
+}
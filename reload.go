@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// wait for config file writes to settle before reloading,
+// editors and kubernetes ConfigMap updates produce several events per change
+const reloadDebounce = time.Second
+
+// runReloader reloads settings on SIGHUP, and on config_file change if it is set,
+// onChange is called when reloaded settings differ from current ones
+func runReloader(ctx context.Context, onChange func()) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	if configFile != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		defer watcher.Close()
+		// watch directory instead of the file, so that replaced files and ConfigMap symlink swaps are noticed
+		if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+			return err
+		}
+		events = watcher.Events
+		go func() {
+			for err := range watcher.Errors {
+				log.Error().
+					Err(err).
+					Str("func", "reload").
+					Msg("Config file watcher failed")
+			}
+		}()
+	}
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	name := filepath.Base(configFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			reloadConfig("signal", onChange)
+		case event := <-events:
+			// kubernetes updates mounted ConfigMap by swapping ..data symlink
+			base := filepath.Base(event.Name)
+			if base != name && base != "..data" {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			reloadConfig("file", onChange)
+		}
+	}
+}
+
+// reloadConfig reads config file again and swaps live settings,
+// invalid config is rejected and current settings stay active
+//
+// without config file there is nothing to reload, environment of running process does not change
+func reloadConfig(source string, onChange func()) {
+	if configFile == "" {
+		metricConfigReload.WithLabelValues(source, "skipped").Inc()
+		log.Warn().
+			Str("func", "reload").
+			Str("source", source).
+			Msg("Config file is not set, settings from environment variables require restart, reload skipped")
+		return
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		reloadFailed(source, err)
+		return
+	}
+	next, err := loadSettings()
+	if err != nil {
+		reloadFailed(source, err)
+		return
+	}
+
+	previous := live.Swap(next)
+	zerolog.SetGlobalLevel(next.logLevel)
+	metricConfigReload.WithLabelValues(source, "success").Inc()
+	metricConfigReloadTimestamp.SetToCurrentTime()
+
+	changed := next.changes(previous)
+	log.Info().
+		Str("func", "reload").
+		Str("source", source).
+		Str("changed", strings.Join(changed, ",")).
+		Msg("Config reloaded")
+	if len(changed) > 0 {
+		// firewall rules and list names are applied by the next update
+		onChange()
+	}
+}
+
+func reloadFailed(source string, err error) {
+	metricConfigReload.WithLabelValues(source, "error").Inc()
+	log.Error().
+		Err(err).
+		Str("func", "reload").
+		Str("source", source).
+		Msg("Failed to reload config, keeping current settings")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// useSettings replaces live settings for the duration of the test
+func useSettings(t *testing.T, s *settings) {
+	t.Helper()
+	previous := live.Load()
+	live.Store(s)
+	t.Cleanup(func() { live.Store(previous) })
+}
+
+// writeConfig replaces content of the config file used by reloadConfig
+func writeConfig(t *testing.T, content string) {
+	t.Helper()
+	if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	viper.SetConfigFile(configFile)
+	level := zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		configFile = ""
+		viper.Reset()
+		zerolog.SetGlobalLevel(level)
+	})
+	useIPV4, useIPV6 = false, false
+	typedLists = nil
+	mikrotikShards = 1
+	updateFreq = time.Hour
+
+	writeConfig(t, "log_level: info\ndefault_ttl: 3h\n")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	initial, err := loadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useSettings(t, initial)
+
+	tests := []struct {
+		name       string
+		config     string
+		wantSwap   bool
+		wantChange bool
+		wantTTL    time.Duration
+	}{
+		{"unchanged", "log_level: info\ndefault_ttl: 3h\n", true, false, 3 * time.Hour},
+		{"changed", "log_level: info\ndefault_ttl: 6h\n", true, true, 6 * time.Hour},
+		{"invalid value", "log_level: info\ndefault_ttl: 1h\ndefault_ttl_max: 30m\n", false, false, 6 * time.Hour},
+		{"invalid file", "log_level: [info\n", false, false, 6 * time.Hour},
+		{"invalid log level", "log_level: loud\ndefault_ttl: 1h\n", false, false, 6 * time.Hour},
+		// same as on startup, default_ttl is not validated
+		{"zero default_ttl", "log_level: info\ndefault_ttl: 0s\n", true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(t, tt.config)
+			before := live.Load()
+			errorsBefore := metricValue(t, "cs_mikrotik_bouncer_config_reload_total", map[string]string{"source": "test", "result": "error"})
+
+			changes := 0
+			reloadConfig("test", func() { changes++ })
+
+			if swapped := live.Load() != before; swapped != tt.wantSwap {
+				t.Errorf("settings swapped = %v, want %v", swapped, tt.wantSwap)
+			}
+			if got := live.Load().defaultTTL; got != tt.wantTTL {
+				t.Errorf("default_ttl = %s, want %s", got, tt.wantTTL)
+			}
+			if (changes > 0) != tt.wantChange {
+				t.Errorf("onChange called %d times, want change %v", changes, tt.wantChange)
+			}
+			rejected := metricValue(t, "cs_mikrotik_bouncer_config_reload_total", map[string]string{"source": "test", "result": "error"}) - errorsBefore
+			if want := map[bool]float64{false: 1}[tt.wantSwap]; rejected != want {
+				t.Errorf("rejected reloads increased by %v, want %v", rejected, want)
+			}
+		})
+	}
+}
+
+func TestSettingsChanges(t *testing.T) {
+	typedLists = map[string]*typedList{"captcha": {decisionType: "captcha", prefix: "crowdsec_captcha"}}
+	defer func() { typedLists = nil }()
+
+	base := settings{
+		defaultTTL: time.Hour,
+		banRules:   []firewallRule{{proto: "ip", mode: "filter", where: "src", ids: "1"}},
+		typeRules:  map[string][]firewallRule{"captcha": {{proto: "ip", mode: "nat", where: "src", ids: "2"}}},
+	}
+	same := base
+	if got := same.changes(&base); len(got) != 0 {
+		t.Errorf("changes() of equal settings = %v", got)
+	}
+
+	changed := base
+	changed.useMaxTTL = true
+	changed.banRules = []firewallRule{{proto: "ip", mode: "filter", where: "src", ids: "1,2"}}
+	changed.typeRules = map[string][]firewallRule{}
+	want := []string{"use_max_ttl", "firewall_rules", "decision_type_rules"}
+	if got := changed.changes(&base); !slices.Equal(got, want) {
+		t.Errorf("changes() = %v, want %v", got, want)
+	}
+}
+
+func TestReloadConfigWithoutFile(t *testing.T) {
+	configFile = ""
+	current := &settings{defaultTTL: time.Hour}
+	useSettings(t, current)
+	labels := map[string]string{"source": "signal", "result": "skipped"}
+	before := metricValue(t, "cs_mikrotik_bouncer_config_reload_total", labels)
+
+	changed := false
+	reloadConfig("signal", func() { changed = true })
+	if live.Load() != current || changed {
+		t.Error("settings reloaded without config file")
+	}
+	if got := metricValue(t, "cs_mikrotik_bouncer_config_reload_total", labels) - before; got != 1 {
+		t.Errorf("config_reload_total{result=skipped} increased by %v, want 1", got)
+	}
+}
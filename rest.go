@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/go-routeros/routeros/v3/proto"
+	"github.com/rs/zerolog/log"
+)
+
+// restError is returned by RouterOS REST API on failed command
+type restError struct {
+	Status  int    `json:"error"`
+	Message string `json:"message"`
+	Detail  string `json:"detail"`
+}
+
+func (e *restError) Error() string {
+	return fmt.Sprintf("rest: %d %s: %s", e.Status, e.Message, e.Detail)
+}
+
+// restClient runs commands on MikroTik over RouterOS 7 REST API (https://<router>/rest)
+//
+// commands are passed as binary API sentences, so that the rest of the code
+// does not need to know which transport is used:
+//
+// - 'add' is sent as PUT to the menu
+//
+// - 'set' is sent as PATCH to each item, rule numbers are resolved to item ids first
+//
+// - anything else, such as 'print', is sent as POST to the command, with '?' words as .query
+type restClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// dialREST creates REST client and checks that credentials are accepted
+func dialREST() (*restClient, error) {
+	c := &restClient{
+		baseURL: strings.TrimSuffix(mikrotikRESTURL, "/") + "/rest",
+		http: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:     mikrotikRESTTLSConfig,
+				MaxIdleConnsPerHost: 2,
+			},
+		},
+	}
+	if _, err := c.RunArgs([]string{"/system/identity/print"}); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("could not login: %w", err)
+	}
+	log.Info().
+		Str("func", "dialREST").
+		Str("url", c.baseURL).
+		Msg("Connected to mikrotik REST API")
+	return c, nil
+}
+
+// RunArgs translates binary API sentence to REST call and returns response as API reply
+func (c *restClient) RunArgs(sentence []string) (*routeros.Reply, error) {
+	if len(sentence) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	path := sentence[0]
+	idx := strings.LastIndex(path, "/")
+	menu, command := path[:idx], path[idx+1:]
+
+	attrs := map[string]string{}
+	var query []string
+	for _, word := range sentence[1:] {
+		switch {
+		case strings.HasPrefix(word, "="):
+			k, v, _ := strings.Cut(word[1:], "=")
+			attrs[k] = v
+		case strings.HasPrefix(word, "?"):
+			query = append(query, word[1:])
+		}
+	}
+
+	switch command {
+	case "add":
+		return c.do(http.MethodPut, menu, attrs)
+	case "set":
+		return c.set(menu, attrs)
+	}
+
+	body := map[string]any{}
+	for k, v := range attrs {
+		if k == ".proplist" {
+			body[k] = strings.Split(v, ",")
+			continue
+		}
+		body[k] = v
+	}
+	if len(query) > 0 {
+		body[".query"] = query
+	}
+	return c.do(http.MethodPost, path, body)
+}
+
+// set updates each item from comma separated .id, which can be item ids such as *1A or rule numbers
+func (c *restClient) set(menu string, attrs map[string]string) (*routeros.Reply, error) {
+	ids := attrs[".id"]
+	delete(attrs, ".id")
+
+	var items []*proto.Sentence
+	for id := range strings.SplitSeq(ids, ",") {
+		if n, err := strconv.Atoi(id); err == nil {
+			if items == nil {
+				r, err := c.RunArgs([]string{menu + "/print", "=.proplist=.id"})
+				if err != nil {
+					return nil, err
+				}
+				items = r.Re
+			}
+			if n < 0 || n >= len(items) {
+				return nil, &restError{Status: http.StatusNotFound, Message: "Not Found", Detail: "no such item"}
+			}
+			id = items[n].Map[".id"]
+		}
+		if _, err := c.do(http.MethodPatch, menu+"/"+id, attrs); err != nil {
+			return nil, err
+		}
+	}
+	return &routeros.Reply{Done: &proto.Sentence{Word: "!done", Map: map[string]string{}}}, nil
+}
+
+// do sends request with JSON body and converts JSON response to API reply
+func (c *restClient) do(method string, path string, body any) (*routeros.Reply, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(username, password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		e := &restError{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		_ = json.Unmarshal(raw, e)
+		return nil, e
+	}
+	return parseRESTReply(raw)
+}
+
+// parseRESTReply converts JSON object or list of objects to API reply,
+// list items become !re sentences and single object becomes !done sentence
+func parseRESTReply(raw []byte) (*routeros.Reply, error) {
+	reply := &routeros.Reply{Done: &proto.Sentence{Word: "!done", Map: map[string]string{}}}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return reply, nil
+	}
+
+	if raw[0] == '[' {
+		var items []map[string]any
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("invalid rest response: %w", err)
+		}
+		for _, item := range items {
+			reply.Re = append(reply.Re, restSentence("!re", item))
+		}
+		return reply, nil
+	}
+
+	var item map[string]any
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return nil, fmt.Errorf("invalid rest response: %w", err)
+	}
+	reply.Done = restSentence("!done", item)
+	return reply, nil
+}
+
+func restSentence(word string, item map[string]any) *proto.Sentence {
+	sen := &proto.Sentence{Word: word, Map: map[string]string{}}
+	for k, v := range item {
+		value, ok := v.(string)
+		if !ok {
+			value = fmt.Sprint(v)
+		}
+		sen.Map[k] = value
+		sen.List = append(sen.List, proto.Pair{Key: k, Value: value})
+	}
+	return sen
+}
+
+// Close drops idle connections, REST API is stateless so there is no session to close
+func (c *restClient) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// restCall is a single request received by fake REST API
+type restCall struct {
+	method string
+	path   string
+	body   map[string]any
+}
+
+// newRESTServer starts fake REST API, handler returns status and JSON response for each call
+func newRESTServer(t *testing.T, handler func(call restCall) (int, string)) (*restClient, func() []restCall) {
+	t.Helper()
+	username, password = "admin", "secret"
+
+	var mutex sync.Mutex
+	var calls []restCall
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		call := restCall{method: r.Method, path: strings.TrimPrefix(r.URL.Path, "/rest")}
+		raw, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(raw, &call.body); err != nil {
+			t.Errorf("%s %s: invalid body %q", r.Method, r.URL.Path, raw)
+		}
+		mutex.Lock()
+		calls = append(calls, call)
+		mutex.Unlock()
+
+		status, resp := handler(call)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(resp))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := &restClient{baseURL: srv.URL + "/rest", http: srv.Client()}
+	return c, func() []restCall {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return calls
+	}
+}
+
+func TestRESTAdd(t *testing.T) {
+	c, calls := newRESTServer(t, func(call restCall) (int, string) {
+		return http.StatusCreated, `{".id":"*1A","address":"192.0.2.1","list":"crowdsec"}`
+	})
+	r, err := c.RunArgs([]string{"/ip/firewall/address-list/add", "=list=crowdsec", "=address=192.0.2.1", "=timeout=4h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Done.Map[".id"] != "*1A" {
+		t.Errorf("reply = %v, want created item", r.Done.Map)
+	}
+	want := []restCall{{
+		method: http.MethodPut,
+		path:   "/ip/firewall/address-list",
+		body:   map[string]any{"list": "crowdsec", "address": "192.0.2.1", "timeout": "4h"},
+	}}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %+v, want %+v", got, want)
+	}
+}
+
+func TestRESTSetRuleNumber(t *testing.T) {
+	c, calls := newRESTServer(t, func(call restCall) (int, string) {
+		if call.method == http.MethodPost {
+			return http.StatusOK, `[{".id":"*5"},{".id":"*9"},{".id":"*C"}]`
+		}
+		return http.StatusOK, `{}`
+	})
+	_, err := c.RunArgs([]string{"/ip/firewall/filter/set", "=.id=1,2", "=src-address-list=crowdsec_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []restCall{
+		// rule numbers are resolved to item ids only once
+		{http.MethodPost, "/ip/firewall/filter/print", map[string]any{".proplist": []any{".id"}}},
+		{http.MethodPatch, "/ip/firewall/filter/*9", map[string]any{"src-address-list": "crowdsec_2"}},
+		{http.MethodPatch, "/ip/firewall/filter/*C", map[string]any{"src-address-list": "crowdsec_2"}},
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %+v, want %+v", got, want)
+	}
+
+	// rule number out of range is reported as missing item
+	_, err = c.RunArgs([]string{"/ip/firewall/filter/set", "=.id=7", "=src-address-list=crowdsec_2"})
+	if got := classifyError(err); got != errClassNotFound {
+		t.Errorf("error %v has class %s, want %s", err, got, errClassNotFound)
+	}
+}
+
+func TestRESTPrintQuery(t *testing.T) {
+	c, calls := newRESTServer(t, func(call restCall) (int, string) {
+		return http.StatusOK, `[{".id":"*1","address":"192.0.2.1","dynamic":true},{".id":"*2","address":"192.0.2.2","dynamic":true}]`
+	})
+	r, err := c.RunArgs([]string{"/ip/firewall/address-list/print", "=.proplist=.id,address", "?list=crowdsec_1", "?dynamic=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []restCall{{
+		method: http.MethodPost,
+		path:   "/ip/firewall/address-list/print",
+		body: map[string]any{
+			".proplist": []any{".id", "address"},
+			".query":    []any{"list=crowdsec_1", "dynamic=true"},
+		},
+	}}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %+v, want %+v", got, want)
+	}
+	if len(r.Re) != 2 || r.Re[1].Map["address"] != "192.0.2.2" || r.Re[1].Map["dynamic"] != "true" {
+		t.Errorf("reply rows = %v", r.Re)
+	}
+}
+
+func TestRESTCountOnly(t *testing.T) {
+	c, calls := newRESTServer(t, func(call restCall) (int, string) {
+		return http.StatusOK, `{"ret":"1234"}`
+	})
+	n, err := countAddressList(c, "ip", "crowdsec_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1234 {
+		t.Errorf("countAddressList() = %d, want 1234", n)
+	}
+	body := calls()[0].body
+	if body["count-only"] != "" || !reflect.DeepEqual(body[".query"], []any{"list=crowdsec_1"}) {
+		t.Errorf("count-only request body = %v", body)
+	}
+}
+
+func TestRESTErrorClass(t *testing.T) {
+	tests := []struct {
+		status int
+		resp   string
+		want   string
+	}{
+		{http.StatusBadRequest, `{"error":400,"message":"Bad Request","detail":"failure: already have such entry"}`, errClassExists},
+		{http.StatusNotFound, `{"error":404,"message":"Not Found","detail":"no such item"}`, errClassNotFound},
+		{http.StatusBadRequest, `{"error":400,"message":"Bad Request","detail":"expected end of command"}`, errClassDevice},
+		{http.StatusInternalServerError, `not json`, errClassDevice},
+	}
+	for _, tt := range tests {
+		c, _ := newRESTServer(t, func(call restCall) (int, string) {
+			return tt.status, tt.resp
+		})
+		_, err := c.RunArgs([]string{"/ip/firewall/address-list/add", "=list=crowdsec", "=address=192.0.2.1"})
+		if err == nil {
+			t.Fatalf("%d %s: no error", tt.status, tt.resp)
+		}
+		if got := classifyError(err); got != tt.want {
+			t.Errorf("%d %s: class = %s, want %s", tt.status, tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestRESTUnauthorized(t *testing.T) {
+	c, _ := newRESTServer(t, func(call restCall) (int, string) {
+		return http.StatusOK, `[]`
+	})
+	password = "wrong"
+	_, err := c.RunArgs([]string{"/system/identity/print"})
+	var restErr *restError
+	if err == nil || !errors.As(err, &restErr) || restErr.Status != http.StatusUnauthorized {
+		t.Errorf("error = %v, want 401 restError", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sync strategies, how addresses are added to the new address-list
+const (
+	syncStrategyAPI    = "api"    // add addresses one by one with api commands
+	syncStrategyScript = "script" // upload generated script and run it on the router
+)
+
+// scriptQuote returns value as RouterOS script string literal
+func scriptQuote(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// scriptHeader and scriptFooter wrap each generated script, failed lines are counted
+// and the script fails at the end if any of them failed, so that the run returns an error
+const (
+	scriptHeader = ":local errs 0\n"
+	scriptFooter = ":if ($errs > 0) do={ :error (\"failed to add \" . $errs . \" addresses\") }\n"
+)
+
+// buildScripts returns script sources adding cached addresses of given protocol to address-list,
+// split so that each source is not longer than mikrotik_script_chunk_size
+//
+// each line counts its own error instead of stopping the script, so that all addresses are tried,
+// and the script fails at the end if any of them could not be added
+func buildScripts(proto string, listName string, items map[string]*ttlcache.Item[string, cacheEntry], summary *syncSummary) ([]string, int) {
+	var scripts []string
+	var sb strings.Builder
+	entries := 0
+	for _, item := range items {
+		address := item.Key()
+		if getProtoCmd(address) != proto {
+			continue
+		}
+		ttl, ttlTruncated := addressTTL(proto, item.TTL())
+		summary.prepared(proto, item.TTL() == 0, ttlTruncated)
+		line := fmt.Sprintf(":do { /%s firewall address-list add list=%s address=%s comment=%s timeout=%s } on-error={ :set errs ($errs + 1) }\n",
+			proto, scriptQuote(listName), address, scriptQuote(item.Value().comment()), ttl)
+		if sb.Len() > 0 && sb.Len()+len(line)+len(scriptFooter) > scriptChunkSize {
+			sb.WriteString(scriptFooter)
+			scripts = append(scripts, sb.String())
+			sb.Reset()
+		}
+		if sb.Len() == 0 {
+			sb.WriteString(scriptHeader)
+		}
+		sb.WriteString(line)
+		entries++
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(scriptFooter)
+		scripts = append(scripts, sb.String())
+	}
+	return scripts, entries
+}
+
+// uploadScript fills new address-list by running generated scripts on the router, and verifies
+// that the address-list has exactly all the addresses afterwards, returns number of added addresses
+//
+// address-list must not exist before, so that its old entries do not hide missing ones,
+// that is why script strategy requires dynamic mikrotik_address_list_name_format
+//
+// scripts are removed from the router after they run, also when they fail
+func (mal *mikrotikAddrList) uploadScript(ctx context.Context, listName string, items map[string]*ttlcache.Item[string, cacheEntry]) (int, error) {
+	total := 0
+	for _, proto := range []string{"ip", "ipv6"} {
+		if (proto == "ip" && !useIPV4) || (proto == "ipv6" && !useIPV6) {
+			continue
+		}
+		mal.cleanupScripts(proto, scriptPrefix(listName))
+		if mal.c == nil {
+			return total, errMikrotikUnreachable
+		}
+
+		existing, err := countAddressList(mal.c, proto, listName)
+		if err == nil && existing > 0 {
+			err = fmt.Errorf("address-list %s already has %d %s entries before running scripts", listName, existing, proto)
+		}
+		if err != nil {
+			metricScriptVerify.WithLabelValues(proto, "error").Inc()
+			return total, err
+		}
+
+		scripts, entries := buildScripts(proto, listName, items, mal.summary)
+		_, span := tracer.Start(ctx, "uploadScript", trace.WithAttributes(
+			attribute.String("proto", proto),
+			attribute.Int("scripts", len(scripts)),
+			attribute.Int("entries", entries),
+		))
+		for i, source := range scripts {
+			if err := ctx.Err(); err != nil {
+				endSpan(span, err)
+				return total, err
+			}
+			name := fmt.Sprintf("%s%d", scriptPrefix(listName), i)
+			if err := mal.runScript(proto, name, source); err != nil {
+				mal.summary.result(proto, entries, err)
+				endSpan(span, err)
+				return total, err
+			}
+		}
+
+		// failed lines fail the script, unless device errors are ignored by mikrotik_error_policy
+		count, err := countAddressList(mal.c, proto, listName)
+		if err == nil && count != entries {
+			err = fmt.Errorf("address-list %s has %d %s entries after running scripts, expected %d", listName, count, proto, entries)
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("func", "uploadScript").
+				Str("proto", proto).
+				Str("list_name", listName).
+				Msg("Address-list verification failed, firewall rules will not be updated")
+			metricScriptVerify.WithLabelValues(proto, "error").Inc()
+			mal.summary.result(proto, entries, err)
+			endSpan(span, err)
+			return total, err
+		}
+		metricScriptVerify.WithLabelValues(proto, "success").Inc()
+		mal.summary.result(proto, entries, nil)
+		span.End()
+		if mal.progress != nil {
+			mal.progress.Add(float64(entries))
+		}
+
+		log.Info().
+			Str("func", "uploadScript").
+			Str("proto", proto).
+			Str("list_name", listName).
+			Int("scripts", len(scripts)).
+			Int("entries", entries).
+			Msg("Addresses added to mikrotik with scripts successfully")
+		total += entries
+	}
+	return total, nil
+}
+
+// runScript adds script with given name and source to the router, runs it and removes it
+func (mal *mikrotikAddrList) runScript(proto string, name string, source string) error {
+	log.Debug().
+		Str("func", "runScript").
+		Str("name", name).
+		Int("size", len(source)).
+		Msg("Uploading script to mikrotik")
+
+	err := mal.runCmd(proto, "script", "add", []string{"/system/script/add", "=name=" + name, "=source=" + source})
+	if err != nil {
+		return fmt.Errorf("failed to upload script %s: %w", name, err)
+	}
+	defer func() {
+		if mal.c == nil {
+			// connection was dropped, leftover script is removed by cleanupScripts in the next update
+			return
+		}
+		if err := mal.runCmd(proto, "script", "remove", []string{"/system/script/remove", "=numbers=" + name}); err != nil {
+			log.Warn().
+				Err(err).
+				Str("func", "runScript").
+				Str("name", name).
+				Msg("Failed to remove script from mikrotik")
+		}
+	}()
+
+	runStart := time.Now()
+	err = mal.runCmd(proto, "script", "run", []string{"/system/script/run", "=number=" + name})
+	metricScriptRunDuration.WithLabelValues(proto).Observe(time.Since(runStart).Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to run script %s: %w", name, err)
+	}
+	return nil
+}
+
+// scriptPrefix returns name prefix of scripts filling given address-list
+func scriptPrefix(listName string) string {
+	return bouncerType + "-" + listName + "-"
+}
+
+// cleanupScripts removes scripts with given name prefix left on the router by previous updates
+// which were interrupted, proto is used as metric label only
+func (mal *mikrotikAddrList) cleanupScripts(proto string, namePrefix string) {
+	r, err := mal.runCmdReply(proto, "script", "print", []string{"/system/script/print", "=.proplist=.id,name"})
+	if err != nil || r == nil {
+		log.Warn().
+			Err(err).
+			Str("func", "cleanupScripts").
+			Msg("Failed to list scripts on mikrotik")
+		return
+	}
+	for _, re := range r.Re {
+		name := re.Map["name"]
+		if !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+		log.Info().
+			Str("func", "cleanupScripts").
+			Str("name", name).
+			Msg("Removing leftover script from mikrotik")
+		if err := mal.runCmd(proto, "script", "remove", []string{"/system/script/remove", "=.id=" + re.Map[".id"]}); err != nil {
+			log.Warn().
+				Err(err).
+				Str("func", "cleanupScripts").
+				Str("name", name).
+				Msg("Failed to remove script from mikrotik")
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+func TestScriptQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"crowdsec", `"crowdsec"`},
+		{"", `""`},
+		{"crowdsec crowdsecurity/ssh-bf Ip", `"crowdsec crowdsecurity/ssh-bf Ip"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"$var", `"\$var"`},
+		{"$(:put 1)", `"\$(:put 1)"`},
+		{"line\nbreak\r", `"line\nbreak\r"`},
+		{`\"`, `"\\\""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := scriptQuote(tt.value); got != tt.want {
+				t.Errorf("scriptQuote(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildScripts(t *testing.T) {
+	useSettings(t, &settings{})
+	updateFreq = time.Hour
+	scriptChunkSize = 1024
+
+	cache := ttlcache.New[string, cacheEntry]()
+	comment := cacheEntry{"crowdsec", `crowdsecurity/"quoted"`, "Ip"}
+	for i := range 50 {
+		cache.Set(fmt.Sprintf("10.0.0.%d", i), comment, time.Hour)
+	}
+	cache.Set("2001:db8::1", comment, time.Hour)
+	// cache has no default ttl, so the address never expires, like ban without duration
+	cache.Set("10.1.0.0/16", comment, ttlcache.DefaultTTL)
+
+	summary := newSyncSummary()
+	scripts, entries := buildScripts("ip", "crowdsec_list", cache.Items(), summary)
+	if entries != 51 {
+		t.Fatalf("entries = %d, want 51", entries)
+	}
+	if len(scripts) < 2 {
+		t.Fatalf("got %d scripts, want addresses split into multiple scripts", len(scripts))
+	}
+
+	seen := map[string]int{}
+	for i, source := range scripts {
+		if len(source) > scriptChunkSize {
+			t.Errorf("script %d has %d bytes, more than %d", i, len(source), scriptChunkSize)
+		}
+		if !strings.HasPrefix(source, scriptHeader) || !strings.HasSuffix(source, scriptFooter) {
+			t.Errorf("script %d does not count errors:\n%s", i, source)
+		}
+		lines := strings.Split(strings.TrimSuffix(strings.TrimPrefix(source, scriptHeader), scriptFooter), "\n")
+		for _, line := range lines {
+			if line == "" {
+				continue
+			}
+			if !strings.HasPrefix(line, ":do { /ip firewall address-list add list=\"crowdsec_list\" ") ||
+				!strings.HasSuffix(line, "on-error={ :set errs ($errs + 1) }") {
+				t.Errorf("unexpected line: %s", line)
+			}
+			if !strings.Contains(line, `comment="crowdsec crowdsecurity/\"quoted\" Ip"`) {
+				t.Errorf("comment is not quoted: %s", line)
+			}
+			address := strings.Fields(strings.SplitAfter(line, "address=")[1])[0]
+			seen[address]++
+		}
+	}
+	if len(seen) != 51 {
+		t.Errorf("scripts add %d addresses, want 51", len(seen))
+	}
+	for address, n := range seen {
+		if n != 1 {
+			t.Errorf("address %s added %d times", address, n)
+		}
+		if strings.Contains(address, ":") {
+			t.Errorf("IPv6 address %s in ip script", address)
+		}
+	}
+
+	if got := summary.families["ip"].permanent.Load(); got != 1 {
+		t.Errorf("permanent addresses in summary = %d, want 1", got)
+	}
+
+	scripts, entries = buildScripts("ipv6", "crowdsec_list", cache.Items(), nil)
+	if entries != 1 || len(scripts) != 1 || !strings.Contains(scripts[0], "/ipv6 firewall address-list add") {
+		t.Errorf("ipv6 scripts = %q, entries = %d", scripts, entries)
+	}
+
+	scripts, entries = buildScripts("ip", "crowdsec_list", nil, nil)
+	if entries != 0 || len(scripts) != 0 {
+		t.Errorf("empty cache gave %d scripts with %d entries", len(scripts), entries)
+	}
+}
+
+func TestUploadScript(t *testing.T) {
+	useSettings(t, &settings{})
+	useIPV4, useIPV6 = true, false
+	updateFreq = time.Hour
+	scriptChunkSize = 1024
+	errRetries = 0
+
+	cache := ttlcache.New[string, cacheEntry]()
+	for i := range 30 {
+		cache.Set(fmt.Sprintf("192.0.2.%d", i), cacheEntry{"crowdsec", "crowdsecurity/ssh-bf", "Ip"}, time.Hour)
+	}
+
+	tests := []struct {
+		name      string
+		before    int    // entries in address-list reported before scripts run
+		count     int    // entries in address-list reported after scripts run
+		runTrap   string // error of the script run
+		wantErr   string
+		wantTotal int
+	}{
+		{"verified", 0, 30, "", "", 30},
+		{"list not fresh", 5, 35, "", "already has 5 ip entries before running scripts", 0},
+		{"unexpected entries", 0, 31, "", "has 31 ip entries after running scripts, expected 30", 0},
+		{"missing entries", 0, 29, "", "has 29 ip entries after running scripts, expected 30", 0},
+		{"script fails", 0, 30, "interrupted", "failed to run script", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			fr := &fakeRouter{
+				reply: func(words []string) ([]map[string]string, string) {
+					switch words[0] {
+					case "/system/script/print":
+						return []map[string]string{
+							{".id": "*1", "name": bouncerType + "-crowdsec_new-0"},
+							{".id": "*2", "name": "backup"},
+							// script of other shard, which runs in parallel
+							{".id": "*3", "name": bouncerType + "-crowdsec_new_1-0"},
+						}, ""
+					case "/system/script/run":
+						ran = true
+						return nil, tt.runTrap
+					}
+					return nil, ""
+				},
+				done: func(words []string) map[string]string {
+					if slices.Contains(words, "=count-only=") {
+						if !ran {
+							return map[string]string{"ret": fmt.Sprint(tt.before)}
+						}
+						return map[string]string{"ret": fmt.Sprint(tt.count)}
+					}
+					return nil
+				},
+			}
+			mal := connectedAddrList(t, fr)
+			labels := map[string]string{"proto": "ip", "result": "error"}
+			failedBefore := metricValue(t, "cs_mikrotik_bouncer_script_verify_total", labels)
+
+			total, err := mal.uploadScript(context.Background(), "crowdsec_new", cache.Items())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("uploadScript() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("uploadScript() error = %v, want %q", err, tt.wantErr)
+			}
+			if total != tt.wantTotal {
+				t.Errorf("uploadScript() = %d, want %d", total, tt.wantTotal)
+			}
+
+			failed := metricValue(t, "cs_mikrotik_bouncer_script_verify_total", labels) - failedBefore
+			if want := map[bool]float64{true: 1}[tt.runTrap == "" && tt.wantErr != ""]; failed != want {
+				t.Errorf("failed verifications increased by %v, want %v", failed, want)
+			}
+
+			var added, removed []string
+			for _, command := range fr.received() {
+				switch {
+				case strings.HasPrefix(command, "/system/script/add =name="):
+					added = append(added, strings.Fields(command)[1])
+				case strings.HasPrefix(command, "/system/script/remove"):
+					removed = append(removed, strings.Fields(command)[1])
+				}
+			}
+			// leftover of interrupted update of the same address-list is removed, other scripts are kept
+			if len(removed) == 0 || removed[0] != "=.id=*1" || slices.Contains(removed, "=.id=*3") {
+				t.Errorf("removed scripts %q, want leftover *1 first and script of other shard kept", removed)
+			}
+			if (tt.before == 0 && len(added) == 0) || len(removed) != len(added)+1 {
+				t.Errorf("added scripts %q, removed %q, want every uploaded script removed", added, removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// httpServer hosts metrics, health and debug endpoints on metrics_address
+type httpServer struct {
+	srv *http.Server
+	mux *http.ServeMux
+}
+
+func newHTTPServer() *httpServer {
+	mux := http.NewServeMux()
+	s := &httpServer{
+		mux: mux,
+		srv: &http.Server{
+			Addr:              metricsAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: metricsReadTimeout,
+			ReadTimeout:       metricsReadTimeout,
+			WriteTimeout:      metricsWriteTimeout,
+		},
+	}
+
+	s.handle("/metrics", promhttp.Handler())
+
+	// liveness probe, not protected so that it can be used by container runtime
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	// readiness probe, ready when the last preflight did not fail,
+	// followers do not talk to the router so they are always ready
+	s.mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := lastPreflight.Load()
+		switch {
+		case !preflightEnable || !isLeader():
+		case report == nil:
+			http.Error(w, "preflight did not run yet", http.StatusServiceUnavailable)
+			return
+		case !report.Ready:
+			http.Error(w, "preflight failed, see /preflight", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	// report of the last preflight
+	s.handle("/preflight", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := lastPreflight.Load()
+		if report == nil {
+			http.Error(w, "preflight did not run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	}))
+
+	if metricsPprof {
+		s.handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+		s.handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		s.handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		s.handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		s.handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	}
+	return s
+}
+
+// handle registers handler protected with configured authorization
+func (s *httpServer) handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, withAuth(handler))
+}
+
+// withAuth wraps handler with basic auth or bearer token check, if any of them is configured
+//
+// if both are configured then any of them is accepted
+func withAuth(next http.Handler) http.Handler {
+	if metricsBearerToken == "" && metricsBasicAuthUser == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if metricsBearerToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(token), []byte(metricsBearerToken)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if metricsBasicAuthUser != "" {
+			user, pass, ok := r.BasicAuth()
+			if ok &&
+				subtle.ConstantTimeCompare([]byte(user), []byte(metricsBasicAuthUser)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(pass), []byte(metricsBasicAuthPass)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		}
+		metricHTTPUnauthorized.Inc()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// start starts listening in the background, failure to listen is fatal
+func (s *httpServer) start() {
+	go func() {
+		var err error
+		if metricsTLSCertFile != "" {
+			err = s.srv.ListenAndServeTLS(metricsTLSCertFile, metricsTLSKeyFile)
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().
+				Err(err).
+				Str("func", "httpServer").
+				Str("metrics_address", metricsAddr).
+				Msg("Failed to start metrics server on desired address")
+		}
+	}()
+	log.Info().
+		Str("func", "httpServer").
+		Str("metrics_address", metricsAddr).
+		Bool("tls", metricsTLSCertFile != "").
+		Bool("pprof", metricsPprof).
+		Msg("Metrics server started")
+}
+
+// shutdown stops the server gracefully, waiting for active requests to finish
+func (s *httpServer) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	log.Info().
+		Str("func", "httpServer").
+		Msg("Shutting down metrics server")
+	return s.srv.Shutdown(ctx)
+}
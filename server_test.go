@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		name        string
+		token, user string
+		req         func(r *http.Request)
+		want        int
+	}{
+		{"no auth configured", "", "", func(r *http.Request) {}, http.StatusOK},
+		{"bearer valid", "secret", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"bearer invalid", "secret", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"bearer missing", "secret", "", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic valid", "", "admin", func(r *http.Request) { r.SetBasicAuth("admin", "pass") }, http.StatusOK},
+		{"basic invalid password", "", "admin", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"both, bearer used", "secret", "admin", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"both, basic used", "secret", "admin", func(r *http.Request) { r.SetBasicAuth("admin", "pass") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metricsBearerToken, metricsBasicAuthUser, metricsBasicAuthPass = tt.token, tt.user, "pass"
+			before := metricValue(t, "cs_mikrotik_bouncer_http_unauthorized_total", nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			tt.req(req)
+			rec := httptest.NewRecorder()
+			withAuth(ok).ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			rejected := metricValue(t, "cs_mikrotik_bouncer_http_unauthorized_total", nil) - before
+			if want := map[bool]float64{true: 1}[tt.want == http.StatusUnauthorized]; rejected != want {
+				t.Errorf("http_unauthorized_total increased by %v, want %v", rejected, want)
+			}
+			if tt.want == http.StatusUnauthorized && tt.user != "" && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header is missing")
+			}
+		})
+	}
+}
+
+func TestServerPprof(t *testing.T) {
+	metricsBearerToken, metricsBasicAuthUser = "secret", ""
+	for _, enabled := range []bool{false, true} {
+		metricsPprof = enabled
+		s := newHTTPServer()
+
+		// health check is never protected
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("pprof=%v: /healthz status = %d, want 200", enabled, rec.Code)
+		}
+
+		want := map[bool]int{false: http.StatusNotFound, true: http.StatusOK}[enabled]
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec = httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("pprof=%v: /debug/pprof/ status = %d, want %d", enabled, rec.Code, want)
+		}
+
+		if enabled {
+			rec = httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("/debug/pprof/ without credentials status = %d, want 401", rec.Code)
+			}
+		}
+	}
+}
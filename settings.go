@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// settings can be changed without restart, see reloadConfig,
+// they are replaced as a whole so readers always see consistent values
+type settings struct {
+	logLevel zerolog.Level
+
+	logSampleRate int            // log only every n-th per-address and per-decision message
+	detailLog     zerolog.Logger // logger for per-address and per-decision messages, sampled by logSampleRate
+
+	// default time for items without TTL,
+	// this is required to allow automatic list expiry, if unsure set it to 1d
+	defaultTTL time.Duration
+
+	// default time for items with TTL, this is used to truncate incoming TTL
+	// to specific value to prevent of address-list with addresses
+	// which would expire after few days
+	// default 24h
+	// we assume that we get updates from crowdsec at least once per hour
+	// so 1 day seems reasonable for now
+	maxTTL time.Duration
+
+	// set to true if you want to use maxTTL
+	useMaxTTL bool
+
+	listNameFormat string // "static" or "dynamic" option for Addresslist name
+
+	banRules  []firewallRule            // firewall rules of ban address-list, for enabled protocols and tables
+	typeRules map[string][]firewallRule // decision type -> firewall rules of its address-list
+
+	permanentRules []firewallRule // firewall rules of permanent_list
+}
+
+// live holds current settings
+var live atomic.Pointer[settings]
+
+// loadSettings reads and validates settings which can be reloaded,
+// it must not have side effects, so that invalid settings can be rejected
+func loadSettings() (*settings, error) {
+	s := &settings{}
+	var err error
+
+	viper.BindEnv("log_level") //nolint:errcheck
+	viper.SetDefault("log_level", "1")
+	s.logLevel, err = zerolog.ParseLevel(viper.GetString("log_level"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log_level: %w", err)
+	}
+
+	viper.BindEnv("log_sample_rate") //nolint:errcheck
+	viper.SetDefault("log_sample_rate", "1")
+	s.logSampleRate = viper.GetInt("log_sample_rate")
+	if s.logSampleRate < 1 {
+		return nil, fmt.Errorf("invalid log_sample_rate '%s', must be 1 or more", viper.GetString("log_sample_rate"))
+	}
+	s.detailLog = log.Logger
+	if s.logSampleRate > 1 {
+		s.detailLog = log.Logger.Sample(&zerolog.BasicSampler{N: uint32(s.logSampleRate)})
+	}
+
+	viper.BindEnv("mikrotik_address_list_name_format") //nolint:errcheck
+	viper.SetDefault("mikrotik_address_list_name_format", "dynamic")
+	s.listNameFormat = viper.GetString("mikrotik_address_list_name_format")
+	if s.listNameFormat != "static" && s.listNameFormat != "dynamic" {
+		return nil, fmt.Errorf("mikrotik_address_list_name_format must be 'static' or 'dynamic'")
+	}
+	if s.listNameFormat == "static" && syncStrategy == syncStrategyScript {
+		return nil, fmt.Errorf("mikrotik_sync_strategy '%s' requires 'dynamic' mikrotik_address_list_name_format", syncStrategyScript)
+	}
+
+	add := func(proto, mode, where string) error {
+		name := fmt.Sprintf("%s_firewall_%s_rules_%s", proto, mode, where)
+		ids, err := cfgValidateFirewall(name)
+		if err != nil {
+			return err
+		}
+		s.banRules = append(s.banRules, firewallRule{proto: proto, mode: mode, where: where, ids: ids})
+		return nil
+	}
+	for _, proto := range []string{"ip", "ipv6"} {
+		if (proto == "ip" && !useIPV4) || (proto == "ipv6" && !useIPV6) {
+			continue
+		}
+		for _, mode := range []string{"filter", "raw"} {
+			if (mode == "filter" && !enableFirewallFilter) || (mode == "raw" && !enableFirewallRaw) {
+				continue
+			}
+			for _, where := range []string{"src", "dst"} {
+				if err := add(proto, mode, where); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	viper.BindEnv("decision_type_rules") //nolint:errcheck
+	viper.SetDefault("decision_type_rules", nil)
+	s.typeRules, err = parseTypeRules(viper.GetStringSlice("decision_type_rules"), typedLists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decision_type_rules: %w", err)
+	}
+
+	viper.BindEnv("permanent_list_rules") //nolint:errcheck
+	viper.SetDefault("permanent_list_rules", nil)
+	s.permanentRules, err = parseRules(viper.GetStringSlice("permanent_list_rules"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse permanent_list_rules: %w", err)
+	}
+	if len(s.permanentRules) > 0 && permanentList == "" {
+		return nil, fmt.Errorf("permanent_list_rules require permanent_list")
+	}
+
+	// permanent_list is not sharded, so its rules are not validated here
+	if mikrotikShards > 1 {
+		for _, rule := range s.banRules {
+			setting := fmt.Sprintf("%s_firewall_%s_rules_%s", rule.proto, rule.mode, rule.where)
+			if err := validateShardRules(setting, []firewallRule{rule}, mikrotikShards); err != nil {
+				return nil, fmt.Errorf("each firewall rule setting must have ids for every shard: %w", err)
+			}
+		}
+		for decisionType, typeRules := range s.typeRules {
+			setting := fmt.Sprintf("decision_type_rules of type %s", decisionType)
+			if err := validateShardRules(setting, typeRules, mikrotikShards); err != nil {
+				return nil, fmt.Errorf("each firewall rule setting must have ids for every shard: %w", err)
+			}
+		}
+	}
+
+	viper.BindEnv("default_ttl") //nolint:errcheck
+	viper.SetDefault("default_ttl", "3h")
+	s.defaultTTL = viper.GetDuration("default_ttl")
+
+	viper.BindEnv("use_max_ttl") //nolint:errcheck
+	viper.SetDefault("use_max_ttl", "false")
+	s.useMaxTTL = viper.GetBool("use_max_ttl")
+
+	viper.BindEnv("default_ttl_max") //nolint:errcheck
+	viper.SetDefault("default_ttl_max", "4h")
+	s.maxTTL = viper.GetDuration("default_ttl_max")
+	if s.maxTTL < updateFreq {
+		return nil, fmt.Errorf("default_ttl_max %s can not be shorter than mikrotik_update_frequency %s", s.maxTTL, updateFreq)
+	}
+	return s, nil
+}
+
+// changes returns names of settings which differ between s and other
+func (s *settings) changes(other *settings) []string {
+	var changed []string
+	if s.logLevel != other.logLevel {
+		changed = append(changed, "log_level")
+	}
+	if s.logSampleRate != other.logSampleRate {
+		changed = append(changed, "log_sample_rate")
+	}
+	if s.defaultTTL != other.defaultTTL {
+		changed = append(changed, "default_ttl")
+	}
+	if s.maxTTL != other.maxTTL {
+		changed = append(changed, "default_ttl_max")
+	}
+	if s.useMaxTTL != other.useMaxTTL {
+		changed = append(changed, "use_max_ttl")
+	}
+	if s.listNameFormat != other.listNameFormat {
+		changed = append(changed, "mikrotik_address_list_name_format")
+	}
+	if !slices.Equal(s.banRules, other.banRules) {
+		changed = append(changed, "firewall_rules")
+	}
+	for decisionType := range typedLists {
+		if !slices.Equal(s.typeRules[decisionType], other.typeRules[decisionType]) {
+			changed = append(changed, "decision_type_rules")
+			break
+		}
+	}
+	if !slices.Equal(s.permanentRules, other.permanentRules) {
+		changed = append(changed, "permanent_list_rules")
+	}
+	return changed
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// shardOf returns shard number for address, the same address always goes to the same shard
+func shardOf(address string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(address))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// splitShards splits cached items into shards by address hash
+func splitShards(items map[string]*ttlcache.Item[string, cacheEntry], shards int) []map[string]*ttlcache.Item[string, cacheEntry] {
+	split := make([]map[string]*ttlcache.Item[string, cacheEntry], shards)
+	for i := range split {
+		split[i] = map[string]*ttlcache.Item[string, cacheEntry]{}
+	}
+	for address, item := range items {
+		split[shardOf(address, shards)][address] = item
+	}
+	return split
+}
+
+// shardRuleIds returns firewall rule ids which use given shard,
+// ids are assigned to shards in turns, so for 2 shards '8,9,20,21' gives '8,20' for shard 0 and '9,21' for shard 1
+func shardRuleIds(ids string, shard int, shards int) string {
+	var picked []string
+	for i, id := range strings.Split(ids, ",") {
+		if i%shards == shard {
+			picked = append(picked, id)
+		}
+	}
+	return strings.Join(picked, ",")
+}
+
+// validateShardRules checks that each firewall rule config has ids for every shard,
+// setting names the config option of the rules in the error
+func validateShardRules(setting string, rules []firewallRule, shards int) error {
+	for _, rule := range rules {
+		n := len(strings.Split(rule.ids, ","))
+		if n%shards != 0 {
+			return fmt.Errorf("%s: %s %s %s rules '%s' has %d ids, expected multiple of %d mikrotik_shards",
+				setting, rule.proto, rule.mode, rule.where, rule.ids, n, shards)
+		}
+	}
+	return nil
+}
+
+// syncShards splits cached addresses into mikrotik_shards address-lists, named <prefix>_<shard>,
+// fills them in parallel, each over its own session, and then updates firewall rules of each shard
+//
+// every shard opens additional session for the time of the update, the main connection
+// is used only to update firewall rules, so that it is never shared between goroutines
+func (mal *mikrotikAddrList) syncShards(ctx context.Context, prefix string, cache *ttlcache.Cache[string, cacheEntry], rules []firewallRule) (bool, error) {
+	ctx, span := tracer.Start(ctx, "syncShards", trace.WithAttributes(
+		attribute.String("list.prefix", prefix),
+		attribute.Int("shards", mikrotikShards),
+	))
+	defer span.End()
+
+	insertStart := time.Now()
+	shards := splitShards(cache.Items(), mikrotikShards)
+	listNames := make([]string, mikrotikShards)
+	for i := range listNames {
+		listNames[i] = getListName(fmt.Sprintf("%s_%d", prefix, i))
+	}
+
+	// open all sessions before filling starts, so that failure does not leave shards half filled
+	summary := newSyncSummary()
+	sessions := make([]*mikrotikAddrList, 0, mikrotikShards)
+	for i := range shards {
+		c, err := mikrotikConnect()
+		if err != nil {
+			for _, session := range sessions {
+				session.conn.disconnect()
+			}
+			err = fmt.Errorf("failed to open session for shard %d: %w", i, err)
+			endSpan(span, err)
+			return false, err
+		}
+		progress := metricShardProgress.WithLabelValues(prefix, strconv.Itoa(i))
+		progress.Set(0)
+		sessions = append(sessions, &mikrotikAddrList{c: c, conn: newSessionConnection(c), progress: progress, summary: summary})
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for i, items := range shards {
+		shard := strconv.Itoa(i)
+		metricShardEntries.WithLabelValues(prefix, shard).Set(float64(len(items)))
+		session := sessions[i]
+
+		g.Go(func() error {
+			defer session.conn.disconnect()
+			sctx, shardSpan := tracer.Start(gctx, "fillShard", trace.WithAttributes(
+				attribute.Int("shard", i),
+				attribute.String("list.name", listNames[i]),
+				attribute.Int("list.entries", len(items)),
+			))
+			shardStart := time.Now()
+			_, err := session.fillList(sctx, listNames[i], items)
+			endSpan(shardSpan, err)
+			metricShardInsertDuration.WithLabelValues(prefix, shard).Observe(time.Since(shardStart).Seconds())
+			if err != nil {
+				return fmt.Errorf("shard %d: %w", i, err)
+			}
+			log.Info().
+				Str("func", "syncShards").
+				Str("list_name", listNames[i]).
+				Int("entries", len(items)).
+				Str("duration", time.Since(shardStart).String()).
+				Msg("Shard filled successfully")
+			return nil
+		})
+	}
+	err := g.Wait()
+	summary.log(prefix, strings.Join(listNames, ","), err)
+	if err != nil {
+		endSpan(span, err)
+		return false, err
+	}
+
+	entries := 0
+	for i, items := range shards {
+		entries += len(items)
+		audit.pushedToList(prefix, listNames[i], items)
+		mal.currentLists.Store(fmt.Sprintf("%s_%d", prefix, i), listNames[i])
+	}
+	span.SetAttributes(attribute.Int("list.entries", entries))
+	metricInsertDuration.WithLabelValues(prefix).Observe(time.Since(insertStart).Seconds())
+	metricLastSyncEntries.WithLabelValues(prefix).Set(float64(entries))
+
+	firewallOK := true
+	for i, listName := range listNames {
+		var shardRules []firewallRule
+		for _, rule := range rules {
+			rule.ids = shardRuleIds(rule.ids, i, mikrotikShards)
+			shardRules = append(shardRules, rule)
+		}
+		firewallOK = mal.updateFirewall(ctx, listName, shardRules) && firewallOK
+	}
+	return firewallOK, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+func TestShardRuleIds(t *testing.T) {
+	tests := []struct {
+		ids    string
+		shard  int
+		shards int
+		want   string
+	}{
+		{"8,9,20,21", 0, 2, "8,20"},
+		{"8,9,20,21", 1, 2, "9,21"},
+		{"3", 0, 1, "3"},
+		{"1,2,3", 0, 1, "1,2,3"},
+		{"1,2,3,4,5,6", 0, 3, "1,4"},
+		{"1,2,3,4,5,6", 1, 3, "2,5"},
+		{"1,2,3,4,5,6", 2, 3, "3,6"},
+		{"5,6", 1, 2, "6"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d/%d", tt.ids, tt.shard, tt.shards), func(t *testing.T) {
+			if got := shardRuleIds(tt.ids, tt.shard, tt.shards); got != tt.want {
+				t.Errorf("shardRuleIds() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardRuleIdsCoverAll(t *testing.T) {
+	// every id goes to exactly one shard
+	ids := "10,11,12,13,14,15,16,17"
+	seen := map[string]int{}
+	for shard := range 4 {
+		for id := range strings.SplitSeq(shardRuleIds(ids, shard, 4), ",") {
+			seen[id]++
+		}
+	}
+	for id := range strings.SplitSeq(ids, ",") {
+		if seen[id] != 1 {
+			t.Errorf("id %s assigned to %d shards", id, seen[id])
+		}
+	}
+}
+
+func TestValidateShardRules(t *testing.T) {
+	rule := func(ids string) firewallRule {
+		return firewallRule{proto: "ip", mode: "filter", where: "src", ids: ids}
+	}
+	tests := []struct {
+		name    string
+		rules   []firewallRule
+		shards  int
+		wantErr bool
+	}{
+		{"single shard", []firewallRule{rule("1"), rule("1,2,3")}, 1, false},
+		{"multiple of shards", []firewallRule{rule("1,2"), rule("1,2,3,4")}, 2, false},
+		{"too few ids", []firewallRule{rule("1")}, 2, true},
+		{"not multiple", []firewallRule{rule("1,2"), rule("1,2,3")}, 2, true},
+		{"no rules", nil, 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateShardRules("ip_firewall_filter_rules_src", tt.rules, tt.shards)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateShardRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "ip_firewall_filter_rules_src") {
+				t.Errorf("error %q does not name the setting", err)
+			}
+		})
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	counts := make([]int, 4)
+	for i := range 1000 {
+		address := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		shard := shardOf(address, 4)
+		if shard != shardOf(address, 4) {
+			t.Fatalf("shardOf(%s) is not stable", address)
+		}
+		counts[shard]++
+	}
+	for shard, n := range counts {
+		if n == 0 {
+			t.Errorf("shard %d got no addresses", shard)
+		}
+	}
+}
+
+// scriptRouter keeps scripts and address-list sizes of fake router, so that parallel shard sessions
+// see scripts of each other
+type scriptRouter struct {
+	mutex   sync.Mutex
+	prints  int
+	added   chan struct{} // closed when the first script is added
+	first   string        // address-list of the first added script
+	listed  chan struct{} // closed when other session finished cleanup and counts its address-list
+	once    sync.Once
+	nextId  int
+	scripts map[string]string // .id -> name
+	sources map[string]string // name -> source
+	lists   map[string]int    // address-list -> entries
+	removed map[string]int    // script name -> times removed
+}
+
+func newScriptRouter(leftover string) *scriptRouter {
+	return &scriptRouter{
+		added:   make(chan struct{}),
+		listed:  make(chan struct{}),
+		scripts: map[string]string{"*L": leftover},
+		sources: map[string]string{},
+		lists:   map[string]int{},
+		removed: map[string]int{},
+	}
+}
+
+func (sr *scriptRouter) reply(words []string) ([]map[string]string, string) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if words[0] == "/system/script/print" {
+		// the first listing is the cleanup before sessions start, the second one is of the first session,
+		// next sessions list scripts only after the first session added its script, and before it runs
+		sr.prints++
+		if sr.prints > 2 {
+			sr.mutex.Unlock()
+			select {
+			case <-sr.added:
+			case <-time.After(2 * time.Second):
+			}
+			sr.mutex.Lock()
+		}
+	}
+	args := map[string]string{}
+	for _, word := range words[1:] {
+		if k, v, ok := strings.Cut(strings.TrimPrefix(word, "="), "="); ok {
+			args[k] = v
+		}
+	}
+	switch words[0] {
+	case "/system/script/print":
+		var rows []map[string]string
+		for id, name := range sr.scripts {
+			rows = append(rows, map[string]string{".id": id, "name": name})
+		}
+		return rows, ""
+	case "/system/script/add":
+		sr.nextId++
+		sr.scripts[fmt.Sprintf("*%d", sr.nextId)] = args["name"]
+		sr.sources[args["name"]] = args["source"]
+		if sr.nextId == 1 {
+			sr.first = scriptList(args["source"])
+			close(sr.added)
+		}
+	case "/ip/firewall/address-list/print":
+		if list := strings.TrimPrefix(words[2], "?list="); sr.first != "" && list != sr.first {
+			sr.once.Do(func() { close(sr.listed) })
+		}
+	case "/system/script/run":
+		// the first session runs its script only after other session finished its cleanup
+		sr.mutex.Unlock()
+		select {
+		case <-sr.listed:
+		case <-time.After(2 * time.Second):
+		}
+		sr.mutex.Lock()
+		if !slices.Contains(slices.Collect(maps.Values(sr.scripts)), args["number"]) {
+			return nil, "no such script"
+		}
+		source := sr.sources[args["number"]]
+		sr.lists[scriptList(source)] += strings.Count(source, "address-list add")
+	case "/system/script/remove":
+		for id, name := range sr.scripts {
+			if id == args[".id"] || name == args["numbers"] {
+				delete(sr.scripts, id)
+				sr.removed[name]++
+				return nil, ""
+			}
+		}
+		return nil, "no such item"
+	}
+	return nil, ""
+}
+
+// scriptList returns name of address-list filled by script source
+func scriptList(source string) string {
+	return strings.Split(strings.SplitAfter(source, `list="`)[1], `"`)[0]
+}
+
+func (sr *scriptRouter) done(words []string) map[string]string {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if len(words) == 3 && words[1] == "=count-only=" {
+		return map[string]string{"ret": strconv.Itoa(sr.lists[strings.TrimPrefix(words[2], "?list=")])}
+	}
+	return nil
+}
+
+func TestSyncShardsScripts(t *testing.T) {
+	useSettings(t, &settings{listNameFormat: "dynamic"})
+	useIPV4, useIPV6 = true, false
+	updateFreq = time.Hour
+	scriptChunkSize = 512
+	errRetries = 0
+	syncStrategy = syncStrategyScript
+	mikrotikShards = 2
+	t.Cleanup(func() {
+		syncStrategy = syncStrategyAPI
+		mikrotikShards = 1
+	})
+
+	leftover := bouncerType + "-crowdsec_0_2000-01-01_00-00-00-0"
+	sr := newScriptRouter(leftover)
+	fr := &fakeRouter{reply: sr.reply, done: sr.done}
+
+	// shard sessions dial the router
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	mikrotikTransport, useTLS, mikrotikHost, timeout = transportAPI, false, ln.Addr().String(), time.Second
+
+	cache := ttlcache.New[string, cacheEntry]()
+	for i := range 100 {
+		cache.Set(fmt.Sprintf("192.0.2.%d", i), cacheEntry{"crowdsec", "crowdsecurity/ssh-bf", "Ip"}, time.Hour)
+	}
+	mal := connectedAddrList(t, fr)
+	if _, err := mal.syncList(context.Background(), "crowdsec", cache, nil); err != nil {
+		t.Fatalf("syncList() error = %v", err)
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if len(sr.scripts) != 0 {
+		t.Errorf("scripts left on the router: %v", sr.scripts)
+	}
+	// every script is removed once, a script removed by other session would fail to be removed by its own
+	for name, n := range sr.removed {
+		if n != 1 {
+			t.Errorf("script %s removed %d times", name, n)
+		}
+	}
+	if sr.removed[leftover] != 1 {
+		t.Errorf("leftover script removed %d times, want 1", sr.removed[leftover])
+	}
+	entries := 0
+	for _, n := range sr.lists {
+		entries += n
+	}
+	if len(sr.lists) != 2 || entries != 100 {
+		t.Errorf("address-lists = %v, want 100 entries in 2 shards", sr.lists)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// countAddressList returns number of entries in given address-list on the MikroTik
+func countAddressList(c mikrotikClient, proto string, listName string) (int, error) {
+	r, err := c.RunArgs([]string{
+		fmt.Sprintf("/%s/firewall/address-list/print", proto),
+		"=count-only=",
+		"?list=" + listName,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if r.Done == nil {
+		return 0, fmt.Errorf("no reply for count-only")
+	}
+	return strconv.Atoi(r.Done.Map["ret"])
+}
+
+// routerStatsLoop periodically collects address-list sizes and firewall rule counters from the MikroTik
+func (mal *mikrotikAddrList) routerStatsLoop() {
+	for {
+		time.Sleep(routerStatsInterval)
+		mal.collectRouterStats()
+	}
+}
+
+// collectRouterStats updates metrics with current size of address-lists created by the bouncer
+// and packets/bytes counters of the configured firewall rules
+func (mal *mikrotikAddrList) collectRouterStats() {
+	if !isLeader() {
+		return
+	}
+	c, err := mal.conn.acquire()
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Str("func", "collectRouterStats").
+			Msg("Mikrotik not available, skipping router stats")
+		return
+	}
+	defer mal.conn.release()
+
+	protos := []string{}
+	if useIPV4 {
+		protos = append(protos, "ip")
+	}
+	if useIPV6 {
+		protos = append(protos, "ipv6")
+	}
+
+	countFailed := false
+	mal.currentLists.Range(func(prefix, listName any) bool {
+		for _, proto := range protos {
+			count, err := countAddressList(c, proto, listName.(string))
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("func", "collectRouterStats").
+					Str("proto", proto).
+					Str("list_name", listName.(string)).
+					Msg("Failed to count address-list entries")
+				countFailed = true
+				return false
+			}
+			metricRouterListEntries.WithLabelValues(proto, prefix.(string)).Set(float64(count))
+		}
+		return true
+	})
+	if countFailed {
+		metricRouterStats.WithLabelValues("error").Inc()
+		return
+	}
+
+	type listRule struct {
+		list string
+		firewallRule
+	}
+	var rules []listRule
+	for _, rule := range banRules() {
+		rules = append(rules, listRule{addressList, rule})
+	}
+	for _, list := range mal.typed {
+		for _, rule := range list.rules() {
+			rules = append(rules, listRule{list.prefix, rule})
+		}
+	}
+	if permanentList != "" {
+		for _, rule := range live.Load().permanentRules {
+			rules = append(rules, listRule{permanentList, rule})
+		}
+	}
+
+	type ruleSample struct {
+		labels []string
+		ruleCounter
+	}
+	var samples []ruleSample
+	tables := map[string][]ruleCounter{}
+	for _, rule := range rules {
+		table := rule.proto + "/" + rule.mode
+		counters, ok := tables[table]
+		if !ok {
+			counters, err = readFirewallCounters(c, rule.proto, rule.mode)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("func", "collectRouterStats").
+					Str("proto", rule.proto).
+					Str("mode", rule.mode).
+					Msg("Failed to read firewall rule counters")
+				metricRouterStats.WithLabelValues("error").Inc()
+				return
+			}
+			tables[table] = counters
+		}
+		for id := range strings.SplitSeq(rule.ids, ",") {
+			samples = append(samples, ruleSample{
+				labels:      []string{rule.proto, rule.mode, rule.where, id, rule.list},
+				ruleCounter: sumRuleCounters(counters, id),
+			})
+		}
+	}
+	// rules can change on config reload, so series of rules which are no longer configured are dropped
+	metricRouterRulePackets.Reset()
+	metricRouterRuleBytes.Reset()
+	for _, sample := range samples {
+		metricRouterRulePackets.WithLabelValues(sample.labels...).Set(float64(sample.packets))
+		metricRouterRuleBytes.WithLabelValues(sample.labels...).Set(float64(sample.bytes))
+	}
+	metricRouterStats.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCollectRouterStatsRules(t *testing.T) {
+	useIPV4, useIPV6 = true, false
+	leader = nil
+	addressList = "crowdsec"
+	permanentList = ""
+	fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+		if words[0] != "/ip/firewall/filter/print" {
+			return nil, "no such command"
+		}
+		return []map[string]string{
+			{"packets": "1", "bytes": "100"},
+			{"packets": "2", "bytes": "200"},
+			{"packets": "3", "bytes": "300"},
+		}, ""
+	}}
+	mc := newMikrotikConnection()
+	mc.dial = fr.dial
+	mal := &mikrotikAddrList{conn: mc}
+	packets := func(id string) float64 {
+		return metricValue(t, "cs_mikrotik_bouncer_mikrotik_firewall_rule_packets",
+			map[string]string{"proto": "ip", "table": "filter", "direction": "src", "rule": id, "list": "crowdsec"})
+	}
+
+	useSettings(t, &settings{banRules: []firewallRule{{proto: "ip", mode: "filter", where: "src", ids: "1"}}})
+	mal.collectRouterStats()
+	if got := packets("1"); got != 2 {
+		t.Fatalf("packets of rule 1 = %v, want 2", got)
+	}
+
+	// rule changed by config reload, series of the old rule is dropped
+	useSettings(t, &settings{banRules: []firewallRule{{proto: "ip", mode: "filter", where: "src", ids: "2"}}})
+	mal.collectRouterStats()
+	if got := packets("2"); got != 3 {
+		t.Errorf("packets of rule 2 = %v, want 3", got)
+	}
+	if got := packets("1"); got != 0 {
+		t.Errorf("packets of removed rule 1 = %v, want series removed", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// familySummary counts addresses of single IP family sent to address-list in one update
+type familySummary struct {
+	added     atomic.Int64
+	failed    atomic.Int64
+	truncated atomic.Int64 // ttl truncated to default_ttl_max
+	permanent atomic.Int64 // ban without ttl converted to expiring one
+}
+
+// syncSummary replaces per-address logs of address-list update with a single log line,
+// shard sessions share the same summary, so counters are atomic
+type syncSummary struct {
+	start    time.Time
+	families map[string]*familySummary
+}
+
+func newSyncSummary() *syncSummary {
+	return &syncSummary{
+		start:    time.Now(),
+		families: map[string]*familySummary{"ip": {}, "ipv6": {}},
+	}
+}
+
+// prepared counts address about to be added, permanent tells if it had no ttl before addressTTL,
+// safe to call on nil summary
+func (s *syncSummary) prepared(proto string, permanent bool, ttlTruncated string) {
+	if s == nil {
+		return
+	}
+	f, ok := s.families[proto]
+	if !ok {
+		return
+	}
+	if permanent {
+		f.permanent.Add(1)
+	}
+	if ttlTruncated == "true" {
+		f.truncated.Add(1)
+	}
+}
+
+// result counts added or failed addresses, safe to call on nil summary
+func (s *syncSummary) result(proto string, count int, err error) {
+	if s == nil {
+		return
+	}
+	f, ok := s.families[proto]
+	if !ok {
+		return
+	}
+	if err != nil {
+		f.failed.Add(int64(count))
+		return
+	}
+	f.added.Add(int64(count))
+}
+
+// log writes summary of filling address-list, or shards of it
+func (s *syncSummary) log(prefix string, listName string, err error) {
+	logger := log.Info()
+	if err != nil {
+		logger = log.Warn().Err(err)
+	}
+	for _, proto := range []string{"ip", "ipv6"} {
+		if (proto == "ip" && !useIPV4) || (proto == "ipv6" && !useIPV6) {
+			continue
+		}
+		f := s.families[proto]
+		logger = logger.Dict(proto, zerolog.Dict().
+			Int64("added", f.added.Load()).
+			Int64("failed", f.failed.Load()).
+			Int64("truncated", f.truncated.Load()).
+			Int64("permanent", f.permanent.Load()),
+		)
+	}
+	logger.
+		Str("func", "syncList").
+		Str("list_prefix", prefix).
+		Str("list_name", listName).
+		Str("duration", time.Since(s.start).String()).
+		Msg("Address-list update summary")
+}
+
+// detailLog returns logger for per-address and per-decision messages,
+// which logs only every log_sample_rate message
+func detailLog() *zerolog.Logger {
+	return &live.Load().detailLog
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+func TestSyncSummaryLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+	useIPV4, useIPV6 = true, false
+
+	s := newSyncSummary()
+	s.prepared("ip", true, "false")
+	s.prepared("ip", false, "true")
+	s.prepared("ip", false, "false")
+	s.result("ip", 2, nil)
+	s.result("ip", 1, errors.New("failure"))
+	s.prepared("ipv6", true, "true") // counted, but ipv6 is disabled and not logged
+	s.log("crowdsec", "crowdsec_1", nil)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected single json log line, got %q: %s", buf.String(), err)
+	}
+	want := map[string]any{"added": 2.0, "failed": 1.0, "truncated": 1.0, "permanent": 1.0}
+	ip, _ := entry["ip"].(map[string]any)
+	for key, value := range want {
+		if ip[key] != value {
+			t.Errorf("ip %s = %v, want %v", key, ip[key], value)
+		}
+	}
+	if _, ok := entry["ipv6"]; ok {
+		t.Errorf("ipv6 summary logged with ipv6 disabled: %s", buf.String())
+	}
+	if entry["list_name"] != "crowdsec_1" || entry["level"] != "info" {
+		t.Errorf("unexpected summary: %s", buf.String())
+	}
+
+	// nil summary is used outside of address-list update
+	var nilSummary *syncSummary
+	nilSummary.prepared("ip", true, "true")
+	nilSummary.result("ip", 1, nil)
+}
+
+func TestLogSampleRate(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	t.Cleanup(func() {
+		log.Logger = logger
+		viper.Reset()
+	})
+	useIPV4, useIPV6 = false, false
+	typedLists = nil
+	mikrotikShards = 1
+
+	viper.Set("log_sample_rate", "0")
+	if _, err := loadSettings(); err == nil {
+		t.Error("log_sample_rate 0 accepted")
+	}
+
+	for _, tt := range []struct {
+		rate string
+		want int
+	}{
+		{"1", 9},
+		{"3", 3},
+	} {
+		buf.Reset()
+		viper.Set("log_sample_rate", tt.rate)
+		s, err := loadSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		useSettings(t, s)
+		for range 9 {
+			detailLog().Info().Msg("address")
+		}
+		log.Info().Msg("summary")
+		lines := strings.Count(buf.String(), "\n")
+		if lines != tt.want+1 {
+			t.Errorf("log_sample_rate %s: logged %d lines, want %d detail lines and the summary", tt.rate, lines, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/rs/zerolog/log"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseFingerprint parses SHA-256 certificate fingerprint in hex,
+// with optional colons, as printed by openssl x509 -fingerprint -sha256
+func parseFingerprint(value string) ([]byte, error) {
+	fp, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(value), ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(fp) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(fp))
+	}
+	return fp, nil
+}
+
+// newMikrotikTLSConfig creates tls.Config used to connect to MikroTik api-ssl service
+//
+// caFile - PEM bundle with CA certificates to verify router certificate, system pool if empty
+//
+// fingerprint - SHA-256 fingerprint of the router certificate, if set then certificate must match it,
+// and chain is verified only if caFile is also set, so self-signed certificates can be used
+//
+// certFile, keyFile - client certificate and key in PEM format
+//
+// serverName - name to verify router certificate against, defaults to host from mikrotik_host
+//
+// minVersion - minimal TLS version, such as 1.2
+//
+// insecure - skip verification of the router certificate completely
+func newMikrotikTLSConfig(caFile, fingerprint, certFile, keyFile, serverName, minVersion string, insecure bool) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid minimal TLS version '%s', valid values are 1.0, 1.1, 1.2, 1.3", minVersion)
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: version, //nolint:gosec
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both client certificate and key must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if insecure {
+		cfg.InsecureSkipVerify = true //nolint:gosec
+		return cfg, nil
+	}
+
+	if fingerprint != "" {
+		fp, err := parseFingerprint(fingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate fingerprint: %w", err)
+		}
+		// default verification would reject self-signed certificates, so do it on our own
+		cfg.InsecureSkipVerify = true //nolint:gosec
+		roots := cfg.RootCAs
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate presented by mikrotik")
+			}
+			leaf := cs.PeerCertificates[0]
+			sum := sha256.Sum256(leaf.Raw)
+			if !bytes.Equal(sum[:], fp) {
+				return fmt.Errorf("certificate fingerprint mismatch, got %s", hex.EncodeToString(sum[:]))
+			}
+			if roots == nil {
+				return nil
+			}
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       cs.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := leaf.Verify(opts)
+			return err
+		}
+	}
+
+	return cfg, nil
+}
+
+// dialTLS connects to MikroTik over TLS and logs in,
+// it does the same as routeros.DialTLSTimeout but reports handshake result
+func dialTLS() (*routeros.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := (&tls.Dialer{Config: mikrotikTLSConfig}).DialContext(ctx, "tcp", mikrotikHost)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("func", "dialTLS").
+			Str("host", mikrotikHost).
+			Msg("TLS handshake with mikrotik failed")
+		metricMikrotikTLSHandshake.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("could not connect to router os: %w", err)
+	}
+	metricMikrotikTLSHandshake.WithLabelValues("success").Inc()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	version := tls.VersionName(state.Version)
+	cipher := tls.CipherSuiteName(state.CipherSuite)
+	metricMikrotikTLSInfo.Reset()
+	metricMikrotikTLSInfo.WithLabelValues(version, cipher).Set(1)
+
+	event := log.Info().
+		Str("func", "dialTLS").
+		Str("host", mikrotikHost).
+		Str("server_name", state.ServerName).
+		Str("tls_version", version).
+		Str("cipher_suite", cipher)
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		sum := sha256.Sum256(leaf.Raw)
+		metricMikrotikTLSCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+		event = event.
+			Str("subject", leaf.Subject.String()).
+			Str("issuer", leaf.Issuer.String()).
+			Str("not_after", leaf.NotAfter.String()).
+			Str("fingerprint_sha256", hex.EncodeToString(sum[:]))
+	}
+	event.Msg("TLS handshake with mikrotik completed")
+
+	c, err := routeros.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to router os: %w; close: %w", err, conn.Close())
+	}
+	if err = c.LoginContext(ctx, username, password); err != nil {
+		return nil, fmt.Errorf("could not login: %w; close %w", err, c.Close())
+	}
+	return c, nil
+}
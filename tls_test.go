@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("router"))
+	hexLower := "3b1f8d0e5a1d35c6d8b4b8e3c8a1e0f4b0f1d4a6e2c7b9d8e5f3a2c1b0d9e8f7"
+	want, _ := hex.DecodeString(hexLower)
+	tests := []struct {
+		name    string
+		value   string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "hex", value: hexLower, want: want},
+		{name: "openssl format", value: "3B:1F:8D:0E:5A:1D:35:C6:D8:B4:B8:E3:C8:A1:E0:F4:B0:F1:D4:A6:E2:C7:B9:D8:E5:F3:A2:C1:B0:D9:E8:F7", want: want},
+		{name: "surrounding spaces", value: "  " + hexLower + "\n", want: want},
+		{name: "sum", value: hex.EncodeToString(sum[:]), want: sum[:]},
+		{name: "sha1 length", value: "da39a3ee5e6b4b0d3255bfef95601890afd80709", wantErr: true},
+		{name: "not hex", value: "zz" + hexLower[2:], wantErr: true},
+		{name: "odd length", value: hexLower[1:], wantErr: true},
+		{name: "empty", value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFingerprint(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseFingerprint() = %x, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFingerprint() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("parseFingerprint() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMikrotikTLSConfigMinVersion(t *testing.T) {
+	for _, version := range []string{"1.0", "1.1", "1.2", "1.3"} {
+		cfg, err := newMikrotikTLSConfig("", "", "", "", "", version, false)
+		if err != nil {
+			t.Fatalf("min version %s: %v", version, err)
+		}
+		if cfg.MinVersion != tlsVersions[version] {
+			t.Errorf("min version %s: got %x", version, cfg.MinVersion)
+		}
+	}
+	if _, err := newMikrotikTLSConfig("", "", "", "", "", "1.4", false); err == nil {
+		t.Error("min version 1.4: want error")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tracer is a no-op until initTelemetry registers OTLP trace provider
+var tracer = otel.Tracer(bouncerType)
+
+// insertSpanBatch is number of address-list inserts grouped in a single span,
+// so that traces of big lists stay readable
+const insertSpanBatch = 1000
+
+// initTelemetry sets up OpenTelemetry trace and metric providers exporting over OTLP
+// to otel_endpoint, depending on otel_traces_enable and otel_metrics_enable
+//
+// returns function which flushes pending data and stops the providers
+func initTelemetry(ctx context.Context) (func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", bouncerType),
+		attribute.String("service.version", GitCommit),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otel resource: %w", err)
+	}
+
+	var shutdowns []func(context.Context) error
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdowns {
+			errs = append(errs, fn(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	if otelTracesEnable {
+		var exporter sdktrace.SpanExporter
+		if otelProtocol == "http" {
+			opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(otelEndpoint)}
+			if otelInsecure {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			exporter, err = otlptracehttp.New(ctx, opts...)
+		} else {
+			opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(otelEndpoint)}
+			if otelInsecure {
+				opts = append(opts, otlptracegrpc.WithInsecure())
+			}
+			exporter, err = otlptracegrpc.New(ctx, opts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp trace exporter: %w", err)
+		}
+
+		tp := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(otelSampleRatio))),
+		)
+		otel.SetTracerProvider(tp)
+		tracer = tp.Tracer(bouncerType)
+		shutdowns = append(shutdowns, tp.Shutdown)
+	}
+
+	if otelMetricsEnable {
+		var exporter sdkmetric.Exporter
+		if otelProtocol == "http" {
+			opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(otelEndpoint)}
+			if otelInsecure {
+				opts = append(opts, otlpmetrichttp.WithInsecure())
+			}
+			exporter, err = otlpmetrichttp.New(ctx, opts...)
+		} else {
+			opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(otelEndpoint)}
+			if otelInsecure {
+				opts = append(opts, otlpmetricgrpc.WithInsecure())
+			}
+			exporter, err = otlpmetricgrpc.New(ctx, opts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp metric exporter: %w", err)
+		}
+
+		// export the same metrics which are exposed on /metrics
+		reader := sdkmetric.NewPeriodicReader(exporter,
+			sdkmetric.WithInterval(otelMetricsInterval),
+			sdkmetric.WithProducer(prombridge.NewMetricProducer()),
+		)
+		mp := sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(reader),
+			sdkmetric.WithResource(res),
+		)
+		otel.SetMeterProvider(mp)
+		shutdowns = append(shutdowns, mp.Shutdown)
+	}
+
+	log.Info().
+		Str("func", "initTelemetry").
+		Bool("traces", otelTracesEnable).
+		Bool("metrics", otelMetricsEnable).
+		Str("protocol", otelProtocol).
+		Str("endpoint", otelEndpoint).
+		Msg("OpenTelemetry export enabled")
+
+	return shutdown, nil
+}
+
+// linkSync remembers span which changed the cache, so that the next mikrotik update links to it
+func (mal *mikrotikAddrList) linkSync(sc trace.SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	mal.linksMutex.Lock()
+	defer mal.linksMutex.Unlock()
+	mal.syncLinks = append(mal.syncLinks, trace.Link{SpanContext: sc})
+}
+
+// takeSyncLinks returns links remembered by linkSync and clears them
+func (mal *mikrotikAddrList) takeSyncLinks() []trace.Link {
+	mal.linksMutex.Lock()
+	defer mal.linksMutex.Unlock()
+	links := mal.syncLinks
+	mal.syncLinks = nil
+	return links
+}
+
+// endSpan records error in the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
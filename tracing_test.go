@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanRecorder keeps ended spans in memory
+type spanRecorder struct {
+	mutex sync.Mutex
+	ended []sdktrace.ReadOnlySpan
+}
+
+func (r *spanRecorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (r *spanRecorder) Shutdown(context.Context) error                  { return nil }
+func (r *spanRecorder) ForceFlush(context.Context) error                { return nil }
+
+func (r *spanRecorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ended = append(r.ended, s)
+}
+
+// spans returns ended spans with given name
+func (r *spanRecorder) spans(name string) []sdktrace.ReadOnlySpan {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var out []sdktrace.ReadOnlySpan
+	for _, s := range r.ended {
+		if s.Name() == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestSyncSpanLinks(t *testing.T) {
+	useSettings(t, &settings{})
+	recorder := &spanRecorder{}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = tp.Tracer(bouncerType)
+	t.Cleanup(func() { tracer = previous })
+
+	useIPV4, useIPV6 = true, true
+	triggerOnUpdate = false
+	mal := newTypedAddrList()
+	mal.conn = newMikrotikConnection()
+	mal.conn.dial = (&fakeRouter{down: true}).dial
+
+	mal.decisionProcess(&models.DecisionsStreamResponse{New: []*models.Decision{newDecision("192.0.2.1", "ban", false)}})
+	// nothing changed, so the next update does not need to link to it
+	mal.decisionProcess(&models.DecisionsStreamResponse{New: []*models.Decision{newDecision("192.0.2.1", "ban", true)}})
+	mal.decisionProcess(&models.DecisionsStreamResponse{Deleted: []*models.Decision{newDecision("192.0.2.1", "ban", false)}})
+
+	runMikrotikCommands(mal)
+	runMikrotikCommands(mal)
+
+	decisions := recorder.spans("decisionProcess")
+	syncs := recorder.spans("runMikrotikCommands")
+	if len(decisions) != 3 || len(syncs) != 2 {
+		t.Fatalf("got %d decisionProcess and %d runMikrotikCommands spans, want 3 and 2", len(decisions), len(syncs))
+	}
+
+	var linked []trace.SpanContext
+	for _, link := range syncs[0].Links() {
+		linked = append(linked, link.SpanContext)
+	}
+	want := []trace.SpanContext{decisions[0].SpanContext(), decisions[2].SpanContext()}
+	if len(linked) != len(want) || !linked[0].Equal(want[0]) || !linked[1].Equal(want[1]) {
+		t.Errorf("update links = %v, want decision spans which changed the cache %v", linked, want)
+	}
+	if syncs[0].Parent().IsValid() {
+		t.Error("update span is not a new root")
+	}
+	if syncs[0].SpanContext().TraceID() == decisions[0].SpanContext().TraceID() {
+		t.Error("update span is in the trace of decision span")
+	}
+
+	// links are used only once
+	if n := len(syncs[1].Links()); n != 0 {
+		t.Errorf("second update has %d links, want 0", n)
+	}
+}
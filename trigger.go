@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// syncTrigger coalesces requests for mikrotik update, so that a burst of requests
+// results in a single update instead of a queue of updates waiting for the lock
+type syncTrigger struct {
+	requests chan struct{} // pending request, buffered so that request() never blocks
+	run      func()        // executes mikrotik update
+	sched    *adaptiveScheduler
+}
+
+// newSyncTrigger creates trigger, sched is optional and if set then it provides
+// spacing between updates instead of sync_min_spacing
+func newSyncTrigger(run func(), sched *adaptiveScheduler) *syncTrigger {
+	return &syncTrigger{
+		requests: make(chan struct{}, 1),
+		run:      run,
+		sched:    sched,
+	}
+}
+
+// minSpacing returns minimum time between the end of mikrotik update and start of the next one
+func (t *syncTrigger) minSpacing() time.Duration {
+	if t.sched != nil {
+		return t.sched.minSpacing()
+	}
+	return syncMinSpacing
+}
+
+// request asks for mikrotik update, source tells what requested it, such as decisions or periodic,
+// returns immediately, if there is already pending request then it is merged with it
+func (t *syncTrigger) request(source string) {
+	metricSyncRequests.WithLabelValues(source).Inc()
+	select {
+	case t.requests <- struct{}{}:
+	default:
+	}
+}
+
+// loop waits for requests and runs mikrotik update once requests stop coming for sync_debounce,
+// but no later than sync_max_delay after the first request,
+// and no sooner than sync_min_spacing after previous update finished
+func (t *syncTrigger) loop() {
+	var lastRun time.Time
+	for {
+		<-t.requests
+		first := time.Now()
+		deadline := first.Add(syncMaxDelay)
+
+		quiet := time.NewTimer(min(syncDebounce, syncMaxDelay))
+	debounce:
+		for {
+			select {
+			case <-t.requests:
+				wait := min(syncDebounce, time.Until(deadline))
+				if wait <= 0 {
+					break debounce
+				}
+				quiet.Reset(wait)
+			case <-quiet.C:
+				break debounce
+			}
+		}
+		quiet.Stop()
+
+		if wait := time.Until(lastRun.Add(t.minSpacing())); wait > 0 {
+			log.Debug().
+				Str("func", "syncTrigger").
+				Str("wait", wait.String()).
+				Msg("Delaying mikrotik update to keep sync_min_spacing")
+			time.Sleep(wait)
+		}
+
+		// requests received while waiting are served by this update, because it reads the cache when it runs
+		select {
+		case <-t.requests:
+		default:
+		}
+
+		metricSyncDelay.Observe(time.Since(first).Seconds())
+		runStart := time.Now()
+		t.run()
+		lastRun = time.Now()
+		if t.sched != nil {
+			t.sched.observeSync(lastRun.Sub(runStart))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// startTrigger runs trigger loop with given timings and returns channel receiving start time of each update
+func startTrigger(t *testing.T, debounce, maxDelay, spacing time.Duration) (*syncTrigger, <-chan time.Time) {
+	t.Helper()
+	syncDebounce, syncMaxDelay, syncMinSpacing = debounce, maxDelay, spacing
+	runs := make(chan time.Time, 16)
+	trigger := newSyncTrigger(func() { runs <- time.Now() }, nil)
+	go trigger.loop()
+	return trigger, runs
+}
+
+func waitRun(t *testing.T, runs <-chan time.Time, timeout time.Duration) time.Time {
+	t.Helper()
+	select {
+	case at := <-runs:
+		return at
+	case <-time.After(timeout):
+		t.Fatalf("no update within %s", timeout)
+	}
+	return time.Time{}
+}
+
+func expectNoRun(t *testing.T, runs <-chan time.Time, d time.Duration) {
+	t.Helper()
+	select {
+	case <-runs:
+		t.Fatalf("unexpected update")
+	case <-time.After(d):
+	}
+}
+
+func TestSyncTriggerDebounce(t *testing.T) {
+	trigger, runs := startTrigger(t, 100*time.Millisecond, 2*time.Second, 0)
+
+	start := time.Now()
+	trigger.request("test")
+	at := waitRun(t, runs, time.Second)
+	if d := at.Sub(start); d < 100*time.Millisecond {
+		t.Errorf("update started %s after request, before sync_debounce", d)
+	}
+	expectNoRun(t, runs, 300*time.Millisecond)
+}
+
+func TestSyncTriggerCoalesce(t *testing.T) {
+	trigger, runs := startTrigger(t, 500*time.Millisecond, 5*time.Second, 0)
+
+	// burst shorter than debounce between requests ends in a single update after the last request
+	var last time.Time
+	for range 5 {
+		last = time.Now()
+		trigger.request("test")
+		time.Sleep(10 * time.Millisecond)
+	}
+	at := waitRun(t, runs, 2*time.Second)
+	if d := at.Sub(last); d < 500*time.Millisecond {
+		t.Errorf("update started %s after the last request, before sync_debounce", d)
+	}
+	expectNoRun(t, runs, 300*time.Millisecond)
+}
+
+func TestSyncTriggerMaxDelay(t *testing.T) {
+	trigger, runs := startTrigger(t, 100*time.Millisecond, 300*time.Millisecond, 0)
+
+	// requests never stop for sync_debounce, so update must run after sync_max_delay anyway
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				trigger.request("test")
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}()
+
+	start := time.Now()
+	at := waitRun(t, runs, 2*time.Second)
+	if d := at.Sub(start); d < 250*time.Millisecond || d > time.Second {
+		t.Errorf("update started %s after the first request, want about sync_max_delay", d)
+	}
+}
+
+func TestSyncTriggerMinSpacing(t *testing.T) {
+	trigger, runs := startTrigger(t, 10*time.Millisecond, time.Second, 400*time.Millisecond)
+
+	trigger.request("test")
+	first := waitRun(t, runs, time.Second)
+
+	trigger.request("test")
+	second := waitRun(t, runs, 2*time.Second)
+	if d := second.Sub(first); d < 400*time.Millisecond {
+		t.Errorf("updates started %s apart, want at least sync_min_spacing", d)
+	}
+}
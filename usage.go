@@ -0,0 +1,151 @@
+package main
+
+import (
+	"maps"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+// bouncerType is reported to CrowdSec LAPI in usage metrics
+const bouncerType = "cs-mikrotik-bouncer-alt"
+
+// usageMetrics computes remediation metrics reported to CrowdSec LAPI,
+// they are visible in `cscli metrics` and in the CrowdSec console
+type usageMetrics struct {
+	mal *mikrotikAddrList
+
+	// dropped counters from previous report, per ip_type, to send only the delta
+	lastDropped map[string]ruleCounter
+}
+
+// ipTypeFromProto converts mikrotik protocol to ip_type label value
+func ipTypeFromProto(proto string) string {
+	if proto == "ipv6" {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+func metricItem(name string, unit string, value float64, labels models.MetricsLabels) *models.MetricsDetailItem {
+	return &models.MetricsDetailItem{
+		Name:   &name,
+		Unit:   &unit,
+		Value:  &value,
+		Labels: labels,
+	}
+}
+
+// update is called by csbouncer.MetricsProvider before each report
+func (um *usageMetrics) update(met *models.RemediationComponentsMetrics, interval time.Duration) {
+	now := time.Now().Unix()
+	window := int64(interval.Seconds())
+
+	var items []*models.MetricsDetailItem
+
+	type key struct{ origin, ipType string }
+	active := map[key]int{}
+	cached := um.mal.cache.Items()
+	if um.mal.permanent != nil {
+		maps.Copy(cached, um.mal.permanent.Items())
+	}
+	for _, item := range cached {
+		k := key{
+			origin: item.Value().usageOrigin(),
+			ipType: ipTypeFromProto(getProtoCmd(item.Key())),
+		}
+		active[k]++
+	}
+	for k, count := range active {
+		items = append(items, metricItem("active_decisions", "ip", float64(count), models.MetricsLabels{
+			"origin":  k.origin,
+			"ip_type": k.ipType,
+		}))
+	}
+
+	// rule counters are per rule and not per address, so dropped traffic can not be split by origin
+	for ipType, delta := range um.droppedDelta() {
+		labels := models.MetricsLabels{"ip_type": ipType}
+		items = append(items,
+			metricItem("dropped", "packet", float64(delta.packets), labels),
+			metricItem("dropped", "byte", float64(delta.bytes), labels),
+		)
+	}
+
+	met.Metrics = append(met.Metrics, &models.DetailedMetrics{
+		Meta: &models.MetricsMeta{
+			UtcNowTimestamp:   &now,
+			WindowSizeSeconds: &window,
+		},
+		Items: items,
+	})
+
+	log.Debug().
+		Str("func", "usageMetrics").
+		Int("items", len(items)).
+		Msg("Usage metrics prepared for CrowdSec LAPI")
+}
+
+// snapshotDropped reads counters of configured ban firewall rules, summed per ip_type,
+// it is called by mikrotik update so that usage metrics never wait for the connection
+func (mal *mikrotikAddrList) snapshotDropped(c mikrotikClient) {
+	current := map[string]ruleCounter{}
+	tables := map[string][]ruleCounter{}
+	for _, rule := range banRules() {
+		if (rule.proto == "ip" && !useIPV4) || (rule.proto == "ipv6" && !useIPV6) {
+			continue
+		}
+		table := rule.proto + "/" + rule.mode
+		if _, ok := tables[table]; !ok {
+			counters, err := readFirewallCounters(c, rule.proto, rule.mode)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("func", "snapshotDropped").
+					Str("proto", rule.proto).
+					Str("mode", rule.mode).
+					Msg("Failed to read firewall rule counters")
+				return
+			}
+			tables[table] = counters
+		}
+		sum := sumRuleCounters(tables[table], rule.ids)
+		ipType := ipTypeFromProto(rule.proto)
+		total := current[ipType]
+		total.packets += sum.packets
+		total.bytes += sum.bytes
+		current[ipType] = total
+	}
+	mal.dropped.Store(&current)
+}
+
+// droppedDelta returns traffic dropped by configured ban firewall rules since previous call, per ip_type,
+// from counters read by the last mikrotik update
+func (um *usageMetrics) droppedDelta() map[string]ruleCounter {
+	if !isLeader() {
+		return nil
+	}
+	snapshot := um.mal.dropped.Load()
+	if snapshot == nil {
+		return nil
+	}
+	current := *snapshot
+
+	delta := map[string]ruleCounter{}
+	for ipType, cur := range current {
+		last, seen := um.lastDropped[ipType]
+		if !seen {
+			// first report after start, we do not know what was dropped in the window
+			continue
+		}
+		// counters are reset when rule is modified or router restarts
+		if cur.packets < last.packets || cur.bytes < last.bytes {
+			delta[ipType] = cur
+			continue
+		}
+		delta[ipType] = ruleCounter{packets: cur.packets - last.packets, bytes: cur.bytes - last.bytes}
+	}
+	um.lastDropped = current
+	return delta
+}
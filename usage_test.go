@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+func TestUsageOrigin(t *testing.T) {
+	tests := []struct {
+		entry cacheEntry
+		want  string
+	}{
+		{cacheEntry{origin: "crowdsec", scenario: "crowdsecurity/ssh-bf"}, "crowdsec"},
+		{cacheEntry{origin: "lists", scenario: "firehol_level1"}, "lists:firehol_level1"},
+		{cacheEntry{origin: "cscli", scenario: "manual"}, "cscli"},
+		{cacheEntry{origin: "lists"}, "lists"},
+		{cacheEntry{}, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.usageOrigin(); got != tt.want {
+			t.Errorf("%+v.usageOrigin() = %s, want %s", tt.entry, got, tt.want)
+		}
+	}
+}
+
+// usageItems returns values of usage metric items by name, unit and labels
+func usageItems(met *models.RemediationComponentsMetrics) map[string]float64 {
+	items := map[string]float64{}
+	for _, detailed := range met.Metrics {
+		for _, item := range detailed.Items {
+			key := fmt.Sprintf("%s/%s %v", *item.Name, *item.Unit, item.Labels)
+			items[key] += *item.Value
+		}
+	}
+	return items
+}
+
+func TestUsageMetricsUpdate(t *testing.T) {
+	useIPV4, useIPV6 = true, true
+	useSettings(t, &settings{banRules: []firewallRule{{proto: "ip", mode: "filter", where: "src", ids: "1"}}})
+
+	// packets of filter rule 1, changed by the test between reports
+	var packets atomic.Uint64
+	fr := &fakeRouter{reply: func(words []string) ([]map[string]string, string) {
+		if words[0] != "/ip/firewall/filter/print" {
+			return nil, "no such command"
+		}
+		p := packets.Load()
+		return []map[string]string{
+			{"packets": "999", "bytes": "99900"},
+			{"packets": fmt.Sprint(p), "bytes": fmt.Sprint(p * 100)},
+		}, ""
+	}}
+	mal := connectedAddrList(t, fr)
+	cache := ttlcache.New[string, cacheEntry]()
+	cache.Set("192.0.2.1", cacheEntry{"crowdsec", "crowdsecurity/ssh-bf", "Ip"}, time.Hour)
+	cache.Set("192.0.2.2", cacheEntry{"crowdsec", "crowdsecurity/http-probing", "Ip"}, time.Hour)
+	cache.Set("198.51.100.0/24", cacheEntry{"lists", "firehol_level1", "Range"}, time.Hour)
+	cache.Set("2001:db8::1/128", cacheEntry{"cscli", "manual", "Ip"}, time.Hour)
+	mal.cache = cache
+	um := &usageMetrics{mal: mal}
+
+	report := func() map[string]float64 {
+		met := &models.RemediationComponentsMetrics{}
+		um.update(met, time.Minute)
+		if len(met.Metrics) != 1 || *met.Metrics[0].Meta.WindowSizeSeconds != 60 {
+			t.Fatalf("unexpected report %+v", met.Metrics)
+		}
+		return usageItems(met)
+	}
+
+	// counters are read by mikrotik update, before the first one nothing is reported
+	items := report()
+	if _, ok := items["dropped/packet map[ip_type:ipv4]"]; ok {
+		t.Errorf("dropped traffic reported before any update: %v", items)
+	}
+
+	packets.Store(10)
+	mal.snapshotDropped(mal.c)
+	items = report()
+	want := map[string]float64{
+		"active_decisions/ip map[ip_type:ipv4 origin:crowdsec]":             2,
+		"active_decisions/ip map[ip_type:ipv4 origin:lists:firehol_level1]": 1,
+		"active_decisions/ip map[ip_type:ipv6 origin:cscli]":                1,
+	}
+	// nothing is known about dropped traffic before the first report
+	if fmt.Sprint(items) != fmt.Sprint(want) {
+		t.Errorf("first report = %v, want %v", items, want)
+	}
+
+	packets.Store(25)
+	mal.snapshotDropped(mal.c)
+	items = report()
+	if got := items["dropped/packet map[ip_type:ipv4]"]; got != 15 {
+		t.Errorf("dropped packets = %v, want 15", got)
+	}
+	if got := items["dropped/byte map[ip_type:ipv4]"]; got != 1500 {
+		t.Errorf("dropped bytes = %v, want 1500", got)
+	}
+
+	// counters were reset by rule change or router restart
+	packets.Store(4)
+	mal.snapshotDropped(mal.c)
+	items = report()
+	if got := items["dropped/packet map[ip_type:ipv4]"]; got != 4 {
+		t.Errorf("dropped packets after counter reset = %v, want 4", got)
+	}
+}